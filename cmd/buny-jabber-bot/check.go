@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"buny-jabber-bot/internal/jabber"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// check - подкоманда check: проверяет конфиг, белый и чёрный списки и печатает найденные проблемы. Возвращает код
+// выхода: 1, если нашлись ошибки, и 0, если только предупреждения или ничего.
+func check(args []string) int {
+	var (
+		flags     = flag.NewFlagSet("check", flag.ContinueOnError)
+		config    = flags.String("config", "", "config file to check instead of the usual locations")
+		whitelist = flags.String("whitelist", "", "whitelist file to check instead of the usual locations")
+		blacklist = flags.String("blacklist", "", "blacklist file to check instead of the usual locations")
+	)
+
+	flags.Usage = func() {
+		fmt.Fprintf( //nolint:errcheck
+			flags.Output(),
+			"Usage: %s check [-config file] [-whitelist file] [-blacklist file]\n",
+			os.Args[0],
+		)
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+
+		return 2
+	}
+
+	// Всё, что бот пишет в лог при чтении конфига, check сообщает сам.
+	log.SetOutput(io.Discard)
+
+	problems, err := jabber.CheckFiles(*config, *whitelist, *blacklist)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err) //nolint:errcheck
+
+		return 1
+	}
+
+	code := 0
+
+	for _, p := range problems {
+		fmt.Println(p) //nolint:forbidigo
+
+		if p.Severity == jabber.CheckError {
+			code = 1
+		}
+	}
+
+	if len(problems) == 0 {
+		fmt.Println("No problems found.") //nolint:forbidigo
+	}
+
+	return code
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -24,6 +24,16 @@ var version string
 func main() {
 	var err error
 
+	// Подкоманды, которым не нужно подключение к серверу.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			os.Exit(replay(os.Args[2:]))
+		case "check":
+			os.Exit(check(os.Args[2:]))
+		}
+	}
+
 	for {
 		var j = jabber.Jabber{ //nolint:exhaustruct
 			SigChan:        make(chan os.Signal, 1),
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+
+	"buny-jabber-bot/internal/jabber"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// replay - подкоманда replay: прогоняет записанный трафик через бота без подключения к серверу и печатает, что бот
+// сделал бы. Возвращает код выхода.
+func replay(args []string) int {
+	var (
+		j = jabber.Jabber{ //nolint:exhaustruct
+			SigChan: make(chan os.Signal, 1),
+		}
+		flags  = flag.NewFlagSet("replay", flag.ContinueOnError)
+		format = flags.String("format", "auto", "recording format: trace (go-xmpp debug output), capture (event_capture) or auto")
+	)
+
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s replay [-format trace|capture|auto] file...\n", os.Args[0]) //nolint:errcheck
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+
+		return 2
+	}
+
+	// Лог уходит в stderr, в stdout - только то, что сделал бы бот.
+	log.SetOutput(os.Stderr)
+	log.SetLevel(log.WarnLevel)
+
+	if err := j.ReadConfig(); err != nil {
+		log.Error(err)
+
+		return 1
+	}
+
+	j.C.Version = version
+
+	if err := j.ReadWhitelist(); err != nil {
+		log.Error(err)
+
+		return 1
+	}
+
+	if err := j.ReadBlacklist(); err != nil {
+		log.Error(err)
+
+		return 1
+	}
+
+	var events []jabber.ReplayEvent
+
+	for _, name := range flags.Args() {
+		e, err := readRecording(name, *format, j.C.Jabber.User+"/"+j.C.Jabber.Resource)
+
+		if err != nil {
+			log.Errorf("Unable to read %s: %s", name, err)
+
+			return 1
+		}
+
+		events = append(events, e...)
+	}
+
+	if err := j.Replay(events, os.Stdout); err != nil {
+		log.Error(err)
+
+		return 1
+	}
+
+	return 0
+}
+
+// readRecording читает запись трафика в формате format. В формате auto запись от event_capture узнаём по тому, что
+// она начинается с json-объекта.
+func readRecording(name, format, ownJid string) ([]jabber.ReplayEvent, error) {
+	buf, err := os.ReadFile(name)
+
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	if format == "auto" {
+		format = "trace"
+
+		if bytes.HasPrefix(bytes.TrimSpace(buf), []byte("{")) {
+			format = "capture"
+		}
+	}
+
+	switch format {
+	case "trace":
+		return jabber.ReadTrace(bytes.NewReader(buf), ownJid) //nolint:wrapcheck
+	case "capture":
+		return jabber.ReadCapture(bytes.NewReader(buf)) //nolint:wrapcheck
+	}
+
+	return nil, fmt.Errorf("unknown format %s", format) //nolint:goerr113
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -5,6 +5,7 @@ go 1.24.3
 require (
 	github.com/davecgh/go-spew v1.1.1
 	github.com/eleksir/go-xmpp v1.6.0
+	github.com/google/uuid v1.6.0
 	github.com/hjson/hjson-go v3.3.0+incompatible
 	github.com/jbrukh/bayesian v0.0.0-20231117143245-13ae6f916c7a
 	github.com/sirupsen/logrus v1.9.3
@@ -13,7 +14,6 @@ require (
 )
 
 require (
-	github.com/google/uuid v1.6.0 // indirect
 	golang.org/x/crypto v0.38.0 // indirect
 	golang.org/x/net v0.40.0 // indirect
 	golang.org/x/sys v0.33.0 // indirect
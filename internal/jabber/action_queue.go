@@ -0,0 +1,618 @@
+package jabber
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eleksir/go-xmpp"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// inFlightTimeout - сколько ждать ответа сервера на muc#admin IQ. Если сервер так и не ответил, IQ перестаёт числиться
+// в полёте и считается потерянным.
+const inFlightTimeout = 5 * time.Minute
+
+// ErrActionQueueFull возвращается, когда очередь модерирующих действий переполнена и действие было отброшено.
+var ErrActionQueueFull = errors.New("action queue is full")
+
+// ModAction описывает одно модерирующее действие над участником комнаты. Действия не выполняются в цикле приёма
+// событий, а складываются в очередь, которую разгребают воркеры.
+type ModAction struct {
+	// Room - комната, в которой производится действие.
+	Room string
+
+	// JID - real jid участника, нужен для смены affiliation (ban).
+	JID string
+
+	// Nick - ник участника в комнате, нужен для смены role (kick, devoice).
+	Nick string
+
+	// Action - что делаем: ban, unban, kick, devoice, voice или retract.
+	Action string
+
+	// Message - stanza-id сообщения участника. Для retract - сообщение, которое надо удалить, для остальных действий -
+	// сообщение, за которое участника наказывают, его Retract удалит вместе с действием.
+	Message string
+
+	// Reason - текст для <reason>, может быть пустым.
+	Reason string
+
+	// Duration - длительность временного бана, 0 - бан постоянный. Снятие бана планируется отдельно, здесь длительность
+	// нужна только для журнала модерации.
+	Duration time.Duration
+
+	// Rule - id сработавшего правила чёрного списка, если действие вызвано правилом.
+	Rule string
+
+	// Why - человекочитаемое объяснение, за что, для журнала модерации.
+	Why string
+
+	// By - кто распорядился, пусто, если бот сам.
+	By string
+
+	// Mode - режим правила, вызвавшего действие, пусто - действует режим комнаты.
+	Mode string
+
+	// VType - тип сообщения, которым будет произнесена пафосная фраза перед баном.
+	VType string
+
+	// Queued - момент, когда действие попало в очередь.
+	Queued time.Time
+}
+
+// ActionQueueStats - метрики очереди модерирующих действий, по ним видно, насколько очередь не успевает.
+type ActionQueueStats struct {
+	// Capacity - ёмкость очереди.
+	Capacity int
+
+	// Depth - сколько действий ждёт в очереди прямо сейчас.
+	Depth int
+
+	// MaxDepth - максимальная наблюдавшаяся глубина очереди.
+	MaxDepth int
+
+	// Enqueued - сколько действий было поставлено в очередь.
+	Enqueued uint64
+
+	// Dropped - сколько действий было отброшено из-за переполнения очереди.
+	Dropped uint64
+
+	// Sent - сколько <item>-ов было отправлено серверу.
+	Sent uint64
+
+	// Batches - сколько muc#admin IQ было отправлено серверу.
+	Batches uint64
+
+	// Acked - на сколько IQ сервер ответил result-ом.
+	Acked uint64
+
+	// Failed - на сколько IQ сервер ответил ошибкой.
+	Failed uint64
+
+	// Lost - на сколько IQ сервер так и не ответил за inFlightTimeout.
+	Lost uint64
+
+	// InFlight - сколько IQ ещё ждут ответа от сервера.
+	InFlight int
+
+	// LastWait - сколько провисело в очереди последнее отправленное действие.
+	LastWait time.Duration
+
+	// MaxWait - максимальное время, которое действие провисело в очереди.
+	MaxWait time.Duration
+}
+
+// ActionQueue ограниченная очередь модерирующих действий с ограничением частоты запросов на комнату.
+type ActionQueue struct {
+	ch       chan ModAction
+	mu       sync.Mutex
+	nextSlot map[string]time.Time
+	inFlight map[string]inFlightIQ
+	stats    ActionQueueStats
+}
+
+// inFlightIQ - отправленный, но ещё не подтверждённый сервером muc#admin IQ: какие в нём действия и когда он ушёл.
+type inFlightIQ struct {
+	actions []ModAction
+	sent    time.Time
+}
+
+// NewActionQueue создаёт очередь модерирующих действий заданной ёмкости.
+func NewActionQueue(size int) *ActionQueue {
+	q := &ActionQueue{ //nolint:exhaustruct
+		ch:       make(chan ModAction, size),
+		nextSlot: make(map[string]time.Time),
+		inFlight: make(map[string]inFlightIQ),
+	}
+
+	q.stats.Capacity = size
+
+	return q
+}
+
+// Push кладёт действие в очередь, не блокируясь. Если очередь заполнена, действие отбрасывается.
+func (q *ActionQueue) Push(a ModAction) error {
+	if a.Queued.IsZero() {
+		a.Queued = time.Now()
+	}
+
+	select {
+	case q.ch <- a:
+	default:
+		q.mu.Lock()
+		q.stats.Dropped++
+		q.mu.Unlock()
+
+		return ErrActionQueueFull
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.stats.Enqueued++
+
+	if depth := len(q.ch); depth > q.stats.MaxDepth {
+		q.stats.MaxDepth = depth
+	}
+
+	return nil
+}
+
+// Stats возвращает снимок метрик очереди.
+func (q *ActionQueue) Stats() ActionQueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := q.stats
+	stats.Depth = len(q.ch)
+	stats.InFlight = len(q.inFlight)
+
+	return stats
+}
+
+// reserveSlot резервирует ближайшее свободное окно для отправки запроса в комнату и возвращает, сколько до него надо
+// подождать.
+func (q *ActionQueue) reserveSlot(room string, interval time.Duration) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	next := q.nextSlot[room]
+
+	if next.Before(now) {
+		next = now
+	}
+
+	q.nextSlot[room] = next.Add(interval)
+
+	return next.Sub(now)
+}
+
+// sent учитывает отправленный на сервер IQ с пачкой действий.
+func (q *ActionQueue) sent(id string, batch []ModAction) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.inFlight[id] = inFlightIQ{actions: batch, sent: time.Now()}
+	q.stats.Batches++
+	q.stats.Sent += uint64(len(batch))
+
+	for _, a := range batch {
+		wait := time.Since(a.Queued)
+		q.stats.LastWait = wait
+
+		if wait > q.stats.MaxWait {
+			q.stats.MaxWait = wait
+		}
+	}
+}
+
+// IsInFlight сообщает, является ли id идентификатором отправленного нами, но ещё не подтверждённого muc#admin IQ.
+func (q *ActionQueue) IsInFlight(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	_, exist := q.inFlight[id]
+
+	return exist
+}
+
+// Done отмечает IQ с действиями как обработанный сервером, успешно или нет, и возвращает действия из него.
+func (q *ActionQueue) Done(id string, success bool) []ModAction {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	iq, exist := q.inFlight[id]
+
+	if !exist {
+		return nil
+	}
+
+	delete(q.inFlight, id)
+
+	if success {
+		q.stats.Acked++
+	} else {
+		q.stats.Failed++
+	}
+
+	return iq.actions
+}
+
+// expire забывает IQ, на которые сервер не ответил за timeout, и возвращает, сколько их было и какие в них были
+// действия.
+func (q *ActionQueue) expire(timeout time.Duration) (int, []ModAction) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var (
+		expired int
+		actions []ModAction
+	)
+
+	for id, iq := range q.inFlight {
+		if time.Since(iq.sent) > timeout {
+			delete(q.inFlight, id)
+			expired++
+			actions = append(actions, iq.actions...)
+		}
+	}
+
+	q.stats.Lost += uint64(expired)
+
+	return expired, actions
+}
+
+// drain забирает из очереди всё, что в ней осталось.
+func (q *ActionQueue) drain() []ModAction {
+	var actions []ModAction
+
+	for {
+		select {
+		case a := <-q.ch:
+			actions = append(actions, a)
+		default:
+			return actions
+		}
+	}
+}
+
+// Enqueue ставит модерирующее действие в очередь. Если очередь переполнена, действие отбрасывается с ошибкой. В журнал
+// модерации действие попадает, когда станет известно, чем оно кончилось: когда сервер ответит на IQ или когда оно
+// пропадёт.
+func (j *Jabber) Enqueue(a ModAction) error {
+	if err := j.Actions.Push(a); err != nil {
+		j.dropActions(err.Error(), a)
+
+		return err
+	}
+
+	stats := j.Actions.Stats()
+
+	// Сообщаем, что очередь близка к переполнению, пока не начали терять действия.
+	if stats.Depth*4 >= stats.Capacity*3 {
+		log.Warnf("Action queue is filling up: %d of %d slots used", stats.Depth, stats.Capacity)
+	}
+
+	return nil
+}
+
+// ActionsDone вызывается, когда сервер ответил на muc#admin IQ id, и пишет действия из него в журнал модерации с
+// результатом. Ошибка относится ко всему IQ: если сервер отверг хотя бы один <item>, не выполнен ни один, поэтому о
+// каждом действии пишется в лог.
+func (j *Jabber) ActionsDone(id string, success bool) {
+	for _, a := range j.Actions.Done(id, success) {
+		if success {
+			j.AuditAction(a)
+
+			continue
+		}
+
+		log.Errorf("Moderation request %s failed, %s of %s (%s) in %s is not done", id, a.Action, a.JID, a.Nick, a.Room)
+		j.AuditActionResult(a, "server returned error")
+	}
+}
+
+// dropActions пишет в лог и журнал модерации, что действия не выполнены и почему.
+func (j *Jabber) dropActions(why string, actions ...ModAction) {
+	for _, a := range actions {
+		log.Errorf("Dropping %s of %s (%s) in %s: %s", a.Action, a.JID, a.Nick, a.Room, why)
+		j.AuditActionResult(a, why)
+	}
+}
+
+// forgetActions вызывается, когда соединение закрывается: действия, оставшиеся в очереди, уже не будут отправлены, а
+// на отправленные не придёт ответ, поэтому в журнал модерации они пишутся как невыполненные.
+func (j *Jabber) forgetActions() {
+	j.dropActions("connection closed", j.Actions.drain()...)
+
+	_, lost := j.Actions.expire(0)
+
+	j.dropActions("connection closed before server answered", lost...)
+}
+
+// ActionWorker разгребает очередь модерирующих действий. Несколько подряд идущих действий для одной комнаты отправляются
+// одним muc#admin IQ, между запросами в одну и ту же комнату выдерживается пауза room_interval.
+func (j *Jabber) ActionWorker() error {
+	var (
+		batchSize    = j.C.Jabber.ActionQueue.BatchSize
+		batchWait    = time.Duration(j.C.Jabber.ActionQueue.BatchWait) * time.Millisecond
+		roomInterval = time.Duration(j.C.Jabber.ActionQueue.RoomInterval) * time.Millisecond
+	)
+
+	for {
+		var batch []ModAction
+
+		select {
+		case <-j.GTomb.Dying():
+			return nil
+		case a := <-j.Actions.ch:
+			batch = append(batch, a)
+		}
+
+		// Подбираем то, что успело накопиться в очереди, но долго не ждём.
+		timer := time.NewTimer(batchWait)
+
+	collect:
+		for len(batch) < batchSize {
+			select {
+			case a := <-j.Actions.ch:
+				batch = append(batch, a)
+			case <-timer.C:
+				break collect
+			case <-j.GTomb.Dying():
+				timer.Stop()
+				j.dropActions("connection closed", batch...)
+
+				return nil
+			}
+		}
+
+		timer.Stop()
+
+		groups := groupActions(batch)
+
+		for n, group := range groups {
+			// Воркер завершается вместе с соединением, так что оставшиеся действия пачки пропадут, о них надо хотя бы
+			// сказать. О действиях группы, которую отправить не удалось, говорит sendActions.
+			dropRest := func(why string, from int) {
+				for _, rest := range groups[from:] {
+					j.dropActions(why, rest...)
+				}
+			}
+
+			// Пока в комнату нельзя - ждём своей очереди.
+			if wait := j.Actions.reserveSlot(group[0].Room, roomInterval); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-j.GTomb.Dying():
+					dropRest("connection closed", n)
+
+					return nil
+				}
+			}
+
+			if err := j.sendActions(group); err != nil {
+				dropRest("connection failed", n+1)
+
+				return err
+			}
+
+			if !j.GTomb.Alive() {
+				dropRest("connection closed", n+1)
+
+				return nil
+			}
+		}
+	}
+}
+
+// groupActions раскладывает пачку действий по группам, каждая из которых может быть отправлена одним IQ: одна комната
+// и один тип изменения (affiliation или role). Порядок групп соответствует порядку первого действия в группе.
+func groupActions(batch []ModAction) [][]ModAction {
+	var (
+		groups [][]ModAction
+		index  = make(map[string]int)
+	)
+
+	for _, a := range batch {
+		key := a.Room + "\x00" + actionItemKind(a.Action)
+
+		if n, exist := index[key]; exist {
+			groups[n] = append(groups[n], a)
+
+			continue
+		}
+
+		index[key] = len(groups)
+		groups = append(groups, []ModAction{a})
+	}
+
+	return groups
+}
+
+// actionItemKind говорит, меняет ли действие affiliation или role участника, или удаляет его сообщение.
+func actionItemKind(action string) string {
+	switch action {
+	case "ban", "unban":
+		return "affiliation"
+	case "retract":
+		return "retract"
+	}
+
+	return "role"
+}
+
+// actionItem формирует <item> для muc#admin запроса согласно https://xmpp.org/extensions/xep-0045.html#admin .
+func actionItem(a ModAction) string {
+	var item string
+
+	switch a.Action {
+	case "ban":
+		item = fmt.Sprintf("<item affiliation='outcast' jid='%s'>", xmlEscape(a.JID))
+	case "unban":
+		item = fmt.Sprintf("<item affiliation='none' jid='%s'>", xmlEscape(a.JID))
+	case "kick":
+		item = fmt.Sprintf("<item role='none' nick='%s'>", xmlEscape(a.Nick))
+	case "devoice":
+		item = fmt.Sprintf("<item role='visitor' nick='%s'>", xmlEscape(a.Nick))
+	case "voice":
+		item = fmt.Sprintf("<item role='participant' nick='%s'>", xmlEscape(a.Nick))
+	default:
+		return ""
+	}
+
+	if a.Reason != "" {
+		item += "<reason>" + xmlEscape(a.Reason) + "</reason>"
+	} else {
+		item += "<reason />"
+	}
+
+	item += "</item>"
+
+	return item
+}
+
+// sendActions отправляет группу действий для одной комнаты одним muc#admin IQ. Удаление сообщений muc#admin-ом не
+// делается, его отправляет sendRetractions. Действия, которые отправить не удалось, пишутся в журнал модерации как
+// невыполненные.
+func (j *Jabber) sendActions(group []ModAction) error {
+	if actionItemKind(group[0].Action) == "retract" {
+		return j.sendRetractions(group)
+	}
+
+	var (
+		room   = group[0].Room
+		items  string
+		sent   []ModAction
+		hasBan bool
+		newest time.Time
+	)
+
+	for _, a := range group {
+		item := actionItem(a)
+
+		if item == "" {
+			j.dropActions("unknown action", a)
+
+			continue
+		}
+
+		items += item
+		sent = append(sent, a)
+
+		if a.Action == "ban" {
+			hasBan = true
+		}
+
+		if a.Queued.After(newest) {
+			newest = a.Queued
+		}
+	}
+
+	if items == "" {
+		return nil
+	}
+
+	if hasBan {
+		if j.C.Jabber.BanPhrasesEnable {
+			phrase := RandomPhrase(j.C.Jabber.BanPhrases)
+
+			if _, err := j.Talk.Send(
+				xmpp.Chat{ //nolint:exhaustruct
+					Remote: room,
+					Text:   phrase,
+					Type:   group[0].VType,
+				},
+			); err != nil {
+				j.dropActions("connection failed", sent...)
+
+				return fmt.Errorf("unable to send phrase to room %s: %w", room, err)
+			}
+		}
+
+		// Выжидаем некоторое время перед баном. А то можно настолько рано забанить, что сервер не внесёт злодея в
+		// банлист комнаты и пришлёт affiliation: none вместо affiliation: outcast. Время отсчитываем от момента
+		// постановки в очередь, если действие уже провисело в очереди достаточно долго, ждать не надо.
+		if wait := time.Until(newest.Add(time.Duration(j.C.Jabber.BanDelay) * time.Millisecond)); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-j.GTomb.Dying():
+				j.dropActions("connection closed", sent...)
+
+				return nil
+			}
+		}
+	}
+
+	id := "mod-" + uuid.New().String()
+
+	log.Debugf("Sending %d moderation item(s) to %s, id=%s", len(sent), room, id)
+
+	if _, err := j.Talk.RawInformationQuery(
+		j.Talk.JID(),
+		room,
+		id,
+		xmpp.IQTypeSet,
+		"http://jabber.org/protocol/muc#admin",
+		items,
+	); err != nil {
+		j.dropActions("connection failed", sent...)
+
+		return fmt.Errorf("unable to send moderation items to %s: id=%s, err=%w", room, id, err)
+	}
+
+	j.Actions.sent(id, sent)
+
+	for _, a := range sent {
+		log.Infof("Sent %s of %s (%s) in %s", a.Action, a.JID, a.Nick, room)
+	}
+
+	return nil
+}
+
+// LogActionQueueStats периодически пишет в лог метрики очереди модерирующих действий. Заодно она списывает IQ, на
+// которые сервер не ответил, а когда соединение закрывается - всё, что осталось в очереди и в полёте.
+func (j *Jabber) LogActionQueueStats() error {
+	interval := time.Duration(j.C.Jabber.ActionQueue.StatsInterval) * time.Second
+
+	for {
+		select {
+		case <-j.GTomb.Dying():
+			j.forgetActions()
+
+			return nil
+		case <-time.After(interval):
+		}
+
+		if n, lost := j.Actions.expire(inFlightTimeout); n > 0 {
+			log.Warnf("Server did not answer %d moderation IQ(s) in %s, forgetting them", n, inFlightTimeout)
+			j.dropActions("server did not answer", lost...)
+		}
+
+		s := j.Actions.Stats()
+
+		log.Infof(
+			"Action queue: depth=%d/%d max_depth=%d enqueued=%d dropped=%d sent=%d batches=%d acked=%d failed=%d "+
+				"lost=%d in_flight=%d last_wait=%s max_wait=%s",
+			s.Depth, s.Capacity, s.MaxDepth, s.Enqueued, s.Dropped, s.Sent, s.Batches, s.Acked, s.Failed,
+			s.Lost, s.InFlight, s.LastWait, s.MaxWait,
+		)
+	}
+}
+
+// xmlEscape экранирует строку для подстановки в xml, как в значение атрибута, так и в текст.
+func xmlEscape(s string) string {
+	var b strings.Builder
+
+	_ = xml.EscapeText(&b, []byte(s))
+
+	return b.String()
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,395 @@
+package jabber
+
+import (
+	"encoding/xml"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/eleksir/go-xmpp"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Пространства имён xep-0050 (ad-hoc команды) и ошибок stanza-ы. Формы xep-0004 (jabber:x:data) описаны в DataForm.
+const (
+	nsCommands = "http://jabber.org/protocol/commands"
+	nsStanzas  = "urn:ietf:params:xml:ns:xmpp-stanzas"
+)
+
+// AdHocCommand - команда, которую bot_masters могут выполнить через меню ad-hoc команд своего клиента. Если у команды
+// есть форма, то сначала клиенту отдаётся форма, а выполняется команда, когда форму заполнят и отправят.
+type AdHocCommand struct {
+	// Node - идентификатор команды, Name - то, что клиент покажет в меню.
+	Node string
+	Name string
+
+	// Form - форма, которую надо заполнить перед выполнением, nil - команда выполняется сразу.
+	Form func(j *Jabber) *DataForm
+
+	// Run выполняет команду. form - заполненная форма, если она у команды есть. Возвращает то, что показать
+	// пользователю: текст или форму с результатом.
+	Run func(j *Jabber, r *CmdRequest, form *DataForm) (string, *DataForm)
+}
+
+// DataForm - форма согласно https://xmpp.org/extensions/xep-0004.html.
+type DataForm struct {
+	XMLName      xml.Name        `xml:"jabber:x:data x"`
+	Type         string          `xml:"type,attr"`
+	Title        string          `xml:"title,omitempty"`
+	Instructions string          `xml:"instructions,omitempty"`
+	Fields       []DataFormField `xml:"field"`
+}
+
+// DataFormField - поле формы.
+type DataFormField struct {
+	Var      string           `xml:"var,attr,omitempty"`
+	Type     string           `xml:"type,attr,omitempty"`
+	Label    string           `xml:"label,attr,omitempty"`
+	Required *struct{}        `xml:"required,omitempty"`
+	Values   []string         `xml:"value"`
+	Options  []DataFormOption `xml:"option"`
+}
+
+// DataFormOption - вариант значения поля list-single.
+type DataFormOption struct {
+	Label string `xml:"label,attr,omitempty"`
+	Value string `xml:"value"`
+}
+
+// AdHocElement - элемент <command/> из запроса и ответа ad-hoc команды.
+type AdHocElement struct {
+	XMLName   xml.Name      `xml:"http://jabber.org/protocol/commands command"`
+	Node      string        `xml:"node,attr"`
+	SessionID string        `xml:"sessionid,attr,omitempty"`
+	Action    string        `xml:"action,attr,omitempty"`
+	Status    string        `xml:"status,attr,omitempty"`
+	Actions   *AdHocActions `xml:"actions,omitempty"`
+	Note      *AdHocNote    `xml:"note,omitempty"`
+	Form      *DataForm     `xml:"x,omitempty"`
+}
+
+// AdHocActions - действия, которые клиент может сделать с формой.
+type AdHocActions struct {
+	Execute  string    `xml:"execute,attr,omitempty"`
+	Complete *struct{} `xml:"complete,omitempty"`
+}
+
+// AdHocNote - текстовое сообщение в ответе команды.
+type AdHocNote struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+// Value возвращает значение поля формы или пустую строку, если поля нет.
+func (f *DataForm) Value(name string) string {
+	if f == nil {
+		return ""
+	}
+
+	for _, field := range f.Fields {
+		if field.Var == name && len(field.Values) > 0 {
+			return strings.TrimSpace(strings.Join(field.Values, "\n"))
+		}
+	}
+
+	return ""
+}
+
+// textField - обязательное или нет текстовое поле формы.
+func textField(name, label string, required bool) DataFormField {
+	field := DataFormField{Var: name, Type: "text-single", Label: label} //nolint:exhaustruct
+
+	if required {
+		field.Required = &struct{}{}
+	}
+
+	return field
+}
+
+// roomField - поле формы с выбором комнаты из конфига. Если global, то можно выбрать и глобальную запись списков.
+func (j *Jabber) roomField(global bool) DataFormField {
+	field := DataFormField{Var: "room", Type: "list-single", Label: "Room", Required: &struct{}{}} //nolint:exhaustruct
+
+	if global {
+		field.Options = append(field.Options, DataFormOption{Label: "All rooms", Value: "global"})
+	}
+
+	for _, channel := range j.C.Jabber.Channels {
+		field.Options = append(field.Options, DataFormOption{Value: channel.Name}) //nolint:exhaustruct
+	}
+
+	if len(field.Options) > 0 {
+		field.Values = []string{field.Options[0].Value}
+	}
+
+	return field
+}
+
+// adHocCommands - ad-hoc команды бота в том порядке, в котором они показываются в меню клиента.
+var adHocCommands = []AdHocCommand{
+	{
+		Node: "rehash",
+		Name: "Reload white and black lists",
+		Run: func(j *Jabber, r *CmdRequest, _ *DataForm) (string, *DataForm) {
+			return j.cmdRehash(r), nil
+		},
+	},
+	{
+		Node: "status",
+		Name: "Bot status",
+		Run: func(j *Jabber, _ *CmdRequest, _ *DataForm) (string, *DataForm) {
+			return j.Status(), nil
+		},
+	},
+	{
+		Node: "rooms",
+		Name: "List rooms",
+		Run: func(j *Jabber, _ *CmdRequest, _ *DataForm) (string, *DataForm) {
+			return "", j.roomsForm()
+		},
+	},
+	{
+		Node: "ban",
+		Name: "Ban occupant",
+		Form: func(j *Jabber) *DataForm {
+			return &DataForm{ //nolint:exhaustruct
+				Type:         "form",
+				Title:        "Ban occupant",
+				Instructions: "Nick of occupant or jid. Empty duration means permanent ban (90m, 12h, 3d, 2w).",
+				Fields: []DataFormField{
+					j.roomField(false),
+					textField("target", "Nick or jid", true),
+					textField("duration", "Duration", false),
+					textField("reason", "Reason", false),
+				},
+			}
+		},
+		Run: func(j *Jabber, r *CmdRequest, form *DataForm) (string, *DataForm) {
+			r.Args = nonEmpty(form.Value("room"), form.Value("target"), form.Value("duration"), form.Value("reason"))
+
+			return j.cmdBan(r), nil
+		},
+	},
+	{
+		Node: "unban",
+		Name: "Lift ban",
+		Form: func(j *Jabber) *DataForm {
+			jid := DataFormField{Var: "jid", Type: "jid-single", Label: "Jid", Required: &struct{}{}} //nolint:exhaustruct
+
+			return &DataForm{Type: "form", Title: "Lift ban", Fields: []DataFormField{j.roomField(false), jid}} //nolint:exhaustruct
+		},
+		Run: func(j *Jabber, r *CmdRequest, form *DataForm) (string, *DataForm) {
+			r.Args = nonEmpty(form.Value("room"), form.Value("jid"))
+
+			return j.cmdUnban(r), nil
+		},
+	},
+	{
+		Node: "add-rule",
+		Name: "Add blacklist rule",
+		Form: func(j *Jabber) *DataForm {
+			kind := DataFormField{Var: "kind", Type: "list-single", Label: "Kind", Required: &struct{}{}} //nolint:exhaustruct
+
+			for _, k := range blacklistKinds {
+				kind.Options = append(kind.Options, DataFormOption{Value: k}) //nolint:exhaustruct
+			}
+
+			kind.Values = []string{blacklistKinds[0]}
+
+			return &DataForm{ //nolint:exhaustruct
+				Type:         "form",
+				Title:        "Add blacklist rule",
+				Instructions: "Regexp for phrase, nick and jid rules, expression for expr rules. Matched occupants are banned.",
+				Fields:       []DataFormField{kind, j.roomField(true), textField("rule", "Rule", true)},
+			}
+		},
+		Run: func(j *Jabber, r *CmdRequest, form *DataForm) (string, *DataForm) {
+			if form.Value("kind") == "" || form.Value("room") == "" || form.Value("rule") == "" {
+				return "Kind, room and rule are required", nil
+			}
+
+			return j.blacklistAdd(r, form.Value("kind"), form.Value("room"), form.Value("rule")), nil
+		},
+	},
+}
+
+// nonEmpty возвращает непустые строки из values, как если бы их передали аргументами команды.
+func nonEmpty(values ...string) []string {
+	var args []string
+
+	for _, v := range values {
+		if v != "" {
+			args = append(args, v)
+		}
+	}
+
+	return args
+}
+
+// roomsForm - список комнат в виде формы с результатом.
+func (j *Jabber) roomsForm() *DataForm {
+	field := DataFormField{Var: "rooms", Type: "text-multi", Label: "Rooms"} //nolint:exhaustruct
+
+	for _, channel := range j.C.Jabber.Channels {
+		state := "not joined"
+
+		if slices.Contains(j.RoomsConnected, channel.Name) {
+			state = "joined"
+		}
+
+		field.Values = append(field.Values, fmt.Sprintf("%s (%s as %s, %s mode)", channel.Name, state, channel.Nick, j.RoomMode(channel.Name)))
+	}
+
+	return &DataForm{Type: "result", Title: "Rooms", Fields: []DataFormField{field}} //nolint:exhaustruct
+}
+
+// lookupAdHoc ищет ad-hoc команду по node.
+func lookupAdHoc(node string) *AdHocCommand {
+	for n := range adHocCommands {
+		if adHocCommands[n].Node == node {
+			return &adHocCommands[n]
+		}
+	}
+
+	return nil
+}
+
+// adHocRequester возвращает bare real jid того, кто прислал запрос: из комнаты - по presence-у, иначе сам jid.
+func (j *Jabber) adHocRequester(from string) string {
+	bare := strings.SplitN(from, "/", 2)[0]
+
+	if j.GetRoomConfig(bare) != nil {
+		return strings.SplitN(j.GetRealJIDfromNick(from), "/", 2)[0]
+	}
+
+	return bare
+}
+
+// AdHocItems отвечает на disco#items с node http://jabber.org/protocol/commands списком ad-hoc команд. Тем, кто не
+// bot_masters, список отдаётся пустым.
+func (j *Jabber) AdHocItems(v xmpp.IQ) error {
+	answer := fmt.Sprintf("<query xmlns='%s' node='%s'>", xmpp.XMPPNS_DISCO_ITEMS, nsCommands)
+
+	if j.IsMaster(j.adHocRequester(v.From)) {
+		for _, cmd := range adHocCommands {
+			answer += fmt.Sprintf(
+				"<item jid='%s' node='%s' name='%s'/>",
+				xmlEscape(j.Talk.JID()),
+				xmlEscape(cmd.Node),
+				xmlEscape(cmd.Name),
+			)
+		}
+	}
+
+	answer += "</query>"
+
+	if _, err := j.Talk.RawInformation(v.To, v.From, v.ID, xmpp.IQTypeResult, answer); err != nil {
+		return fmt.Errorf("unable to send ad-hoc command list to %s: %w", v.From, err)
+	}
+
+	return nil
+}
+
+// AdHoc выполняет ad-hoc команду из IQ set-а. Возвращает false, если в IQ не ad-hoc команда. Права проверяются те же,
+// что и у команд в чате: ad-hoc команды доступны только bot_masters.
+func (j *Jabber) AdHoc(v xmpp.IQ) (bool, error) {
+	var req AdHocElement
+
+	if err := xml.Unmarshal(v.Query, &req); err != nil {
+		return false, nil
+	}
+
+	jid := j.adHocRequester(v.From)
+	cmd := lookupAdHoc(req.Node)
+
+	if j.Replaying {
+		j.replayNote("would run ad-hoc command %s by %s(%s)", req.Node, jid, v.From)
+
+		return true, nil
+	}
+
+	switch {
+	case !j.IsMaster(jid):
+		log.Infof("Ad-hoc command %s from %s (%s) is forbidden", req.Node, v.From, jid)
+
+		return true, j.adHocError(v, req, "auth", "forbidden")
+	case cmd == nil:
+		return true, j.adHocError(v, req, "cancel", "item-not-found")
+	}
+
+	resp := AdHocElement{Node: req.Node, SessionID: req.SessionID} //nolint:exhaustruct
+
+	if resp.SessionID == "" {
+		resp.SessionID = uuid.New().String()
+	}
+
+	switch {
+	case req.Action == "cancel":
+		resp.Status = "canceled"
+
+	// Форму ещё не заполняли, отдаём её. Сессию бот не хранит: всё нужное для выполнения приходит в форме.
+	case cmd.Form != nil && (req.Form == nil || req.Form.Type != "submit"):
+		resp.Status = "executing"
+		resp.Actions = &AdHocActions{Execute: "complete", Complete: &struct{}{}}
+		resp.Form = cmd.Form(j)
+
+	default:
+		chatCmd := j.Commands.Lookup(cmd.Node)
+
+		if chatCmd == nil {
+			chatCmd = &Command{Name: cmd.Node} //nolint:exhaustruct
+		}
+
+		r := &CmdRequest{ //nolint:exhaustruct
+			Msg:     xmpp.Chat{Remote: v.From, Type: "chat"}, //nolint:exhaustruct
+			Command: chatCmd,
+			Name:    chatCmd.Name,
+			Place:   CmdInDirect,
+			JID:     jid,
+		}
+
+		log.Infof("Ad-hoc command %s ordered by %s(%s)", cmd.Node, jid, v.From)
+
+		text, form := cmd.Run(j, r, req.Form)
+
+		resp.Status = "completed"
+		resp.Form = form
+
+		if text != "" {
+			resp.Note = &AdHocNote{Type: "info", Text: text}
+		}
+	}
+
+	buf, err := xml.Marshal(resp)
+
+	if err != nil {
+		return true, fmt.Errorf("unable to serialize ad-hoc command %s answer: %w", req.Node, err)
+	}
+
+	if _, err := j.Talk.RawInformation(v.To, v.From, v.ID, xmpp.IQTypeResult, string(buf)); err != nil {
+		return true, fmt.Errorf("unable to send ad-hoc command %s answer to %s: %w", req.Node, v.From, err)
+	}
+
+	return true, nil
+}
+
+// adHocError отвечает на ad-hoc команду ошибкой condition типа errType.
+func (j *Jabber) adHocError(v xmpp.IQ, req AdHocElement, errType, condition string) error {
+	answer := fmt.Sprintf(
+		"<command xmlns='%s' node='%s'/><error type='%s'><%s xmlns='%s'/></error>",
+		nsCommands,
+		xmlEscape(req.Node),
+		errType,
+		condition,
+		nsStanzas,
+	)
+
+	if _, err := j.Talk.RawInformation(v.To, v.From, v.ID, xmpp.IQTypeError, answer); err != nil {
+		return fmt.Errorf("unable to send ad-hoc command %s error to %s: %w", req.Node, v.From, err)
+	}
+
+	return nil
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
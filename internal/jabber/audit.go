@@ -0,0 +1,221 @@
+package jabber
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// auditMutex не даёт записям от разных горутин перемешаться в файле.
+var auditMutex sync.Mutex
+
+// AuditRecord - одна запись журнала модерации.
+type AuditRecord struct {
+	Time     time.Time `json:"time"`
+	Room     string    `json:"room"`
+	Nick     string    `json:"nick,omitempty"`
+	JID      string    `json:"jid,omitempty"`
+	Action   string    `json:"action"`
+	Duration string    `json:"duration,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Rule     string    `json:"rule,omitempty"`
+	Why      string    `json:"why,omitempty"`
+	By       string    `json:"by,omitempty"`
+
+	// Shadow - действие не выполнялось, комната или правило в режиме shadow.
+	Shadow bool `json:"shadow,omitempty"`
+
+	// Failed - почему действие не выполнено: сервер ответил ошибкой, не ответил, действие не влезло в очередь или
+	// пропало вместе с соединением. Пусто - выполнено.
+	Failed string `json:"failed,omitempty"`
+}
+
+// Audit дописывает запись в журнал модерации audit_log, по одному json-объекту на строку. Если журнал не задан, то
+// ничего не делает.
+func (j *Jabber) Audit(r AuditRecord) {
+	if j.C.Jabber.AuditLog == "" {
+		return
+	}
+
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+
+	buf, err := json.Marshal(r)
+
+	if err != nil {
+		log.Errorf("Unable to serialize audit record: %s", err)
+
+		return
+	}
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	if err := appendLine(j.C.Jabber.AuditLog, buf); err != nil {
+		log.Errorf("Unable to write audit record: %s", err)
+	}
+}
+
+// AuditAction пишет в журнал модерации выполненное действие.
+func (j *Jabber) AuditAction(a ModAction) {
+	j.AuditActionResult(a, "")
+}
+
+// AuditActionResult пишет в журнал модерации действие и, если оно не выполнено, почему. Время записи - момент, когда
+// стал известен результат, так журнал остаётся упорядоченным по времени.
+func (j *Jabber) AuditActionResult(a ModAction, failed string) {
+	r := AuditRecord{ //nolint:exhaustruct
+		Room:   a.Room,
+		Nick:   a.Nick,
+		JID:    a.JID,
+		Action: a.Action,
+		Reason: a.Reason,
+		Rule:   a.Rule,
+		Why:    a.Why,
+		By:     a.By,
+		Shadow: a.Mode == ModeShadow,
+		Failed: failed,
+	}
+
+	if a.Duration > 0 {
+		r.Duration = a.Duration.String()
+
+		if a.Action == "ban" {
+			r.Action = "tempban"
+		}
+	}
+
+	j.Audit(r)
+}
+
+// auditChunk - сколько байт журнала модерации ReadAudit читает за раз.
+const auditChunk = 64 * 1024
+
+// ReadAudit читает журнал модерации и передаёт в f записи не старше since, от старых к новым. Битые строки
+// пропускаются. Журнал дописывается по времени, поэтому он читается с конца и только до первой записи старше since:
+// сколько бы журнал ни рос, читаются только свежие записи.
+func (j *Jabber) ReadAudit(since time.Time, f func(r AuditRecord)) error {
+	if j.C.Jabber.AuditLog == "" {
+		return nil
+	}
+
+	fh, err := os.Open(j.C.Jabber.AuditLog)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %w", j.C.Jabber.AuditLog, err)
+	}
+
+	defer fh.Close() //nolint:errcheck
+
+	var records []AuditRecord
+
+	err = readLinesBackward(fh, func(line []byte) bool {
+		var r AuditRecord
+
+		if err := json.Unmarshal(line, &r); err != nil {
+			return true
+		}
+
+		if r.Time.Before(since) {
+			return false
+		}
+
+		records = append(records, r)
+
+		return true
+	})
+
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %w", j.C.Jabber.AuditLog, err)
+	}
+
+	for n := len(records) - 1; n >= 0; n-- {
+		f(records[n])
+	}
+
+	return nil
+}
+
+// readLinesBackward передаёт в f непустые строки файла от последней к первой, пока f возвращает true.
+func readLinesBackward(fh *os.File, f func(line []byte) bool) error {
+	fi, err := fh.Stat()
+
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	var (
+		offset = fi.Size()
+		// head - начало строки, которое не поместилось в прочитанный кусок, её конец уже прочитан.
+		head []byte
+	)
+
+	for offset > 0 {
+		size := min(int64(auditChunk), offset)
+		offset -= size
+
+		chunk := make([]byte, size, size+int64(len(head)))
+
+		if _, err := fh.ReadAt(chunk, offset); err != nil {
+			return err //nolint:wrapcheck
+		}
+
+		chunk = append(chunk, head...)
+
+		for {
+			n := bytes.LastIndexByte(chunk, '\n')
+
+			if n < 0 {
+				break
+			}
+
+			if line := chunk[n+1:]; len(line) > 0 && !f(line) {
+				return nil
+			}
+
+			chunk = chunk[:n]
+		}
+
+		head = chunk
+	}
+
+	if len(head) > 0 {
+		f(head)
+	}
+
+	return nil
+}
+
+// appendLine дописывает строку в конец файла, создавая его при необходимости.
+func appendLine(path string, line []byte) error {
+	fh, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %w", path, err)
+	}
+
+	if _, err := fh.Write(append(line, '\n')); err != nil {
+		_ = fh.Close()
+
+		return fmt.Errorf("unable to write to %s: %w", path, err)
+	}
+
+	if err := fh.Close(); err != nil {
+		return fmt.Errorf("unable to close %s: %w", path, err)
+	}
+
+	return nil
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
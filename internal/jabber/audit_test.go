@@ -0,0 +1,80 @@
+package jabber
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadAudit(t *testing.T) {
+	var (
+		now  = time.Now().Truncate(time.Second)
+		path = filepath.Join(t.TempDir(), "audit.jsonl")
+		j    = &Jabber{} //nolint:exhaustruct
+		buf  []byte
+	)
+
+	j.C.Jabber.AuditLog = path
+
+	records := []AuditRecord{
+		{Time: now.AddDate(0, 0, -40), Room: "a", Action: "ban"},  //nolint:exhaustruct
+		{Time: now.AddDate(0, 0, -10), Room: "b", Action: "kick"}, //nolint:exhaustruct
+		{Time: now.AddDate(0, 0, -5), Room: "c", Action: "ban"},   //nolint:exhaustruct
+		{Time: now.Add(-time.Hour), Room: "d", Action: "devoice"}, //nolint:exhaustruct
+		{Time: now, Room: "e", Action: "ban"},                     //nolint:exhaustruct
+	}
+
+	// Запись длиннее куска, который читается за раз, и битые строки.
+	records[2].Reason = strings.Repeat("x", 3*auditChunk)
+
+	for n, r := range records {
+		line, err := json.Marshal(r)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+
+		if n == 1 {
+			buf = append(buf, "{broken\n\n"...)
+		}
+	}
+
+	// Последняя строка без перевода строки.
+	buf = buf[:len(buf)-1]
+
+	if err := os.WriteFile(path, buf, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		since time.Time
+		want  []string
+	}{
+		{time.Time{}, []string{"a", "b", "c", "d", "e"}},
+		{now.AddDate(0, 0, -30), []string{"b", "c", "d", "e"}},
+		{now.AddDate(0, 0, -7), []string{"c", "d", "e"}},
+		{now.Add(-time.Minute), []string{"e"}},
+		{now.Add(time.Minute), nil},
+	}
+
+	for _, tt := range tests {
+		var got []string
+
+		if err := j.ReadAudit(tt.since, func(r AuditRecord) { got = append(got, r.Room) }); err != nil {
+			t.Fatal(err)
+		}
+
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("ReadAudit(%s) = %v, want %v", tt.since, got, tt.want)
+		}
+	}
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
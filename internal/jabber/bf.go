@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/jbrukh/bayesian"
 	log "github.com/sirupsen/logrus"
@@ -36,6 +37,55 @@ func checkPhrase(s string) error { //nolint: unused
 	return err
 }
 
+var (
+	// bayesClassifier загружается из dataFile один раз, при первом использовании.
+	bayesClassifier     *bayesian.Classifier
+	bayesClassifierOnce sync.Once
+)
+
+// IsBayesSpam проверяет фразу байесовским классификатором. Короткие фразы и фразы, в которых мало слов, не проверяются.
+// Возвращает признак спама и вероятность того, что фраза - спам.
+func IsBayesSpam(s string, minLength int, minWords int64) (bool, float64) {
+	bayesClassifierOnce.Do(func() {
+		classifier, err := bayesian.NewClassifierFromFile(dataFile)
+
+		if err != nil {
+			log.Errorf("Unable to load bayes classifier data, bayes signal disabled: %s", err)
+
+			return
+		}
+
+		bayesClassifier = classifier
+	})
+
+	if bayesClassifier == nil {
+		return false, 0
+	}
+
+	s = nStringLower(s)
+	words := strings.Fields(s)
+
+	if len(s) < minLength || int64(len(words)) < minWords {
+		return false, 0
+	}
+
+	scores, inx, strict, err := bayesClassifier.SafeProbScores(words)
+
+	if err != nil {
+		log.Debugf("Unable to classify phrase: %s", err)
+
+		return false, 0
+	}
+
+	for n, class := range bayesClassifier.Classes {
+		if class == Bad {
+			return strict && inx == n, scores[n]
+		}
+	}
+
+	return false, 0
+}
+
 // Выучивает слова из предопределённых словарей.
 func learn() error { //nolint: unused
 	classifier := bayesian.NewClassifier(Bad, Good)
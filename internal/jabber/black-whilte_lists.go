@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/hjson/hjson-go"
 	log "github.com/sirupsen/logrus"
@@ -27,14 +28,7 @@ func (j *Jabber) ReadWhitelist() error {
 		return err
 	}
 
-	whitelistJSONPath := fmt.Sprintf("%s/data/whitelist.json", filepath.Dir(executablePath))
-
-	locations := []string{
-		"~/.buny-jabber-bot-whitelist.json",
-		"~/buny-jabber-bot-whitelist.json",
-		"/etc/buny-jabber-bot-whitelist.json",
-		whitelistJSONPath,
-	}
+	locations := WhitelistLocations(executablePath)
 
 	for _, location := range locations {
 		fileInfo, err := os.Stat(location)
@@ -92,7 +86,12 @@ func (j *Jabber) ReadWhitelist() error {
 			continue
 		}
 
+		prepareWhitelist(&sampleWhitelist)
+
 		j.WhiteList = sampleWhitelist
+		j.WhitelistFile = location
+		j.whitelistRaw = tmpJSON
+		j.ListsLoaded = time.Now()
 		whitelistLoaded = true
 
 		log.Infof("Using %s as whiteList file", location)
@@ -123,14 +122,7 @@ func (j *Jabber) ReadBlacklist() error {
 		return err
 	}
 
-	whitelistJSONPath := fmt.Sprintf("%s/data/blacklist.json", filepath.Dir(executablePath))
-
-	locations := []string{
-		"~/.bunyPresense-jabber-bot-blacklist.json",
-		"~/bunyPresense-jabber-bot-blacklist.json",
-		"/etc/bunyPresense-jabber-bot-blacklist.json",
-		whitelistJSONPath,
-	}
+	locations := BlacklistLocations(executablePath)
 
 	for _, location := range locations {
 		fileInfo, err := os.Stat(location)
@@ -188,9 +180,17 @@ func (j *Jabber) ReadBlacklist() error {
 			continue
 		}
 
+		prepareBlacklist(&sampleBlacklist)
+
 		j.BlackList = sampleBlacklist
+		j.BlacklistFile = location
+		j.blacklistRaw = tmpJSON
+		j.ListsLoaded = time.Now()
 		blacklistLoaded = true
 
+		// Новым правилам заводим счётчики срабатываний. При старте бота счётчиков ещё нет, ими займётся MyLoop.
+		j.TrackRules()
+
 		log.Infof("Using %s as blacklist file", location)
 
 		break
@@ -203,4 +203,134 @@ func (j *Jabber) ReadBlacklist() error {
 	return err
 }
 
+// prepareWhitelist компилирует шаблоны белого списка один раз, при загрузке. Некорректные шаблоны пропускаются.
+func prepareWhitelist(wl *MyWhiteList) {
+	for n := range wl.Whitelist {
+		wEntry := &wl.Whitelist[n]
+
+		for _, w := range wEntry.Jid {
+			pattern, err := CompileJidPattern(w.Jid, w.Expires)
+
+			if err != nil {
+				log.Errorf("Incorrect jid entry in whitelist for room %q: %s, skipping", wEntry.RoomName, err)
+
+				continue
+			}
+
+			if pattern.Expired() {
+				log.Infof("Whitelist entry %s for room %q is expired", pattern, wEntry.RoomName)
+			}
+
+			wEntry.jids = append(wEntry.jids, pattern)
+		}
+	}
+}
+
+// prepareBlacklist компилирует правила для клиентского ПО, выражения и шаблоны причин чёрного списка один раз, при
+// загрузке, и проверяет остальные поля записей. Некорректные правила пропускаются.
+func prepareBlacklist(bl *MyBlackList) {
+	var err error
+
+	for n := range bl.Blacklist {
+		bEntry := &bl.Blacklist[n]
+
+		for _, ua := range bEntry.UserAgent {
+			matcher, err := CompileUserAgent(ua)
+
+			if err != nil {
+				log.Errorf("Incorrect user_agent entry in blacklist for room %q: %s, skipping", bEntry.RoomName, err)
+
+				continue
+			}
+
+			bEntry.userAgents = append(bEntry.userAgents, matcher)
+		}
+
+		switch bEntry.Action {
+		case "log", "warn", "devoice", "kick", "ban":
+		case "tempban":
+			d, err := ParseDuration(bEntry.Duration)
+
+			if err != nil {
+				log.Errorf(
+					"Incorrect duration %q of tempban in blacklist for room %q: %s, using ban instead",
+					bEntry.Duration,
+					bEntry.RoomName,
+					err,
+				)
+
+				bEntry.Action = "ban"
+			}
+
+			bEntry.duration = d
+		case "":
+			bEntry.Action = "ban"
+		default:
+			log.Errorf("Unknown action %s in blacklist for room %q, using ban instead", bEntry.Action, bEntry.RoomName)
+
+			bEntry.Action = "ban"
+		}
+
+		if !validMode(bEntry.Mode) {
+			log.Errorf("Unknown mode %s in blacklist for room %q, using room mode", bEntry.Mode, bEntry.RoomName)
+
+			bEntry.Mode = ""
+		}
+
+		if bEntry.reason, err = CompileReasonTemplate("reason of "+bEntry.RoomName, bEntry.Reason); err != nil {
+			log.Errorf("Incorrect reason in blacklist for room %q: %s, ignoring it", bEntry.RoomName, err)
+		}
+
+		if bEntry.Expires != "" {
+			expires, err := parseExpires(bEntry.Expires)
+
+			// Запись задумывалась временной, так что вечной её делать нельзя: считаем, что срок уже вышел.
+			if err != nil {
+				log.Errorf("Incorrect expires in blacklist for room %q: %s, treating entry as expired", bEntry.RoomName, err)
+
+				expires = time.Unix(0, 0)
+			}
+
+			bEntry.expires = expires
+
+			if err == nil && bEntry.Expired() {
+				log.Infof("Blacklist entry for room %q expired at %s", bEntry.RoomName, bEntry.expires)
+			}
+		}
+
+		// Выражения разбираются и проверяются на типы тоже здесь, чтобы не делать этого на каждое событие.
+		for _, source := range bEntry.Expr {
+			expr, err := CompileExpr(source)
+
+			if err != nil {
+				log.Errorf("Incorrect expr entry in blacklist for room %q: %s: %s, skipping", bEntry.RoomName, source, err)
+
+				continue
+			}
+
+			bEntry.exprs = append(bEntry.exprs, expr)
+		}
+	}
+}
+
+// WhitelistLocations возвращает, где и в каком порядке искать белый список. executablePath - путь к бинарнику бота.
+func WhitelistLocations(executablePath string) []string {
+	return []string{
+		"~/.buny-jabber-bot-whitelist.json",
+		"~/buny-jabber-bot-whitelist.json",
+		"/etc/buny-jabber-bot-whitelist.json",
+		fmt.Sprintf("%s/data/whitelist.json", filepath.Dir(executablePath)),
+	}
+}
+
+// BlacklistLocations возвращает, где и в каком порядке искать чёрный список. executablePath - путь к бинарнику бота.
+func BlacklistLocations(executablePath string) []string {
+	return []string{
+		"~/.bunyPresense-jabber-bot-blacklist.json",
+		"~/bunyPresense-jabber-bot-blacklist.json",
+		"/etc/bunyPresense-jabber-bot-blacklist.json",
+		fmt.Sprintf("%s/data/blacklist.json", filepath.Dir(executablePath)),
+	}
+}
+
 /* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
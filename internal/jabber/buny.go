@@ -1,10 +1,10 @@
 package jabber
 
 import (
-	"encoding/json"
 	"fmt"
-	"regexp"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/eleksir/go-xmpp"
@@ -12,8 +12,8 @@ import (
 )
 
 // BunyPresense производит проверку по бело-чёрным спискам. Если presence пришёл от злодея (из чёрного списка), то
-// отправляет его в бан.
-func (j *Jabber) BunyPresense(v xmpp.Presence) error { //nolint:gocognit,gocyclo
+// отправляет его в бан. Возвращает true, если по участнику сработало правило и дальше его проверять не нужно.
+func (j *Jabber) BunyPresense(v xmpp.Presence) (bool, error) { //nolint:gocognit,gocyclo
 	var err error
 
 	// Если у presence-а есть JID и presence из одной из комнат, в которой мы есть и если его домен в чёрном
@@ -21,7 +21,7 @@ func (j *Jabber) BunyPresense(v xmpp.Presence) error { //nolint:gocognit,gocyclo
 	if v.JID != "" {
 		// На всякий случай: себя никогда не баним, явным образом
 		if v.JID == j.Talk.JID() {
-			return err
+			return false, err
 		}
 
 		room := strings.SplitN(v.From, "/", 2)[0]
@@ -29,45 +29,32 @@ func (j *Jabber) BunyPresense(v xmpp.Presence) error { //nolint:gocognit,gocyclo
 		if room == "" {
 			log.Infof("We got empty room field in presence event, which kinda strange: %s", spew.Sdump(v))
 
-			return err
+			return false, err
 		}
 
-		goodJid := strings.SplitN(v.JID, "/", 2)[0]
-
-		// Обрабатываем правила белого списка
-		for _, good := range j.WhiteList.Whitelist {
-			// Глобальный белый список
-			if good.RoomName == "" {
-				for _, person := range good.Jid {
-					if person == goodJid {
-						return err
-					}
-				}
-			}
-
-			// Белый список для конкретных каналов
-			if good.RoomName == room {
-				for _, person := range good.Jid {
-					if person == goodJid {
-						return err
-					}
-				}
-			}
+		// Админов, модераторов, белый список и прочих неприкосновенных не трогаем
+		if j.IsProtected(v) {
+			return false, err
 		}
 
-		id, err := j.QuerySoftwareVersion(v.From)
+		// Presence прилетает на каждую смену статуса, не стоит переспрашивать версию, если мы уже ждём ответа.
+		if !j.IsSoftwareVersionPending(v.From) {
+			id, err := j.QuerySoftwareVersion(v.From)
 
-		if err != nil {
-			err := fmt.Errorf(
-				"unable to query user software and version: jid=%s id=%s, err=%w",
-				v.JID,
-				id,
-				err,
-			)
+			if err != nil {
+				err := fmt.Errorf(
+					"unable to query user software and version: jid=%s id=%s, err=%w",
+					v.JID,
+					id,
+					err,
+				)
+
+				j.GTomb.Kill(err)
 
-			j.GTomb.Kill(err)
+				return false, err
+			}
 
-			return err
+			j.WaitSoftwareVersion(id, v)
 		}
 
 		evilJid := strings.SplitN(v.JID, "/", 2)[0]
@@ -82,283 +69,85 @@ func (j *Jabber) BunyPresense(v xmpp.Presence) error { //nolint:gocognit,gocyclo
 		// Обрабатываем правила чёрного списка
 		for _, cRoom := range j.RoomsConnected {
 			if cRoom == room {
-				for _, bEntry := range j.BlackList.Blacklist {
-					// Обработаем правила глобального чёрного списка
-					if bEntry.RoomName == "" {
-						for _, jidRegexp := range bEntry.JidRe {
-							if jidRegexp == "" {
-								continue
-							}
-
-							re, err := regexp.Compile(jidRegexp)
-
-							if err != nil {
-								log.Errorf("Incorrect regexp in global blacklist: %s, skipping", jidRegexp)
-
-								continue
-							}
-
-							log.Debugf("Checking jid %s vs global blacklist regex %s", v.JID, jidRegexp)
-
-							if re.MatchString(v.JID) {
-								log.Warnf(
-									"Hammer falls on %s (%s): jid matches with global blacklist entry: %s",
-									v.From,
-									evilJid,
-									jidRegexp,
-								)
-
-								id, err := j.Squash(room, evilJid, bEntry.ReasonEnable, v.Type)
-
-								if err != nil {
-									err := fmt.Errorf(
-										"unable to ban user: id=%s, err=%w",
-										id,
-										err,
-									)
-
-									j.GTomb.Kill(err)
-								}
-
-								return err
-							}
-						}
-
-						for _, nickRegexp := range bEntry.NickRe {
-							if nickRegexp == "" {
-								continue
-							}
-
-							re, err := regexp.Compile(nickRegexp)
-
-							if err != nil {
-								log.Errorf("Incorrect regexp in global blacklist: %s, skipping", nickRegexp)
-
-								continue
-							}
-
-							log.Debugf("Checking nick %s vs global blacklist regex %s", evilNick, nickRegexp)
-
-							if re.MatchString(evilNick) {
-								log.Warnf(
-									"Hammer falls on %s (%s): nick matches with global blacklist entry: %s",
-									v.From,
-									evilJid,
-									nickRegexp,
-								)
-
-								// Баним именно jid
-								id, err := j.Squash(room, evilJid, bEntry.ReasonEnable, v.Type)
-
-								if err != nil {
-									err := fmt.Errorf(
-										"unable to ban user: id=%s, err=%w",
-										id,
-										err,
-									)
-
-									j.GTomb.Kill(err)
-								}
-
-								return err
-							}
-						}
-
-						continue
-					}
-
-					// Обработаем правила конкретного канала, комнаты конференции
-					if bEntry.RoomName == room {
-						for _, jidRegexp := range bEntry.JidRe {
-							if jidRegexp == "" {
-								continue
-							}
-
-							re, err := regexp.Compile(jidRegexp)
-
-							if err != nil {
-								log.Errorf("Incorrect regexp in room %s blacklist: %s, skipping", room, jidRegexp)
-
-								continue
-							}
-
-							log.Debugf("Checking jid %s vs room %s blacklist regex %s", v.JID, room, jidRegexp)
-
-							if re.MatchString(v.JID) {
-								log.Warnf(
-									"Hammer falls on %s (%s): jid matches with room blacklist entry: %s",
-									v.From,
-									evilJid,
-									jidRegexp,
-								)
-
-								id, err := j.Squash(room, evilJid, bEntry.ReasonEnable, v.Type)
-
-								if err != nil {
-									err := fmt.Errorf(
-										"unable to ban user: id=%s, err=%w",
-										id,
-										err,
-									)
-
-									j.GTomb.Kill(err)
-								}
-
-								return err
-							}
-						}
-
-						if bEntry.RoomName == room {
-							for _, nickRegexp := range bEntry.NickRe {
-								if nickRegexp == "" {
-									continue
-								}
-
-								re, err := regexp.Compile(nickRegexp)
-
-								if err != nil {
-									log.Errorf("Incorrect regexp in room %s blacklist: %s, skipping", room, nickRegexp)
-
-									continue
-								}
-
-								log.Debugf("Checking nick %s vs room %s blacklist regex %s", evilJid, room, nickRegexp)
-
-								if re.MatchString(evilNick) {
-									log.Warnf(
-										"Hammer falls on %s (%s): nick matches with room blacklist entry: %s",
-										v.From,
-										evilJid,
-										nickRegexp,
-									)
-
-									// Баним именно jid
-									id, err := j.Squash(room, evilJid, bEntry.ReasonEnable, v.Type)
-
-									if err != nil {
-										err := fmt.Errorf(
-											"unable to ban user: id=%s, err=%w",
-											id,
-											err,
-										)
-
-										j.GTomb.Kill(err)
-									}
-
-									return err
-								}
-							}
-						}
+				subjects := []RuleSubject{{Kind: "jid", Value: v.JID}, {Kind: "nick", Value: evilNick}}
+
+				if j.MatchRules(room, subjects, func(m RuleMatch) bool {
+					log.Warnf(
+						"Hammer falls on %s (%s): %s matches with %s blacklist entry: %s",
+						v.From,
+						evilJid,
+						m.Kind,
+						ruleScope(m.Entry),
+						m.Pattern,
+					)
+
+					return j.RuleHit(room, v.From, evilJid, m.Entry, m.Kind, m.Pattern, m.Match, v.Type, "")
+				}) {
+					return true, err
+				}
 
-						continue
-					}
+				// Правила-выражения проверяем последними, они комбинируют сразу несколько признаков.
+				if j.BunyExpr(room, v.From, v.JID, "", v.Type, "") {
+					return true, err
 				}
 			}
 		}
 	}
 
-	return err
+	return false, err
 }
 
 // BunyChat производит проверку сообщений участников чата по списку забаненных фраз и в случае нахождения запрещённого
-// шаблона банит участника чата.
-func (j *Jabber) BunyChat(v xmpp.Chat) error {
+// шаблона банит участника чата. id - stanza-id сообщения, по нему сообщение можно удалить.
+func (j *Jabber) BunyChat(v xmpp.Chat, id string) error {
+	// Если участника нет в базе presence-ов, то проверим хотя бы то, что знаем.
+	p, found := j.GetPresence(v.Remote)
+
+	if !found {
+		p = xmpp.Presence{From: v.Remote} //nolint:exhaustruct
+	}
+
+	return j.checkChat(v, p, id)
+}
+
+// checkChat проверяет сообщение v участника p. Участника может уже не быть в комнате, если сообщение пропущенное.
+// id - stanza-id сообщения, если известен.
+func (j *Jabber) checkChat(v xmpp.Chat, p xmpp.Presence, id string) error {
 	var (
 		room = (strings.SplitN(v.Remote, "/", 2))[0]
 		// nick = (strings.SplitN(v.Remote, "/", 2))[1]
-		err error
+		started = time.Now()
+		err     error
 	)
 
 	// Действовать мы можем только в рамках тех комнат, где явно присуствуем.
 	for _, cRoom := range j.RoomsConnected {
 		if cRoom == room {
-			// Перебирём правила чёрных списков.
-			for _, bEntry := range j.BlackList.Blacklist {
-				// Обработаем правила глобального чёрного списка
-				if bEntry.RoomName == "" {
-					for _, phraseRegexp := range bEntry.PhraseRe {
-						if phraseRegexp == "" {
-							continue
-						}
-
-						re, err := regexp.Compile(phraseRegexp)
-
-						if err != nil {
-							log.Errorf("Incorrect regexp in room %s blacklist: %s, skipping", room, phraseRegexp)
-
-							continue
-						}
-
-						log.Debugf("Checking phrase %s vs room %s blacklist regex %s", v.Text, room, phraseRegexp)
-
-						if re.MatchString(v.Text) {
-							realJID := j.GetRealJIDfromNick(v.Remote)
-
-							log.Warnf(
-								"Hammer falls on %s (%s): phrase matches with global blacklist entry: %s vs %s",
-								v.Remote,
-								realJID,
-								v.Text,
-								phraseRegexp,
-							)
-
-							if id, err := j.Squash(room, realJID, bEntry.ReasonEnable, v.Type); err != nil {
-								err := fmt.Errorf(
-									"unable to ban user: id=%s, err=%w",
-									id,
-									err,
-								)
-
-								j.GTomb.Kill(err)
-							}
-
-							return err
-						}
-					}
-				}
-
-				// Обработаем правила чёрного списка для конкретной комнаты
-				if bEntry.RoomName == room {
-					for _, phraseRegexp := range bEntry.PhraseRe {
-						if phraseRegexp == "" {
-							continue
-						}
-
-						re, err := regexp.Compile(phraseRegexp)
-
-						if err != nil {
-							log.Errorf("Incorrect regexp in room %s blacklist: %s, skipping", room, phraseRegexp)
-
-							continue
-						}
-
-						log.Debugf("Checking phrase %s vs room %s blacklist regex %s", v.Text, room, phraseRegexp)
-
-						if re.MatchString(v.Text) {
-							realJID := j.GetRealJIDfromNick(v.Remote)
-
-							log.Warnf(
-								"Hammer falls on %s (%s): phrase matches with room blacklist entry: %s vs %s",
-								v.Remote,
-								realJID,
-								v.Text,
-								phraseRegexp,
-							)
-
-							if id, err := j.Squash(room, realJID, bEntry.ReasonEnable, v.Type); err != nil {
-								err := fmt.Errorf(
-									"unable to ban user: id=%s, err=%w",
-									id,
-									err,
-								)
+			// Неприкосновенных участников не проверяем.
+			if j.IsProtected(p) {
+				return err
+			}
 
-								j.GTomb.Kill(err)
-							}
+			// Перебирём правила чёрных списков.
+			if j.MatchRules(room, []RuleSubject{{Kind: "phrase", Value: v.Text}}, func(m RuleMatch) bool {
+				realJID := p.JID
+
+				log.Warnf(
+					"Hammer falls on %s (%s): phrase matches with %s blacklist entry: %s vs %s",
+					v.Remote,
+					realJID,
+					ruleScope(m.Entry),
+					v.Text,
+					m.Pattern,
+				)
+
+				return j.RuleHit(room, v.Remote, realJID, m.Entry, m.Kind, m.Pattern, m.Match, v.Type, id)
+			}) {
+				return err
+			}
 
-							return err
-						}
-					}
-				}
+			if j.BunyExpr(room, v.Remote, p.JID, v.Text, v.Type, id) {
+				return err
 			}
 
 			// Если включено, проверяем фразу на КАПС.
@@ -372,21 +161,54 @@ func (j *Jabber) BunyChat(v xmpp.Chat) error {
 						normPhraseUpper := strings.ReplaceAll(nStringUpper(v.Text), " ", "")
 
 						if normPhrase == normPhraseUpper {
-							realJID := j.GetRealJIDfromNick(v.Remote)
-							id, err := j.Squash(room, realJID, false, v.Type)
-
-							if err != nil {
-								err := fmt.Errorf(
-									"unable to ban user: id=%s, err=%w",
-									id,
-									err,
+							realJID := p.JID
+
+							// С подсчётом очков КАПС - лишь один из признаков, а не повод для бана.
+							if channel.Scoring.Enabled && channel.Scoring.Signals.AllCaps > 0 {
+								j.AddScore(room, v.Remote, realJID, channel.Scoring.Signals.AllCaps, "all caps")
+							} else {
+								j.Sanction(
+									v.Remote,
+									ModAction{ //nolint:exhaustruct
+										JID:    realJID,
+										Action: "ban",
+										Reason: j.RenderReason(
+											room,
+											nil,
+											ReasonData{Kind: "all_caps", Match: v.Text, Why: "all caps", Action: "ban"}, //nolint:exhaustruct
+											false,
+										),
+										VType:   v.Type,
+										Why:     "all caps",
+										Message: id,
+									},
 								)
 
-								j.GTomb.Kill(err)
+								return err
 							}
 						}
 					}
 				}
+
+				// Байесовский классификатор ошибается слишком часто, чтобы банить по нему, поэтому он работает только как
+				// сигнал для подсчёта очков.
+				if channel.Name == room && channel.Bayes.Enabled &&
+					channel.Scoring.Enabled && channel.Scoring.Signals.Bayes > 0 {
+					if spam, probability := IsBayesSpam(v.Text, channel.Bayes.MinLength, channel.Bayes.MinWords); spam {
+						j.AddScore(
+							room,
+							v.Remote,
+							p.JID,
+							channel.Scoring.Signals.Bayes,
+							fmt.Sprintf("bayes %.2f", probability),
+						)
+					}
+				}
+			}
+
+			// Сообщение ничего не нарушило, участник зарабатывает репутацию.
+			if !j.ScoredSince(room, v.Remote, p.JID, started) {
+				j.GainReputation(strings.SplitN(p.JID, "/", 2)[0])
 			}
 
 			break
@@ -396,208 +218,107 @@ func (j *Jabber) BunyChat(v xmpp.Chat) error {
 	return err
 }
 
-// BunySoftwareVersion производит проверку по чёрному списку версий и названий клинтского ПО.
+// BunySoftwareVersion производит проверку по чёрному списку версий и названий клинтского ПО, а также по списку
+// устаревших клиентов комнаты.
 func (j *Jabber) BunySoftwareVersion(v xmpp.IQ, ver IqResultSoftwareVersion) error {
-	var err error
+	// На всякий случай: себя никогда не баним, явным образом
+	if v.From == "" || v.From == j.Talk.JID() {
+		return nil
+	}
 
-	if v.From != "" {
-		// На всякий случай: себя никогда не баним, явным образом
-		if v.From == j.Talk.JID() {
-			return err
-		}
+	room := strings.SplitN(v.From, "/", 2)[0]
 
-		room := strings.SplitN(v.From, "/", 2)[0]
+	// Действовать мы можем только в рамках тех комнат, где явно присуствуем.
+	if !slices.Contains(j.RoomsConnected, room) {
+		return nil
+	}
 
-		var (
-			presenceJSONStrings []string
-		)
+	log.Debugf("Looking up %s in presence db", v.From)
 
-		if presenceJSONInterface, present := j.RoomPresences.Get(room); present {
-			presenceJSONStrings = InterfaceToStringSlice(presenceJSONInterface)
-		}
+	p, found := j.GetPresence(v.From)
+
+	if !found {
+		log.Infof("Unable to find %s in presence db, skipping useragent blacklist check", v.From)
+
+		return nil
+	}
+
+	if j.IsProtected(p) {
+		log.Infof("Skipping useragent blacklist check for %s", v.From)
+
+		return nil
+	}
 
-		log.Debugf("Looking up %s in presence db", v.From)
+	log.Debugf("Found jid of %s in presence db: %s", v.From, p.JID)
 
-		for _, presenceJSONString := range presenceJSONStrings {
-			var p xmpp.Presence
-			_ = json.Unmarshal([]byte(presenceJSONString), &p)
+	evilJid := strings.SplitN(p.JID, "/", 2)[0]
 
-			if p.Affiliation == "admin" || p.Affiliation == "owner" {
-				log.Infof("Skipping useragent blacklist check for %s because his affiliation is %s", v.From, p.Affiliation)
+	for _, bEntry := range j.BlackList.Blacklist {
+		// Нас интересуют только действующие глобальные правила и правила этой комнаты.
+		if (bEntry.RoomName != "" && bEntry.RoomName != room) || bEntry.Expired() {
+			continue
+		}
 
+		for _, useragent := range bEntry.userAgents {
+			if !useragent.Match(ver) {
 				continue
 			}
 
-			// На всякий случай.
-			if p.Role == "moderator" {
-				log.Infof("Skipping useragent blacklist check for %s because his role is %s", v.From, p.Role)
+			log.Warnf(
+				"Hammer falls on %s (%s): software %s %s %s matches with blacklist entry: %s",
+				v.From,
+				evilJid,
+				ver.Name,
+				ver.Version,
+				ver.Os,
+				useragent,
+			)
 
-				continue
+			if j.RuleHit(room, v.From, evilJid, bEntry, "user_agent", useragent.String(), ver.Name+" "+ver.Version+" "+ver.Os, v.Type, "") {
+				return nil
 			}
+		}
+	}
 
-			if v.From == p.From {
-				log.Errorf("Found jid of %s in presence db: %s", v.From, p.JID)
-
-				// Lookup in global blacklist.
-				for _, cRoom := range j.RoomsConnected {
-					if cRoom == room {
-						for _, bEntry := range j.BlackList.Blacklist {
-							// Обработаем правила глобального чёрного списка
-							if bEntry.RoomName == "" {
-								for _, useragent := range bEntry.UserAgent {
-									switch {
-									case useragent.Name != "" && useragent.Version != "" && useragent.Os != "":
-										if ver.Name == useragent.Name && ver.Version == useragent.Version && ver.Os == useragent.Os {
-											id, err := j.Squash(room, p.JID, bEntry.ReasonEnable, v.Type)
-
-											if err != nil {
-												err := fmt.Errorf(
-													"unable to ban user: id=%s, err=%w",
-													id,
-													err,
-												)
-
-												j.GTomb.Kill(err)
-											}
-
-											return err
-										}
-
-									case useragent.Name != "" && useragent.Version != "":
-										if ver.Name == useragent.Name && ver.Version == useragent.Version {
-											id, err := j.Squash(room, p.JID, bEntry.ReasonEnable, v.Type)
-
-											if err != nil {
-												err := fmt.Errorf(
-													"unable to ban user: id=%s, err=%w",
-													id,
-													err,
-												)
-
-												j.GTomb.Kill(err)
-											}
-
-											return err
-										}
-
-									case useragent.Name != "":
-										if ver.Name == useragent.Name {
-											id, err := j.Squash(room, p.JID, bEntry.ReasonEnable, v.Type)
-
-											if err != nil {
-												err := fmt.Errorf(
-													"unable to ban user: id=%s, err=%w",
-													id,
-													err,
-												)
-
-												j.GTomb.Kill(err)
-											}
-
-											return err
-										}
-
-									case useragent.Version != "":
-										if ver.Version == useragent.Version {
-											id, err := j.Squash(room, p.JID, bEntry.ReasonEnable, v.Type)
-
-											if err != nil {
-												err := fmt.Errorf(
-													"unable to ban user: id=%s, err=%w",
-													id,
-													err,
-												)
-
-												j.GTomb.Kill(err)
-											}
-
-											return err
-										}
-									}
-								}
-							}
+	// Теперь, когда клиент известен, выражения с client.* могут сработать.
+	if j.BunyExpr(room, v.From, p.JID, "", v.Type, "") {
+		return nil
+	}
 
-							if bEntry.RoomName == room {
-								for _, useragent := range bEntry.UserAgent {
-									switch {
-									case useragent.Name != "" && useragent.Version != "" && useragent.Os != "":
-										if ver.Name == useragent.Name && ver.Version == useragent.Version && ver.Os == useragent.Os {
-											id, err := j.Squash(room, p.JID, bEntry.ReasonEnable, v.Type)
-
-											if err != nil {
-												err := fmt.Errorf(
-													"unable to ban user: id=%s, err=%w",
-													id,
-													err,
-												)
-
-												j.GTomb.Kill(err)
-											}
-
-											return err
-										}
-
-									case useragent.Name != "" && useragent.Version != "":
-										if ver.Name == useragent.Name && ver.Version == useragent.Version {
-											id, err := j.Squash(room, p.JID, bEntry.ReasonEnable, v.Type)
-
-											if err != nil {
-												err := fmt.Errorf(
-													"unable to ban user: id=%s, err=%w",
-													id,
-													err,
-												)
-
-												j.GTomb.Kill(err)
-											}
-
-											return err
-										}
-
-									case useragent.Name != "":
-										if ver.Name == useragent.Name {
-											id, err := j.Squash(room, p.JID, bEntry.ReasonEnable, v.Type)
-
-											if err != nil {
-												err := fmt.Errorf(
-													"unable to ban user: id=%s, err=%w",
-													id,
-													err,
-												)
-
-												j.GTomb.Kill(err)
-											}
-
-											return err
-										}
-
-									case useragent.Version != "":
-										if ver.Version == useragent.Version {
-											id, err := j.Squash(room, p.JID, bEntry.ReasonEnable, v.Type)
-
-											if err != nil {
-												err := fmt.Errorf(
-													"unable to ban user: id=%s, err=%w",
-													id,
-													err,
-												)
-
-												j.GTomb.Kill(err)
-											}
-
-											return err
-										}
-									}
-								}
-							}
-						}
-					}
-				}
+	// Устаревшие клиенты не обязательно злодейские, поэтому для них в комнате может быть задано любое действие.
+	if channel := j.GetRoomConfig(room); channel != nil {
+		for _, oc := range channel.OutdatedClients {
+			if !oc.matcher.Match(ver) {
+				continue
 			}
+
+			j.Punish(
+				v.From,
+				evilJid,
+				oc.Action,
+				fmt.Sprintf("outdated client %s %s matches %s", ver.Name, ver.Version, oc.matcher),
+			)
+
+			return nil
 		}
 	}
 
-	return err
+	return nil
+}
+
+// BunyExpr проверяет участника по правилам-выражениям чёрного списка и в случае совпадения отправляет его в бан.
+// from - полный ник участника, jid - его real jid, text и msgID - текст и stanza-id сообщения, если проверяется
+// сообщение. Возвращает true, если участник отправлен в бан и дальше его проверять не нужно.
+func (j *Jabber) BunyExpr(room, from, jid, text, vType, msgID string) bool {
+	return j.MatchExprs(
+		room,
+		func() *ExprEnv { return j.NewExprEnv(from, jid, text) },
+		func(m RuleMatch, env *ExprEnv) bool {
+			log.Warnf("Hammer falls on %s (%s): matches with blacklist expression: %s", from, env.JID, m.Pattern)
+
+			return j.RuleHit(room, from, env.JID, m.Entry, m.Kind, m.Pattern, m.Match, vType, msgID)
+		},
+	)
 }
 
 /* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,421 @@
+package jabber
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/eleksir/go-xmpp"
+	log "github.com/sirupsen/logrus"
+)
+
+// CapturedEvent - одно событие из записи трафика, одна строка event_capture.
+type CapturedEvent struct {
+	Time  time.Time       `json:"time"`
+	Type  string          `json:"type"`
+	Event json.RawMessage `json:"event"`
+}
+
+// ReplayEvent - разобранное событие из записи трафика, готовое для ParseEvent. Time может быть нулевым, если время
+// события неизвестно.
+type ReplayEvent struct {
+	Time  time.Time
+	Event interface{}
+}
+
+// CaptureEvent дописывает событие в event_capture, по одному json-объекту на строку. Записываются только те события,
+// которые умеет воспроизводить replay.
+func (j *Jabber) CaptureEvent(e interface{}) {
+	if j.C.Jabber.EventCapture == "" {
+		return
+	}
+
+	var kind string
+
+	switch e.(type) {
+	case xmpp.Chat:
+		kind = "chat"
+	case xmpp.Presence:
+		kind = "presence"
+	case xmpp.IQ:
+		kind = "iq"
+	case xmpp.DiscoResult:
+		kind = "disco_result"
+	default:
+		return
+	}
+
+	event, err := json.Marshal(e)
+
+	if err != nil {
+		log.Errorf("Unable to serialize %s event for capture: %s", kind, err)
+
+		return
+	}
+
+	buf, err := json.Marshal(CapturedEvent{Time: time.Now(), Type: kind, Event: event})
+
+	if err != nil {
+		log.Errorf("Unable to serialize %s event for capture: %s", kind, err)
+
+		return
+	}
+
+	if err := appendLine(j.C.Jabber.EventCapture, buf); err != nil {
+		log.Errorf("Unable to capture event: %s", err)
+	}
+}
+
+// ReadCapture читает запись трафика, сделанную через event_capture.
+func ReadCapture(r io.Reader) ([]ReplayEvent, error) {
+	var (
+		events  []ReplayEvent
+		scanner = bufio.NewScanner(r)
+		line    int
+	)
+
+	scanner.Buffer(make([]byte, 0, 65536), 16777216)
+
+	for scanner.Scan() {
+		line++
+
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var (
+			c     CapturedEvent
+			event interface{}
+			err   error
+		)
+
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		switch c.Type {
+		case "chat":
+			var v xmpp.Chat
+			err = json.Unmarshal(c.Event, &v)
+			event = v
+		case "presence":
+			var v xmpp.Presence
+			err = json.Unmarshal(c.Event, &v)
+			event = v
+		case "iq":
+			var v xmpp.IQ
+			err = json.Unmarshal(c.Event, &v)
+			event = v
+		case "disco_result":
+			var v xmpp.DiscoResult
+			err = json.Unmarshal(c.Event, &v)
+			event = v
+		default:
+			log.Warnf("Line %d: unknown event type %s, skipping", line, c.Type)
+
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("line %d: unable to parse %s event: %w", line, c.Type, err)
+		}
+
+		events = append(events, ReplayEvent{Time: c.Time, Event: event})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read capture: %w", err)
+	}
+
+	return events, nil
+}
+
+// traceMessage, tracePresence и traceIQ повторяют то, как разбирает строфы go-xmpp, чтобы из трейса получались такие
+// же события, как от настоящего клиента.
+type traceMessage struct {
+	From    string            `xml:"from,attr"`
+	Type    string            `xml:"type,attr"`
+	Subject string            `xml:"subject"`
+	Body    string            `xml:"body"`
+	Thread  string            `xml:"thread"`
+	Other   []xmpp.XMLElement `xml:",any"`
+	Delay   xmpp.Delay        `xml:"delay"`
+}
+
+type tracePresence struct {
+	From string `xml:"from,attr"`
+	ID   string `xml:"id,attr"`
+	To   string `xml:"to,attr"`
+	Type string `xml:"type,attr"`
+	X    struct {
+		Item struct {
+			Affiliation string `xml:"affiliation,attr"`
+			Jid         string `xml:"jid,attr"`
+			Role        string `xml:"role,attr"`
+		} `xml:"item"`
+	} `xml:"x"`
+	Show     string `xml:"show"`
+	Status   string `xml:"status"`
+	Priority string `xml:"priority,attr"`
+}
+
+type traceIQ struct {
+	From  string          `xml:"from,attr"`
+	ID    string          `xml:"id,attr"`
+	To    string          `xml:"to,attr"`
+	Type  string          `xml:"type,attr"`
+	Query xmpp.XMLElement `xml:",any"`
+}
+
+type traceDiscoQuery struct {
+	Features []struct {
+		Var string `xml:"var,attr"`
+	} `xml:"feature"`
+	Identities []struct {
+		Category string `xml:"category,attr"`
+		Type     string `xml:"type,attr"`
+		Name     string `xml:"name,attr"`
+	} `xml:"identity"`
+}
+
+// ReadTrace читает трейс, который пишет go-xmpp в xmpp.DebugWriter при loglevel trace, и достаёт из него входящие
+// строфы. В трейсе вперемешку и входящий, и исходящий трафик, исходящие строфы отличаем по отсутствию атрибута from
+// или по тому, что from - это сам бот (ownJid).
+func ReadTrace(r io.Reader, ownJid string) ([]ReplayEvent, error) {
+	var (
+		stream  strings.Builder
+		scanner = bufio.NewScanner(r)
+	)
+
+	scanner.Buffer(make([]byte, 0, 65536), 16777216)
+
+	// Каждый кусок, прочитанный из сокета или записанный в него, logrus пишет строкой вида
+	// time=... level=trace msg=<кусок xml-я> logger=stdlib. Куски режутся где попало, поэтому склеиваем их обратно в
+	// один поток.
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if !strings.HasSuffix(line, " logger=stdlib") {
+			continue
+		}
+
+		_, msg, found := strings.Cut(strings.TrimSuffix(line, " logger=stdlib"), " msg=")
+
+		if !found {
+			continue
+		}
+
+		stream.WriteString(msg)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read trace: %w", err)
+	}
+
+	var (
+		events []ReplayEvent
+		data   = stream.String()
+		bare   = strings.SplitN(ownJid, "/", 2)[0]
+	)
+
+	for pos := 0; pos < len(data); {
+		start := nextTraceStanza(data, pos)
+
+		if start < 0 {
+			break
+		}
+
+		d := xml.NewDecoder(strings.NewReader(data[start:]))
+		event, err := decodeTraceStanza(d)
+
+		// Обрывок или мусор (например, исходящая строфа вклинилась посреди входящей), ищем следующую строфу.
+		if err != nil {
+			log.Debugf("Skipping broken stanza at offset %d: %s", start, err)
+
+			pos = start + 1
+
+			continue
+		}
+
+		pos = start + int(d.InputOffset())
+
+		if event == nil {
+			continue
+		}
+
+		if from := eventFrom(event); from == "" || strings.SplitN(from, "/", 2)[0] == bare {
+			continue
+		}
+
+		events = append(events, ReplayEvent{Time: time.Time{}, Event: event})
+	}
+
+	return events, nil
+}
+
+// nextTraceStanza ищет начало следующей строфы message, presence или iq, начиная с позиции pos.
+func nextTraceStanza(data string, pos int) int {
+	best := -1
+
+	for _, tag := range []string{"<message", "<presence", "<iq"} {
+		for from := pos; from < len(data); {
+			n := strings.Index(data[from:], tag)
+
+			if n < 0 {
+				break
+			}
+
+			n += from
+			end := n + len(tag)
+
+			// Не путаем <iq с каким-нибудь <iqfoo.
+			if end < len(data) && strings.ContainsRune(" \t\r\n/>", rune(data[end])) {
+				if best < 0 || n < best {
+					best = n
+				}
+
+				break
+			}
+
+			from = end
+		}
+	}
+
+	return best
+}
+
+// decodeTraceStanza разбирает одну строфу и превращает её в то же, что вернул бы xmpp.Client.Recv(). Строфы, которые
+// бот всё равно не обрабатывает, возвращаются как nil.
+func decodeTraceStanza(d *xml.Decoder) (interface{}, error) {
+	var se xml.StartElement
+
+	for {
+		tok, err := d.Token()
+
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+
+		if s, ok := tok.(xml.StartElement); ok {
+			se = s
+
+			break
+		}
+	}
+
+	switch se.Name.Local {
+	case "message":
+		var m traceMessage
+
+		if err := d.DecodeElement(&m, &se); err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+
+		other := make([]string, len(m.Other))
+
+		for n := range m.Other {
+			other[n] = m.Other[n].String()
+		}
+
+		stamp, _ := time.Parse("2006-01-02T15:04:05Z", m.Delay.Stamp)
+
+		return xmpp.Chat{ //nolint:exhaustruct
+			Remote:    m.From,
+			Type:      m.Type,
+			Text:      m.Body,
+			Subject:   m.Subject,
+			Thread:    m.Thread,
+			Other:     other,
+			OtherElem: m.Other,
+			Stamp:     stamp,
+		}, nil
+
+	case "presence":
+		var p tracePresence
+
+		if err := d.DecodeElement(&p, &se); err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+
+		return xmpp.Presence{
+			From:        p.From,
+			To:          p.To,
+			Type:        p.Type,
+			Show:        p.Show,
+			Status:      p.Status,
+			Priority:    p.Priority,
+			ID:          p.ID,
+			Affiliation: p.X.Item.Affiliation,
+			Role:        p.X.Item.Role,
+			JID:         p.X.Item.Jid,
+		}, nil
+
+	case "iq":
+		var iq traceIQ
+
+		if err := d.DecodeElement(&iq, &se); err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+
+		// Ответ на наш disco#info go-xmpp отдаёт отдельным типом.
+		if iq.Type == xmpp.IQTypeResult && iq.ID == "info3" && iq.Query.XMLName.Space == xmpp.XMPPNS_DISCO_INFO {
+			var disco traceDiscoQuery
+
+			if err := xml.Unmarshal([]byte("<query>"+iq.Query.InnerXML+"</query>"), &disco); err != nil {
+				return nil, err //nolint:wrapcheck
+			}
+
+			result := xmpp.DiscoResult{ID: iq.ID, From: iq.From, To: iq.To} //nolint:exhaustruct
+
+			for _, f := range disco.Features {
+				result.Features = append(result.Features, f.Var)
+			}
+
+			for _, i := range disco.Identities {
+				result.Identities = append(
+					result.Identities,
+					xmpp.DiscoIdentity{Category: i.Category, Type: i.Type, Name: i.Name},
+				)
+			}
+
+			return result, nil
+		}
+
+		if iq.Query.XMLName.Local == "" {
+			return xmpp.IQ{ID: iq.ID, From: iq.From, To: iq.To, Type: iq.Type}, nil //nolint:exhaustruct
+		}
+
+		query, err := xml.Marshal(iq.Query)
+
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+
+		return xmpp.IQ{ID: iq.ID, From: iq.From, To: iq.To, Type: iq.Type, Query: query}, nil
+	}
+
+	return nil, d.Skip() //nolint:wrapcheck
+}
+
+// eventFrom возвращает отправителя события.
+func eventFrom(e interface{}) string {
+	switch v := e.(type) {
+	case xmpp.Chat:
+		return v.Remote
+	case xmpp.Presence:
+		return v.From
+	case xmpp.IQ:
+		return v.From
+	case xmpp.DiscoResult:
+		return v.From
+	}
+
+	return ""
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,502 @@
+package jabber
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eleksir/go-xmpp"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// catchupState - имя файла состояния с последними виденными сообщениями комнат.
+const catchupState = "catchup.json"
+
+// Пространства имён xep-0313 (архив сообщений), xep-0359 (stanza-id) и xep-0059 (постраничная выдача).
+const (
+	nsMAM       = "urn:xmpp:mam:2"
+	nsStanzaID  = "urn:xmpp:sid:0"
+	nsRSM       = "http://jabber.org/protocol/rsm"
+	nsDataForms = "jabber:x:data"
+)
+
+// CatchupMark - последнее сообщение комнаты, которое видел бот: его stanza-id, если комната их проставляет, и время.
+type CatchupMark struct {
+	ID   string    `json:"id,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+// CatchupList - последние виденные сообщения комнат, по комнате, а также запросы к архивам комнат, на которые ещё не
+// пришёл ответ. Последние виденные сообщения сохраняются в state_dir, чтобы после перезапуска бот знал, с какого
+// момента проверять пропущенное.
+type CatchupList struct {
+	mu    sync.Mutex
+	marks map[string]CatchupMark
+	dirty bool
+
+	// queries - запросы к архивам, id запроса -> комната.
+	queries map[string]string
+
+	// history - комнаты, которые сейчас присылают историю после входа, и до какого момента её ждать.
+	history map[string]time.Time
+
+	// start - последние виденные сообщения комнат на момент входа в комнату: пропущенным считается то, что новее. Живые
+	// сообщения, которые приходят вперемешку с пропущенными, сдвигают marks, но не start.
+	start map[string]CatchupMark
+}
+
+// mamResult - то, что лежит внутри <result/> сообщения из архива комнаты.
+type mamResult struct {
+	Delay struct {
+		Stamp string `xml:"stamp,attr"`
+	} `xml:"delay"`
+	Message struct {
+		From string `xml:"from,attr"`
+		Type string `xml:"type,attr"`
+		Body string `xml:"body"`
+		X    struct {
+			Item struct {
+				Jid string `xml:"jid,attr"`
+			} `xml:"item"`
+		} `xml:"x"`
+	} `xml:"message"`
+}
+
+// mamFin - ответ на запрос к архиву комнаты.
+type mamFin struct {
+	Complete string `xml:"complete,attr"`
+}
+
+// LoadCatchup загружает последние виденные сообщения комнат из state_dir.
+func (j *Jabber) LoadCatchup() *CatchupList {
+	l := &CatchupList{ //nolint:exhaustruct
+		marks:   make(map[string]CatchupMark),
+		queries: make(map[string]string),
+		history: make(map[string]time.Time),
+		start:   make(map[string]CatchupMark),
+	}
+
+	if err := j.LoadState(catchupState, &l.marks); err != nil {
+		log.Errorf("Unable to load last seen messages: %s", err)
+	}
+
+	return l
+}
+
+// SaveCatchup сохраняет последние виденные сообщения комнат в state_dir, если они поменялись.
+func (j *Jabber) SaveCatchup() {
+	if j.Catchup == nil {
+		return
+	}
+
+	j.Catchup.mu.Lock()
+
+	if !j.Catchup.dirty {
+		j.Catchup.mu.Unlock()
+
+		return
+	}
+
+	marks := make(map[string]CatchupMark, len(j.Catchup.marks))
+
+	for room, mark := range j.Catchup.marks {
+		marks[room] = mark
+	}
+
+	j.Catchup.dirty = false
+	j.Catchup.mu.Unlock()
+
+	if err := j.SaveState(catchupState, marks); err != nil {
+		log.Errorf("Unable to save last seen messages: %s", err)
+	}
+}
+
+// CatchupWorker раз в минуту и при остановке бота сохраняет последние виденные сообщения комнат.
+func (j *Jabber) CatchupWorker() error {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-j.GTomb.Dying():
+			j.SaveCatchup()
+
+			return nil
+		case <-ticker.C:
+		}
+
+		j.SaveCatchup()
+	}
+}
+
+// Mark запоминает сообщение id, отправленное в комнату room в момент t, как последнее виденное, если оно новее уже
+// запомненного.
+func (l *CatchupList) Mark(room, id string, t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if mark, ok := l.marks[room]; ok && t.Before(mark.Time) {
+		return
+	}
+
+	l.marks[room] = CatchupMark{ID: id, Time: t}
+	l.dirty = true
+}
+
+// Seen сообщает, видел ли бот уже сообщение id, отправленное в комнату room в момент t. Нулевое t означает, что время
+// сообщения неизвестно.
+func (l *CatchupList) Seen(room, id string, t time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	mark, ok := l.start[room]
+
+	if !ok {
+		mark, ok = l.marks[room]
+	}
+
+	if !ok {
+		return false
+	}
+
+	if id != "" && id == mark.ID {
+		return true
+	}
+
+	return !t.IsZero() && t.Before(mark.Time)
+}
+
+// InHistory сообщает, присылает ли сейчас комната историю после входа бота. Сообщения из истории - пропущенные, а не
+// живые, команды в них не выполняются.
+func (l *CatchupList) InHistory(room string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	until, ok := l.history[room]
+
+	if ok && time.Now().After(until) {
+		delete(l.history, room)
+
+		return false
+	}
+
+	return ok
+}
+
+// EndHistory отмечает, что комната прислала всю историю: за историей всегда следует тема комнаты.
+func (l *CatchupList) EndHistory(room string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.history, room)
+}
+
+// IsQuery сообщает, является ли id запросом к архиву комнаты, на который ещё не пришёл ответ.
+func (l *CatchupList) IsQuery(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, ok := l.queries[id]
+
+	return ok
+}
+
+// stanzaID достаёт из сообщения stanza-id, который проставила комната room (xep-0359).
+func stanzaID(v xmpp.Chat, room string) string {
+	for _, e := range v.OtherElem {
+		if e.XMLName.Local != "stanza-id" || e.XMLName.Space != nsStanzaID {
+			continue
+		}
+
+		var id, by string
+
+		for _, a := range e.Attr {
+			switch a.Name.Local {
+			case "id":
+				id = a.Value
+			case "by":
+				by = a.Value
+			}
+		}
+
+		// stanza-id, проставленные кем-то ещё, ничего не значат, их может подделать кто угодно.
+		if by == room {
+			return id
+		}
+	}
+
+	return ""
+}
+
+// begin запоминает последнее виденное сообщение комнаты room на момент входа в неё: всё, что новее, - пропущенное.
+func (l *CatchupList) begin(room string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if mark, ok := l.marks[room]; ok {
+		l.start[room] = mark
+	} else {
+		delete(l.start, room)
+	}
+}
+
+// catchupSince возвращает, с какого момента проверять пропущенные сообщения комнаты: с последнего виденного на момент
+// входа в комнату, но не раньше, чем max_age назад. Если проверка выключена или бот ещё ни разу не видел сообщений
+// комнаты, то проверять нечего.
+func (j *Jabber) catchupSince(room string) (time.Time, bool) {
+	channel := j.GetRoomConfig(room)
+
+	if channel == nil || !channel.Catchup.Enabled || j.Catchup == nil {
+		return time.Time{}, false
+	}
+
+	j.Catchup.mu.Lock()
+	mark, ok := j.Catchup.start[room]
+	j.Catchup.mu.Unlock()
+
+	if !ok {
+		return time.Time{}, false
+	}
+
+	since := mark.Time
+
+	if floor := time.Now().Add(-time.Duration(channel.Catchup.MaxAge) * time.Second); since.Before(floor) {
+		log.Infof(
+			"Bot missed messages in %s since %s, checking only ones since %s",
+			room,
+			since.Format(time.RFC3339),
+			floor.Format(time.RFC3339),
+		)
+
+		since = floor
+	}
+
+	return since, true
+}
+
+// roomSupports сообщает, анонсировала ли комната поддержку feature в ответе на disco#info.
+func (j *Jabber) roomSupports(room, feature string) bool {
+	caps, exist := j.MucCapsList.Get(room)
+
+	return exist && caps.(map[string]bool)[feature]
+}
+
+// joinRoom заходит в комнату. Если для комнаты включена проверка пропущенных сообщений, а архива у комнаты нет, то
+// просит у комнаты историю с момента последнего виденного сообщения. Если архив есть, то пропущенное запросит
+// RequestArchive, когда бот войдёт в комнату.
+func (j *Jabber) joinRoom(room string) error {
+	nick := j.GetBotNickFromRoomConfig(room)
+
+	if j.Catchup != nil {
+		j.Catchup.begin(room)
+	}
+
+	if j.roomSupports(room, nsMAM) {
+		_, err := j.Talk.JoinMUCNoHistory(room, nick)
+
+		return err //nolint:wrapcheck
+	}
+
+	since, ok := j.catchupSince(room)
+
+	if !ok {
+		_, err := j.Talk.JoinMUCNoHistory(room, nick)
+
+		return err //nolint:wrapcheck
+	}
+
+	// Историю комната присылает сразу после входа. Если темы у комнаты нет и конец истории не виден, то перестаём
+	// ждать её через пару таймаутов соединения.
+	j.Catchup.mu.Lock()
+	j.Catchup.history[room] = time.Now().Add(2 * time.Duration(j.C.Jabber.ConnectionTimeout) * time.Second)
+	j.Catchup.mu.Unlock()
+
+	log.Infof(
+		"Room %s has no message archive, asking for history since %s to check missed messages",
+		room,
+		since.Format(time.RFC3339),
+	)
+
+	_, err := j.Talk.JoinMUC(room, nick, xmpp.SinceHistory, 0, &since)
+
+	return err //nolint:wrapcheck
+}
+
+// RequestArchive запрашивает из архива комнаты (xep-0313) последние max_messages сообщений с момента последнего
+// виденного.
+func (j *Jabber) RequestArchive(room string) error {
+	since, ok := j.catchupSince(room)
+
+	if !ok || !j.roomSupports(room, nsMAM) {
+		return nil
+	}
+
+	channel := j.GetRoomConfig(room)
+	id := "mam-" + uuid.New().String()
+
+	// Пустой <before/> - последняя страница выдачи, то есть самые свежие сообщения.
+	query := fmt.Sprintf(
+		"<x xmlns='%s' type='submit'>"+
+			"<field var='FORM_TYPE' type='hidden'><value>%s</value></field>"+
+			"<field var='start'><value>%s</value></field>"+
+			"</x>"+
+			"<set xmlns='%s'><max>%d</max><before/></set>",
+		nsDataForms,
+		nsMAM,
+		since.UTC().Format(time.RFC3339),
+		nsRSM,
+		channel.Catchup.MaxMessages,
+	)
+
+	j.Catchup.mu.Lock()
+	j.Catchup.queries[id] = room
+	j.Catchup.mu.Unlock()
+
+	log.Infof("Requesting messages since %s from archive of %s", since.Format(time.RFC3339), room)
+
+	if _, err := j.Talk.RawInformationQuery(j.Talk.JID(), room, id, xmpp.IQTypeSet, nsMAM, query); err != nil {
+		return fmt.Errorf("unable to query archive of %s: %w", room, err)
+	}
+
+	return nil
+}
+
+// ArchiveQueryDone обрабатывает ответ комнаты на запрос к архиву. Сами сообщения приходят до ответа, отдельными
+// сообщениями.
+func (j *Jabber) ArchiveQueryDone(v xmpp.IQ) {
+	j.Catchup.mu.Lock()
+	room := j.Catchup.queries[v.ID]
+	delete(j.Catchup.queries, v.ID)
+	j.Catchup.mu.Unlock()
+
+	if v.Type == xmpp.IQTypeError {
+		log.Errorf("Unable to get missed messages from archive of %s, got error", room)
+
+		return
+	}
+
+	var fin mamFin
+
+	if err := xml.Unmarshal(v.Query, &fin); err == nil && fin.Complete != "true" {
+		log.Warnf("Too many missed messages in %s, only the last ones are checked", room)
+
+		return
+	}
+
+	log.Infof("Missed messages in %s are checked", room)
+}
+
+// CatchupArchived проверяет сообщение из архива комнаты. Возвращает false, если v - не сообщение из архива.
+func (j *Jabber) CatchupArchived(v xmpp.Chat) (bool, error) {
+	room := strings.SplitN(v.Remote, "/", 2)[0]
+
+	for _, e := range v.OtherElem {
+		if e.XMLName.Local != "result" || e.XMLName.Space != nsMAM {
+			continue
+		}
+
+		// Архив комнаты может прислать только сама комната, и только если мы его запрашивали.
+		if v.Remote != room || !j.archiveRequested(room) {
+			log.Infof("Got unexpected archived message from %s, skipping", v.Remote)
+
+			return true, nil
+		}
+
+		var (
+			r  mamResult
+			id string
+		)
+
+		if err := xml.Unmarshal([]byte(e.InnerXML), &r); err != nil {
+			log.Errorf("Unable to parse archived message from %s: %s", room, err)
+
+			return true, nil
+		}
+
+		for _, a := range e.Attr {
+			if a.Name.Local == "id" {
+				id = a.Value
+			}
+		}
+
+		stamp, _ := time.Parse(time.RFC3339, r.Delay.Stamp)
+
+		// Архив хранит и то, что было в комнате при боте, и то, что бот уже проверил.
+		if r.Message.Type != "groupchat" || r.Message.Body == "" ||
+			strings.SplitN(r.Message.From, "/", 2)[0] != room {
+			return true, nil
+		}
+
+		chat := xmpp.Chat{Remote: r.Message.From, Type: r.Message.Type, Text: r.Message.Body, Stamp: stamp} //nolint:exhaustruct
+
+		return true, j.CheckMissed(chat, id, r.Message.X.Item.Jid)
+	}
+
+	return false, nil
+}
+
+// archiveRequested сообщает, ждём ли мы ответа на запрос к архиву комнаты room.
+func (j *Jabber) archiveRequested(room string) bool {
+	j.Catchup.mu.Lock()
+	defer j.Catchup.mu.Unlock()
+
+	for _, r := range j.Catchup.queries {
+		if r == room {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckMissed проверяет пропущенное сообщение, из архива или из истории комнаты, так же, как живое, но только если оно
+// не старше max_age и бот его ещё не видел. Команды в пропущенных сообщениях не выполняются. id - stanza-id сообщения,
+// jid - real jid автора, если комната его сообщила.
+func (j *Jabber) CheckMissed(v xmpp.Chat, id, jid string) error {
+	room := strings.SplitN(v.Remote, "/", 2)[0]
+	channel := j.GetRoomConfig(room)
+
+	if channel == nil || !channel.Catchup.Enabled {
+		return nil
+	}
+
+	if !v.Stamp.IsZero() && time.Since(v.Stamp) > time.Duration(channel.Catchup.MaxAge)*time.Second {
+		log.Debugf("Missed message from %s at %s is too old, skipping", v.Remote, v.Stamp)
+
+		return nil
+	}
+
+	if j.Catchup.Seen(room, id, v.Stamp) {
+		return nil
+	}
+
+	stamp := v.Stamp
+
+	if stamp.IsZero() {
+		stamp = time.Now()
+	}
+
+	j.Catchup.Mark(room, id, stamp)
+
+	if nick := strings.SplitN(v.Remote, "/", 2); len(nick) < 2 || nick[1] == j.GetBotNickFromRoomConfig(room) {
+		return nil
+	}
+
+	// Автора, может быть, уже нет в комнате, тогда о нём известно только то, что сообщила комната.
+	p, found := j.GetPresence(v.Remote)
+
+	if !found {
+		p = xmpp.Presence{From: v.Remote, JID: jid} //nolint:exhaustruct
+	}
+
+	log.Infof("Checking missed message from %s at %s: %s", v.Remote, stamp.Format(time.RFC3339), v.Text)
+
+	j.TrackMessage(v.Remote, id)
+
+	return j.checkChat(v, p, id)
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
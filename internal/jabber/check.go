@@ -0,0 +1,583 @@
+package jabber
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hjson/hjson-go"
+)
+
+// Серьёзность проблем, найденных командой check. С ошибками бот не запустится или будет работать не так, как
+// задумано; предупреждения - то, что скорее всего опечатка или недосмотр.
+const (
+	CheckError   = "error"
+	CheckWarning = "warning"
+)
+
+// CheckProblem - проблема, найденная командой check.
+type CheckProblem struct {
+	File     string
+	Severity string
+	Message  string
+}
+
+// String возвращает проблему в виде "файл: серьёзность: описание".
+func (p CheckProblem) String() string {
+	return fmt.Sprintf("%s: %s: %s", p.File, p.Severity, p.Message)
+}
+
+// checker копит проблемы, найденные при проверке файлов.
+type checker struct {
+	file     string
+	problems []CheckProblem
+}
+
+// errorf добавляет ошибку в текущем файле.
+func (c *checker) errorf(format string, args ...interface{}) {
+	c.problems = append(c.problems, CheckProblem{File: c.file, Severity: CheckError, Message: fmt.Sprintf(format, args...)})
+}
+
+// warnf добавляет предупреждение в текущем файле.
+func (c *checker) warnf(format string, args ...interface{}) {
+	c.problems = append(c.problems, CheckProblem{File: c.file, Severity: CheckWarning, Message: fmt.Sprintf(format, args...)})
+}
+
+// broadProbes - строки, на которых проверяем, не совпадает ли регулярка вообще со всем подряд.
+var broadProbes = []string{"x", "0", " ", "user@example.org/resource", "Привет"}
+
+// CheckFiles проверяет конфиг, белый и чёрный списки, не запуская бота. Если какой-то из файлов не задан, то он ищется
+// там же, где его ищет бот, и проверяются все найденные кандидаты: бот молча пропускает файл, который не смог
+// разобрать, и берёт следующий. Возвращает найденные проблемы в том порядке, в котором они нашлись.
+func CheckFiles(configFile, whitelistFile, blacklistFile string) ([]CheckProblem, error) {
+	executablePath, err := os.Executable()
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to get current executable path: %w", err)
+	}
+
+	var (
+		c   = &checker{} //nolint:exhaustruct
+		cfg MyConfig
+		wl  MyWhiteList
+		bl  MyBlackList
+	)
+
+	configOK := c.load("config", candidates(configFile, ConfigLocations(executablePath)), 2777216, &cfg)
+
+	if configOK {
+		c.checkConfig(&cfg, filepath.Dir(executablePath))
+	}
+
+	if c.load("whitelist", candidates(whitelistFile, WhitelistLocations(executablePath)), 2097152, &wl) {
+		c.checkWhitelist(&wl, configOK, &cfg)
+	}
+
+	if c.load("blacklist", candidates(blacklistFile, BlacklistLocations(executablePath)), 16777216, &bl) {
+		c.checkBlacklist(&bl, configOK, &cfg)
+	}
+
+	return c.problems, nil
+}
+
+// candidates возвращает файлы для проверки: заданный явно или все обычные места.
+func candidates(file string, locations []string) []string {
+	if file != "" {
+		return []string{file}
+	}
+
+	return locations
+}
+
+// load ищет среди files первый файл, который бот смог бы прочитать, так же, как это делают ReadConfig, ReadWhitelist и
+// ReadBlacklist, и разбирает его в v. Про каждый файл, который бот пропустил бы, заводится ошибка. Неизвестные ключи в
+// выбранном файле - предупреждения. Возвращает false, если подходящего файла не нашлось.
+func (c *checker) load(what string, files []string, maxSize int64, v interface{}) bool {
+	for _, file := range files {
+		c.file = file
+
+		fileInfo, err := os.Stat(file)
+
+		if err != nil {
+			// Файла в обычном месте может и не быть, это нормально, а вот явно заданный файл должен быть.
+			if len(files) == 1 {
+				c.errorf("unable to read %s: %s", what, err)
+			}
+
+			continue
+		}
+
+		if fileInfo.Size() > maxSize {
+			c.errorf("%s file is too long (%d bytes, at most %d), the bot would skip it", what, fileInfo.Size(), maxSize)
+
+			continue
+		}
+
+		buf, err := os.ReadFile(file)
+
+		if err != nil {
+			c.errorf("unable to read %s, the bot would skip it: %s", what, err)
+
+			continue
+		}
+
+		var tmp map[string]interface{}
+
+		if err := hjson.Unmarshal(buf, &tmp); err != nil {
+			c.errorf("unable to parse %s, the bot would skip it: %s", what, strings.TrimSpace(err.Error()))
+
+			continue
+		}
+
+		tmpJSON, err := json.Marshal(tmp)
+
+		if err == nil {
+			err = json.Unmarshal(tmpJSON, v)
+		}
+
+		if err != nil {
+			c.errorf("unable to parse %s, the bot would skip it: %s", what, err)
+
+			continue
+		}
+
+		for _, key := range unknownKeys("", tmp, reflect.TypeOf(v)) {
+			c.warnf("unknown key %s, it is ignored", key)
+		}
+
+		return true
+	}
+
+	c.file = what
+
+	if len(files) > 1 {
+		c.errorf("no usable %s found in %s", what, strings.Join(files, ", "))
+	}
+
+	return false
+}
+
+// unknownKeys сравнивает разобранный hjson data с json-тегами типа t и возвращает ключи, которым в t ничего не
+// соответствует, вместе с путём до них. Ключи, как и в encoding/json, сравниваются без учёта регистра.
+func unknownKeys(path string, data interface{}, t reflect.Type) []string {
+	var keys []string
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() { //nolint:exhaustive
+	case reflect.Struct:
+		// Если вместо объекта что-то другое (например, строка в WhiteListJid), то ключей нет.
+		m, ok := data.(map[string]interface{})
+
+		if !ok {
+			return nil
+		}
+
+		fields := jsonFields(t)
+		names := make([]string, 0, len(m))
+
+		for name := range m {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			key := name
+
+			if path != "" {
+				key = path + "." + name
+			}
+
+			ft, ok := fields[strings.ToLower(name)]
+
+			if !ok {
+				keys = append(keys, key)
+
+				continue
+			}
+
+			keys = append(keys, unknownKeys(key, m[name], ft)...)
+		}
+
+	case reflect.Slice, reflect.Array:
+		list, ok := data.([]interface{})
+
+		if !ok {
+			return nil
+		}
+
+		for n, item := range list {
+			keys = append(keys, unknownKeys(fmt.Sprintf("%s[%d]", path, n), item, t.Elem())...)
+		}
+
+	case reflect.Map:
+		m, ok := data.(map[string]interface{})
+
+		if !ok {
+			return nil
+		}
+
+		for name, item := range m {
+			keys = append(keys, unknownKeys(path+"."+name, item, t.Elem())...)
+		}
+	}
+
+	return keys
+}
+
+// jsonFields возвращает поля структуры t по их именам в json, в нижнем регистре. Поля встроенных структур, как и в
+// encoding/json, считаются полями самой структуры.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+
+	for n := 0; n < t.NumField(); n++ {
+		f := t.Field(n)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+
+		if name == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+
+		if name == "" && f.Anonymous && f.Type.Kind() == reflect.Struct {
+			for k, v := range jsonFields(f.Type) {
+				fields[k] = v
+			}
+
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		fields[strings.ToLower(name)] = f.Type
+	}
+
+	return fields
+}
+
+// matchesEverything сообщает, совпадает ли регулярка с чем угодно: с пустой строкой или со всеми пробными строками.
+func matchesEverything(re *regexp.Regexp) bool {
+	if re.MatchString("") {
+		return true
+	}
+
+	for _, probe := range broadProbes {
+		if !re.MatchString(probe) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkConfig проверяет конфиг: всё то, что проверяет бот при чтении конфига, плюс то, что бот молча заменяет
+// значениями по-умолчанию.
+func (c *checker) checkConfig(cfg *MyConfig, exeDir string) {
+	if cfg.Jabber.Server == "" {
+		c.warnf("jabber server is not defined, localhost is used")
+	}
+
+	if len(cfg.Jabber.BotMasters) == 0 {
+		c.warnf("no bot_masters defined, the bot will be its own master")
+	}
+
+	seen := make(map[string]int)
+
+	for n, channel := range cfg.Jabber.Channels {
+		if first, ok := seen[strings.ToLower(channel.Name)]; ok && channel.Name != "" {
+			c.warnf("channel %s is defined twice, in channels[%d] and channels[%d]", channel.Name, first, n)
+		} else {
+			seen[strings.ToLower(channel.Name)] = n
+		}
+
+		if !validMode(channel.Mode) {
+			c.warnf("unknown mode %s for channel %s, %s is used", channel.Mode, channel.Name, ModeEnforce)
+		}
+
+		if !checkAction(channel.Bayes.DefaultAction, "", "log", "devoice", "kick", "ban") {
+			c.warnf("unknown bayes default_action %s for channel %s, log is used", channel.Bayes.DefaultAction, channel.Name)
+		}
+
+		if !checkAction(channel.AllCaps.DefaultAction, "", "log", "devoice", "kick", "ban") {
+			c.warnf("unknown all_caps default_action %s for channel %s, log is used", channel.AllCaps.DefaultAction, channel.Name)
+		}
+
+		if !checkAction(channel.Corrections.DefaultAction, "", "log", "devoice", "kick", "ban") {
+			c.warnf(
+				"unknown corrections default_action %s for channel %s, log is used",
+				channel.Corrections.DefaultAction,
+				channel.Name,
+			)
+		}
+
+		if channel.Retract.OnBan < 0 {
+			c.warnf("negative retract on_ban %d for channel %s, 0 is used", channel.Retract.OnBan, channel.Name)
+		}
+
+		for i, oc := range channel.OutdatedClients {
+			if !checkAction(oc.Action, "", "log", "devoice", "kick", "ban") {
+				c.warnf("unknown action %s in outdated_clients[%d] of channel %s, log is used", oc.Action, i, channel.Name)
+			}
+		}
+
+		for i, policy := range []string{
+			channel.VersionQuery.NoAnswer,
+			channel.VersionQuery.Error,
+			channel.VersionQuery.EmptyName,
+		} {
+			if !checkAction(policy, "", "ignore", "log", "devoice", "kick", "ban") {
+				what := []string{"no_answer", "error", "empty_name"}[i]
+
+				c.warnf("unknown version_query %s policy %s for channel %s, log is used", what, policy, channel.Name)
+			}
+		}
+
+		for i, moderator := range channel.Moderators {
+			if !strings.Contains(moderator, "@") || strings.Contains(moderator, "/") {
+				c.warnf("moderators[%d] %s of channel %s is not a bare jid and will never match", i, moderator, channel.Name)
+			}
+		}
+	}
+
+	// Остальное проверяет сам бот. Ошибка там одна, первая, но и бот дальше первой не продвинется.
+	if err := prepareConfig(cfg, exeDir); err != nil {
+		c.errorf("%s", err)
+	}
+}
+
+// checkAction сообщает, есть ли action среди allowed.
+func checkAction(action string, allowed ...string) bool {
+	for _, a := range allowed {
+		if action == a {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkRoom предупреждает, если комнаты room нет в конфиге, - скорее всего, это опечатка.
+func (c *checker) checkRoom(where, room string, configOK bool, cfg *MyConfig) {
+	if room == "" || !configOK {
+		return
+	}
+
+	for _, channel := range cfg.Jabber.Channels {
+		if strings.EqualFold(channel.Name, room) {
+			return
+		}
+	}
+
+	c.warnf("%s: room %s is not in config", where, room)
+}
+
+// checkWhitelist проверяет белый список: шаблоны jid-ов, их сроки действия, повторы и слишком широкие шаблоны.
+func (c *checker) checkWhitelist(wl *MyWhiteList, configOK bool, cfg *MyConfig) {
+	seen := make(map[string]string)
+
+	for n, wEntry := range wl.Whitelist {
+		where := fmt.Sprintf("whitelist[%d]", n)
+
+		c.checkRoom(where, wEntry.RoomName, configOK, cfg)
+
+		for i, w := range wEntry.Jid {
+			at := fmt.Sprintf("%s.jid[%d]", where, i)
+			pattern, err := CompileJidPattern(w.Jid, w.Expires)
+
+			if err != nil {
+				c.errorf("%s: %s", at, err)
+
+				continue
+			}
+
+			if pattern.Expired() {
+				c.warnf("%s: %s is expired", at, pattern)
+			}
+
+			key := strings.ToLower(wEntry.RoomName + "\x00" + strings.TrimSpace(w.Jid))
+
+			if first, ok := seen[key]; ok {
+				c.warnf("%s: duplicate of %s: %s", at, first, w.Jid)
+			} else {
+				seen[key] = at
+			}
+
+			switch {
+			case pattern.re != nil && matchesEverything(pattern.re):
+				c.warnf("%s: %s matches every jid", at, w.Jid)
+			case pattern.domain != "" && !strings.Contains(pattern.domain, "."):
+				c.warnf("%s: %s covers the whole top-level domain", at, w.Jid)
+			}
+		}
+	}
+}
+
+// checkBlacklist проверяет чёрный список: регулярки, выражения и правила для клиентского ПО, повторы и правила,
+// которые перекрыты такими же глобальными, слишком широкие правила и правила, под которые попадает сам бот или его
+// мастера, а также остальные поля записей.
+func (c *checker) checkBlacklist(bl *MyBlackList, configOK bool, cfg *MyConfig) { //nolint:gocognit,cyclop
+	var (
+		seen   = make(map[string]string)
+		global = make(map[string]string)
+	)
+
+	// Глобальное правило действует во всех комнатах, так что такое же правило комнаты ничего не добавляет, где бы в
+	// списке оно ни стояло.
+	for n, bEntry := range bl.Blacklist {
+		if bEntry.RoomName != "" {
+			continue
+		}
+
+		for _, kind := range []string{"jid", "nick", "phrase"} {
+			for i, pattern := range bEntry.rulePatterns(kind) {
+				if _, ok := global[kind+"\x00"+pattern]; !ok {
+					global[kind+"\x00"+pattern] = fmt.Sprintf("blacklist[%d].%s_re[%d]", n, kind, i)
+				}
+			}
+		}
+	}
+
+	for n, bEntry := range bl.Blacklist {
+		where := fmt.Sprintf("blacklist[%d]", n)
+
+		c.checkRoom(where, bEntry.RoomName, configOK, cfg)
+
+		if len(bEntry.JidRe)+len(bEntry.NickRe)+len(bEntry.PhraseRe)+len(bEntry.UserAgent)+len(bEntry.Expr) == 0 {
+			c.warnf("%s: entry has no rules", where)
+		}
+
+		for _, kind := range []string{"jid", "nick", "phrase"} {
+			for i, pattern := range bEntry.rulePatterns(kind) {
+				at := fmt.Sprintf("%s.%s_re[%d]", where, kind, i)
+
+				if pattern == "" {
+					c.warnf("%s: empty pattern is ignored", at)
+
+					continue
+				}
+
+				re, err := regexp.Compile(pattern)
+
+				if err != nil {
+					c.errorf("%s: incorrect regexp %s: %s", at, pattern, err)
+
+					continue
+				}
+
+				key := strings.ToLower(bEntry.RoomName) + "\x00" + kind + "\x00" + pattern
+
+				first, dup := seen[key]
+
+				if !dup {
+					seen[key] = at
+				}
+
+				switch {
+				case dup:
+					c.warnf("%s: duplicate of %s: %s", at, first, pattern)
+				case bEntry.RoomName != "" && global[kind+"\x00"+pattern] != "":
+					c.warnf("%s: shadowed by the same global rule %s: %s", at, global[kind+"\x00"+pattern], pattern)
+				}
+
+				if matchesEverything(re) {
+					c.warnf("%s: %s matches everything", at, pattern)
+				}
+
+				if configOK {
+					c.checkBotMatch(at, kind, re, bEntry.RoomName, cfg)
+				}
+			}
+		}
+
+		for i, ua := range bEntry.UserAgent {
+			if _, err := CompileUserAgent(ua); err != nil {
+				c.errorf("%s.user_agent[%d]: %s", where, i, err)
+			}
+		}
+
+		for i, source := range bEntry.Expr {
+			if _, err := CompileExpr(source); err != nil {
+				c.errorf("%s.expr[%d]: %s: %s", where, i, source, err)
+			}
+		}
+
+		c.checkBlacklistEntry(where, bEntry)
+	}
+}
+
+// checkBotMatch проверяет, не попадает ли под правило сам бот или кто-то из его мастеров.
+func (c *checker) checkBotMatch(at, kind string, re *regexp.Regexp, room string, cfg *MyConfig) {
+	switch kind {
+	case "jid":
+		bot := cfg.Jabber.User
+
+		if re.MatchString(bot) || re.MatchString(bot+"/"+cfg.Jabber.Resource) {
+			c.errorf("%s: %s matches the bot's own jid %s", at, re, bot)
+		}
+
+		for _, master := range cfg.Jabber.BotMasters {
+			if re.MatchString(master) {
+				c.errorf("%s: %s matches bot master %s", at, re, master)
+			}
+		}
+
+	case "nick":
+		for _, channel := range cfg.Jabber.Channels {
+			if room != "" && !strings.EqualFold(room, channel.Name) {
+				continue
+			}
+
+			if re.MatchString(channel.Nick) {
+				c.errorf("%s: %s matches the bot's own nick %s in %s", at, re, channel.Nick, channel.Name)
+			}
+		}
+	}
+}
+
+// checkBlacklistEntry проверяет остальные поля записи чёрного списка: действие, срок, режим, причину и срок действия.
+func (c *checker) checkBlacklistEntry(where string, bEntry BlackListEntry) {
+	switch bEntry.Action {
+	case "", "log", "warn", "devoice", "kick", "ban":
+	case "tempban":
+		if _, err := ParseDuration(bEntry.Duration); err != nil {
+			c.errorf("%s: incorrect tempban duration %q, ban is used instead: %s", where, bEntry.Duration, err)
+		}
+	default:
+		c.errorf("%s: unknown action %s, ban is used instead", where, bEntry.Action)
+	}
+
+	if bEntry.Duration != "" && bEntry.Action != "tempban" {
+		c.warnf("%s: duration is set, but action is not tempban", where)
+	}
+
+	if !validMode(bEntry.Mode) {
+		c.warnf("%s: unknown mode %s, room mode is used", where, bEntry.Mode)
+	}
+
+	if _, err := CompileReasonTemplate(where+" reason", bEntry.Reason); err != nil {
+		c.errorf("%s: %s", where, err)
+	}
+
+	if bEntry.Expires != "" {
+		expires, err := parseExpires(bEntry.Expires)
+
+		switch {
+		case err != nil:
+			c.errorf("%s: incorrect expires: %s", where, err)
+		case time.Now().After(expires):
+			c.warnf("%s: entry expired at %s", where, expires.Format(time.RFC3339))
+		}
+	}
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
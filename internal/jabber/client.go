@@ -0,0 +1,40 @@
+package jabber
+
+import (
+	"time"
+
+	"github.com/eleksir/go-xmpp"
+)
+
+// XMPPClient - то, что бот использует от xmpp-клиента. Настоящий клиент - *xmpp.Client, а для прогона записанного
+// трафика без сервера есть FakeClient.
+type XMPPClient interface {
+	JID() string
+	Recv() (interface{}, error)
+	Close() error
+
+	Send(chat xmpp.Chat) (int, error)
+	SendPresence(presence xmpp.Presence) (int, error)
+	SendKeepAlive() (int, error)
+	JoinMUCNoHistory(jid, nick string) (int, error)
+	JoinMUC(jid, nick string, historyType, history int, historyDate *time.Time) (int, error)
+
+	DiscoverInfo(from, to string) (string, error)
+	RawInformation(from, to, id, iqType, body string) (string, error)
+	RawInformationQuery(from, to, id, iqType, requestNamespace, body string) (string, error)
+
+	PingC2S(jid, server string) error
+	PingS2S(fromServer, toServer string) error
+	PingResponse(v xmpp.IQ) (string, error)
+
+	IqVersionResponse(v xmpp.IQ, name, version, os string) (string, error)
+	JabberIqLastResponse(v xmpp.IQ, lastActivity int64) (string, error)
+	UrnXMPPTimeResponse(v xmpp.IQ, timezoneOffset string) (string, error)
+	ErrorNotImplemented(v xmpp.IQ, xmlns, feature string) (string, error)
+	ErrorServiceUnavailable(v xmpp.IQ, queryXmlns, node string) (string, error)
+}
+
+// Настоящий клиент должен подходить под интерфейс.
+var _ XMPPClient = (*xmpp.Client)(nil)
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
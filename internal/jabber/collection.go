@@ -37,6 +37,18 @@ func (collection *Collection) Get(key interface{}) (interface{}, bool) {
 	return item.data, true
 }
 
+// GetAndDelete достаёт данные по заданному ключу и удаляет их из коллекции. Из нескольких одновременных вызовов данные
+// получит только один.
+func (collection *Collection) GetAndDelete(key interface{}) (interface{}, bool) {
+	obj, exists := collection.items.LoadAndDelete(key)
+
+	if !exists {
+		return nil, false
+	}
+
+	return obj.(item).data, true
+}
+
 // Set сохраняет данные с заданным ключом в коллекцию.
 func (collection *Collection) Set(key interface{}, value interface{}) {
 	collection.items.Store(key, item{
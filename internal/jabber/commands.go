@@ -3,248 +3,566 @@ package jabber
 import (
 	"fmt"
 	"slices"
+	"sort"
+	"strconv"
 	"strings"
 
-	"github.com/davecgh/go-spew/spew"
 	"github.com/eleksir/go-xmpp"
 	log "github.com/sirupsen/logrus"
 )
 
-// Cmd парсит команды из чятика.
+// CmdPlace - откуда пришла команда. Используется и как набор флагов: в каких местах команду можно вызывать.
+type CmdPlace int
+
+const (
+	// CmdInRoom - в самой комнате.
+	CmdInRoom CmdPlace = 1 << iota
+
+	// CmdInRoomPM - в привате комнаты, от участника по его нику.
+	CmdInRoomPM
+
+	// CmdInDirect - напрямую, через ростер, от real jid-а.
+	CmdInDirect
+
+	// CmdAnywhere - откуда угодно.
+	CmdAnywhere = CmdInRoom | CmdInRoomPM | CmdInDirect
+
+	// CmdInPrivate - в привате, комнаты или напрямую.
+	CmdInPrivate = CmdInRoomPM | CmdInDirect
+)
+
+// CmdPermission - кому можно вызывать команду. Уровни упорядочены: у каждого следующего прав больше.
+type CmdPermission int
+
+const (
+	// PermAnyone - кому угодно.
+	PermAnyone CmdPermission = iota
+
+	// PermRoomAdmin - bot_masters, а также владельцам, администраторам и модераторам из конфига комнаты, но только для
+	// своей комнаты. Какой комнаты касается вызов, команда проверяет сама через CmdRoomPermitted.
+	PermRoomAdmin
+
+	// PermMaster - только bot_masters.
+	PermMaster
+)
+
+// deniedAnswer - что бот отвечает тем, кому команда не положена.
+const deniedAnswer = "Ничем помочь не могу. Луна не светит на тебя."
+
+// Command описывает команду бота: как её зовут, сколько у неё аргументов, кому и откуда её можно вызывать и что она
+// делает.
+type Command struct {
+	// Name - имя команды без префикса csign, Aliases - другие имена, например, русские.
+	Name    string
+	Aliases []string
+
+	// Usage - аргументы для справки, например, "top [N] | stale [days]".
+	Usage string
+
+	// Help - что делает команда, одной строкой.
+	Help string
+
+	// MinArgs и MaxArgs ограничивают число аргументов, MaxArgs < 0 - без ограничения.
+	MinArgs int
+	MaxArgs int
+
+	// Permission - кому можно, Places - откуда можно.
+	Permission CmdPermission
+	Places     CmdPlace
+
+	// Private - отвечать в приват, даже если команду дали в комнате: например, если ответ длинный.
+	Private bool
+
+	// Run выполняет команду и возвращает ответ. Пустой ответ не отправляется.
+	Run func(j *Jabber, r *CmdRequest) string
+}
+
+// CmdRequest - разобранный вызов команды.
+type CmdRequest struct {
+	// Msg - сообщение, в котором пришла команда.
+	Msg xmpp.Chat
+
+	// Command - вызванная команда, Name - имя, под которым её вызвали.
+	Command *Command
+	Name    string
+
+	// Args - аргументы, разделённые пробелами (аргумент с пробелами, например, ник, можно взять в двойные кавычки),
+	// Text - всё, что после имени команды, как есть.
+	Args []string
+	Text string
+
+	// Place - откуда пришла команда, Room - комната, если команда пришла из комнаты или из её привата.
+	Place CmdPlace
+	Room  string
+
+	// JID - bare real jid того, кто дал команду, если он известен.
+	JID string
+}
+
+// Usage возвращает подсказку по аргументам команды.
+func (r *CmdRequest) Usage(csign string) string {
+	return fmt.Sprintf("Usage: %s%s %s", csign, r.Name, r.Command.Usage)
+}
+
+// CommandRegistry - реестр команд бота, по имени и псевдонимам.
+type CommandRegistry struct {
+	list   []*Command
+	byName map[string]*Command
+}
+
+// NewCommandRegistry создаёт реестр со всеми командами бота.
+func NewCommandRegistry() *CommandRegistry {
+	r := &CommandRegistry{byName: make(map[string]*Command)} //nolint:exhaustruct
+
+	r.Register(&Command{ //nolint:exhaustruct
+		Name:    "help",
+		Aliases: []string{"помощь"},
+		Help:    "this commands list",
+		Places:  CmdAnywhere,
+		Run:     (*Jabber).cmdHelp,
+	})
+
+	r.Register(&Command{ //nolint:exhaustruct
+		Name:       "rehash",
+		Aliases:    []string{"перечитать"},
+		Help:       "reload white and black lists",
+		Permission: PermMaster,
+		Places:     CmdAnywhere,
+		Run:        (*Jabber).cmdRehash,
+	})
+
+	r.Register(&Command{ //nolint:exhaustruct
+		Name:       "rules",
+		Aliases:    []string{"правила"},
+		Usage:      "top [N] | stale [days]",
+		Help:       "N most matching blacklist rules or rules that did not match for days",
+		MinArgs:    1,
+		MaxArgs:    2,
+		Permission: PermMaster,
+		Places:     CmdAnywhere,
+		Private:    true,
+		Run:        (*Jabber).cmdRules,
+	})
+
+	r.Register(&Command{ //nolint:exhaustruct
+		Name:       "mode",
+		Aliases:    []string{"режим"},
+		Usage:      "[room|rule shadow|enforce|default]",
+		Help:       "show or switch modes",
+		MaxArgs:    2,
+		Permission: PermMaster,
+		Places:     CmdAnywhere,
+		Private:    true,
+		Run:        (*Jabber).cmdMode,
+	})
+
+	r.Register(&Command{ //nolint:exhaustruct
+		Name:       "test",
+		Aliases:    []string{"тест"},
+		Usage:      "text | nick <nick> | jid <jid>",
+		Help:       "which blacklist rules match",
+		MinArgs:    1,
+		MaxArgs:    -1,
+		Permission: PermMaster,
+		Places:     CmdInPrivate,
+		Run:        (*Jabber).cmdTest,
+	})
+
+	r.Register(&Command{ //nolint:exhaustruct
+		Name:    "version",
+		Aliases: []string{"ver", "версия"},
+		Help:    "prints version of software",
+		Places:  CmdAnywhere,
+		Run:     (*Jabber).cmdVersion,
+	})
+
+	r.Register(&Command{ //nolint:exhaustruct
+		Name:       "status",
+		Aliases:    []string{"статус"},
+		Help:       "uptime, connection, rooms, actions and lists",
+		Permission: PermMaster,
+		Places:     CmdAnywhere,
+		Private:    true,
+		Run:        (*Jabber).cmdStatus,
+	})
+
+	registerModerationCommands(r)
+	registerListCommands(r)
+	registerRoomCommands(r)
+	registerWhoisCommand(r)
+
+	return r
+}
+
+// Register добавляет команду в реестр. Имена сравниваются без учёта регистра.
+func (r *CommandRegistry) Register(cmd *Command) {
+	r.list = append(r.list, cmd)
+
+	for _, name := range append([]string{cmd.Name}, cmd.Aliases...) {
+		r.byName[strings.ToLower(name)] = cmd
+	}
+}
+
+// Lookup ищет команду по имени или псевдониму.
+func (r *CommandRegistry) Lookup(name string) *Command {
+	return r.byName[strings.ToLower(name)]
+}
+
+// Commands возвращает все команды, отсортированные по имени.
+func (r *CommandRegistry) Commands() []*Command {
+	list := slices.Clone(r.list)
+
+	sort.Slice(list, func(a, b int) bool { return list[a].Name < list[b].Name })
+
+	return list
+}
+
+// Cmd парсит команды из чятика: находит команду в реестре, проверяет, можно ли её вызывать отсюда и этому
+// собеседнику, выполняет её и отправляет ответ.
 func (j *Jabber) Cmd(v xmpp.Chat) error {
-	var err error
+	text, found := strings.CutPrefix(v.Text, j.C.CSign)
+
+	if !found {
+		return nil
+	}
+
+	name, rest, _ := strings.Cut(strings.TrimSpace(text), " ")
+	cmd := j.Commands.Lookup(name)
+
+	if cmd == nil {
+		return nil
+	}
+
+	r := j.newCmdRequest(v, cmd, name, strings.TrimSpace(rest))
+
+	if r.Place&cmd.Places == 0 {
+		log.Debugf("Command %s%s from %s is not available here, ignoring", j.C.CSign, cmd.Name, v.Remote)
+
+		return nil
+	}
+
+	if !j.CmdPermitted(cmd, r) {
+		log.Infof("Command %s%s given by unprivileged user %s(%s), ignoring", j.C.CSign, cmd.Name, r.JID, v.Remote)
+
+		return j.CmdReply(r, deniedAnswer)
+	}
+
+	if len(r.Args) < cmd.MinArgs || (cmd.MaxArgs >= 0 && len(r.Args) > cmd.MaxArgs) {
+		return j.CmdReply(r, r.Usage(j.C.CSign))
+	}
+
+	// Команды из записи трафика меняют списки, состояние и комнаты настоящего бота, так что их только упоминаем.
+	if j.Replaying {
+		j.replayNote("would run command %s by %s(%s)", v.Text, r.JID, v.Remote)
+
+		return nil
+	}
+
+	return j.CmdReply(r, cmd.Run(j, r))
+}
+
+// newCmdRequest разбирает вызов команды cmd, пришедший в сообщении v: откуда он пришёл и кто его сделал.
+func (j *Jabber) newCmdRequest(v xmpp.Chat, cmd *Command, name, rest string) *CmdRequest {
+	r := &CmdRequest{ //nolint:exhaustruct
+		Msg:     v,
+		Command: cmd,
+		Name:    name,
+		Args:    splitArgs(rest),
+		Text:    rest,
+	}
+
+	bare := strings.SplitN(v.Remote, "/", 2)[0]
 
 	switch {
-	case v.Text == fmt.Sprintf("%shelp", j.C.CSign) || v.Text == fmt.Sprintf("%sпомощь", j.C.CSign):
-		var (
-			answer         string
-			chosenOneTalks = false
-		)
+	case v.Type == "groupchat":
+		r.Place = CmdInRoom
+		r.Room = bare
+		r.JID = strings.SplitN(j.GetRealJIDfromNick(v.Remote), "/", 2)[0]
+
+	// Приват комнаты отличается от прямого сообщения только тем, что пришёл от комнаты, в которой мы есть.
+	case slices.Contains(j.RoomsConnected, bare) || j.GetRoomConfig(bare) != nil:
+		r.Place = CmdInRoomPM
+		r.Room = bare
+		r.JID = strings.SplitN(j.GetRealJIDfromNick(v.Remote), "/", 2)[0]
+
+	// Если пишут не из комнаты, а напрямую, то real jid-ом является сам собеседник.
+	default:
+		r.Place = CmdInDirect
+		r.JID = bare
+	}
 
-		realJID := j.GetRealJIDfromNick(v.Remote)
+	return r
+}
 
-		for _, master := range j.C.Jabber.BotMasters {
-			if (strings.SplitN(realJID, "/", 2))[0] == master {
-				chosenOneTalks = true
+// splitArgs разбивает аргументы команды по пробелам. То, что взято в двойные кавычки, - один аргумент.
+func splitArgs(s string) []string {
+	var (
+		args   []string
+		arg    strings.Builder
+		quoted bool
+		inArg  bool
+	)
+
+	for _, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			inArg = true
+		case (c == ' ' || c == '\t') && !quoted:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
 			}
+
+			inArg = false
+		default:
+			arg.WriteRune(c)
+			inArg = true
 		}
+	}
+
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	return args
+}
 
-		if chosenOneTalks {
-			answer = fmt.Sprintf("%sпомощь       - этот список команд\n", j.C.CSign)
-			answer += fmt.Sprintf("%shelp         - this commands list\n", j.C.CSign)
-			answer += fmt.Sprintf("%srehash       - reload white and black lists (available to bot admins only)\n", j.C.CSign)
-			answer += fmt.Sprintf("%sver|%sversion - prints version of software", j.C.CSign, j.C.CSign)
-		} else {
-			answer = "Ничем помочь не могу. Луна не светит на тебя."
+// IsMaster сообщает, является ли bare jid одним из bot_masters.
+func (j *Jabber) IsMaster(jid string) bool {
+	return jid != "" && slices.Contains(j.C.Jabber.BotMasters, jid)
+}
+
+// IsRoomAdmin сообщает, является ли jid владельцем или администратором комнаты room либо перечислен в moderators в её
+// конфиге. Affiliation берётся из сведений об участниках, так что узнать его бот может, только пока этот jid сидит в
+// комнате.
+func (j *Jabber) IsRoomAdmin(room, jid string) bool {
+	admin := false
+
+	if jid == "" || room == "" {
+		return false
+	}
+
+	if channel := j.GetRoomConfig(room); channel != nil {
+		for _, moderator := range channel.Moderators {
+			if strings.EqualFold(moderator, jid) {
+				return true
+			}
 		}
+	}
+
+	j.Occupants.Range(func(_, value interface{}) bool {
+		o := value.(*Occupant)
 
-		dest := v.Remote
+		if o.JID == jid && strings.SplitN(o.From, "/", 2)[0] == room && (o.Affiliation == "owner" || o.Affiliation == "admin") {
+			admin = true
 
-		if v.Type == "groupchat" {
-			dest = (strings.SplitN(v.Remote, "/", 2))[0]
+			return false
 		}
 
-		if _, err := j.Talk.Send(
-			xmpp.Chat{ //nolint:exhaustruct
-				Remote: dest,
-				Text:   strings.TrimSpace(answer),
-				Type:   v.Type,
-			},
-		); err != nil {
-			err = fmt.Errorf("unable to send message to %s: %w", v.Remote, err)
+		return true
+	})
+
+	return admin
+}
 
-			return err
+// CmdPermitted сообщает, можно ли автору вызова r выполнять команду cmd.
+func (j *Jabber) CmdPermitted(cmd *Command, r *CmdRequest) bool {
+	switch cmd.Permission {
+	case PermAnyone:
+		return true
+	case PermRoomAdmin:
+		return j.IsMaster(r.JID) || len(j.AdminRooms(r.JID)) > 0
+	case PermMaster:
+		return j.IsMaster(r.JID)
+	}
+
+	return false
+}
+
+// AdminRooms возвращает комнаты из конфига, в которых jid - владелец, администратор или модератор из конфига.
+func (j *Jabber) AdminRooms(jid string) []string {
+	var rooms []string
+
+	for _, channel := range j.C.Jabber.Channels {
+		if j.IsRoomAdmin(channel.Name, jid) {
+			rooms = append(rooms, channel.Name)
 		}
+	}
 
-	case v.Text == fmt.Sprintf("%srehash", j.C.CSign): //nolint:wsl
-		/* Эта команда может прилетать из приватной беседы с realjid-ом, из приватной беседы с chat-nick-ом, а также из
-		 * чятика.
-		 * Groupchat мы можем определить по v.Type (groupchat) и тогда понятно что делать.
-		 * А вот, например, приватные притязания определить несколько сложно-вато. Но можно попробовать, например,
-		 * пытаться по списку presence-ов находить персонажа и его real jid и уже из этого определять master он или нет.
-		 */
-
-		// Попробуем определить каков алгоритм наших действий, в зависимости от типа сообщения
-		switch v.Type {
-		case "groupchat":
-			// Проверим, является ли "командир" избранным или это самозванец?
-			var (
-				chosenOneTalks = false
-				listsLoaded    = true
-			)
-
-			realJID := j.GetRealJIDfromNick(v.Remote)
-
-			for _, master := range j.C.Jabber.BotMasters {
-				if (strings.SplitN(realJID, "/", 2))[0] == master {
-					chosenOneTalks = true
-				}
-			}
+	return rooms
+}
 
-			if !chosenOneTalks {
-				log.Infof(
-					"Command %srehash given by non-bot_master user %s(%s), ignoring",
-					j.C.CSign,
-					realJID,
-					v.Remote,
-				)
+// CmdRoomPermitted сообщает, можно ли автору вызова r выполнять команду над комнатой room. Пустая room означает
+// глобальную операцию, она доступна только bot_masters.
+func (j *Jabber) CmdRoomPermitted(r *CmdRequest, room string) bool {
+	if j.IsMaster(r.JID) {
+		return true
+	}
 
-				var msg xmpp.Chat
-				msg.Remote = v.Remote
-				msg.Type = v.Type
-				msg.Text = "Ничем помочь не могу. Луна не светит на тебя."
+	if room == "" || !j.IsRoomAdmin(room, r.JID) {
+		log.Infof(
+			"Command %s%s given by %s(%s) for %s they do not administer, ignoring",
+			j.C.CSign, r.Name, r.JID, r.Msg.Remote, roomTitle(room),
+		)
 
-				_, err := j.Talk.Send(msg)
+		return false
+	}
 
-				return err
-			}
+	return true
+}
 
-			if err := j.ReadWhitelist(); err != nil {
-				listsLoaded = false
+// CmdReply отправляет ответ на команду туда, откуда она пришла: в комнату или в приват. Если команда отвечает
+// приватно, то ответ на команду из комнаты уходит в приват комнаты.
+func (j *Jabber) CmdReply(r *CmdRequest, answer string) error {
+	answer = strings.TrimSpace(answer)
 
-				var msg xmpp.Chat
-				msg.Remote = v.Remote
-				msg.Type = "chat" // private message
-				msg.Text = fmt.Sprint(err)
+	if answer == "" {
+		return nil
+	}
 
-				if _, err := j.Talk.Send(msg); err != nil {
-					return err
-				}
-			}
+	msg := xmpp.Chat{Remote: r.Msg.Remote, Type: "chat", Text: answer} //nolint:exhaustruct
 
-			if err := j.ReadBlacklist(); err != nil {
-				listsLoaded = false
+	if r.Place == CmdInRoom && !r.Command.Private {
+		msg.Remote = r.Room
+		msg.Type = "groupchat"
+	}
 
-				var msg xmpp.Chat
-				msg.Remote = v.Remote
-				msg.Type = "chat" // private message
-				msg.Text = fmt.Sprint(err)
+	if _, err := j.Talk.Send(msg); err != nil {
+		return fmt.Errorf("unable to send message to %s: %w", msg.Remote, err)
+	}
 
-				if _, err := j.Talk.Send(msg); err != nil {
-					return err
-				}
-			}
+	return nil
+}
 
-			if listsLoaded {
-				room := (strings.SplitN(v.Remote, "/", 2))[0]
+// cmdHelp перечисляет команды, которые автор вызова может выполнить оттуда, откуда спрашивает.
+func (j *Jabber) cmdHelp(r *CmdRequest) string {
+	var lines []string
 
-				var msg xmpp.Chat
-				msg.Remote = room
-				msg.Type = v.Type
-				msg.Text = "Сделано"
+	for _, cmd := range j.Commands.Commands() {
+		if r.Place&cmd.Places == 0 || !j.CmdPermitted(cmd, r) {
+			continue
+		}
 
-				if _, err := j.Talk.Send(msg); err != nil {
-					return err
-				}
-			}
-		case "chat":
-			room := (strings.SplitN(v.Remote, "/", 2))[0]
-
-			// Реагировать на приватную команду "из комнаты", только если бот в комнате
-			if slices.Contains(j.RoomsConnected, room) {
-				var (
-					chosenOneTalks = false
-					listsLoaded    = true
-				)
-
-				// Реагировать на rehash только если собеседник является bot master-ом
-				realJID := j.GetRealJIDfromNick(v.Remote)
-
-				for _, master := range j.C.Jabber.BotMasters {
-					if (strings.SplitN(realJID, "/", 2))[0] == master {
-						chosenOneTalks = true
-					}
-				}
-
-				if !chosenOneTalks {
-					log.Infof(
-						"Command %srehash given by non-bot_master user %s(%s), ignoring",
-						j.C.CSign,
-						realJID,
-						v.Remote,
-					)
-
-					var msg xmpp.Chat
-					msg.Remote = v.Remote
-					msg.Type = v.Type
-					msg.Text = "Ничем помочь не могу. Луна не светит на тебя."
-
-					_, err := j.Talk.Send(msg)
-
-					return err
-				}
-
-				if err := j.ReadWhitelist(); err != nil {
-					listsLoaded = false
-
-					var msg xmpp.Chat
-					msg.Remote = v.Remote
-					msg.Type = v.Type
-					msg.Text = fmt.Sprint(err)
-
-					if _, err := j.Talk.Send(msg); err != nil {
-						return err
-					}
-				}
-
-				if err := j.ReadBlacklist(); err != nil {
-					listsLoaded = false
-
-					var msg xmpp.Chat
-					msg.Remote = v.Remote
-					msg.Type = v.Type
-					msg.Text = fmt.Sprint(err)
-
-					if _, err := j.Talk.Send(msg); err != nil {
-						return err
-					}
-				}
-
-				if listsLoaded {
-					var msg xmpp.Chat
-					msg.Remote = v.Remote
-					msg.Type = v.Type
-					msg.Text = "Сделано"
-
-					if _, err := j.Talk.Send(msg); err != nil {
-						return err
-					}
-				}
-			}
+		names := j.C.CSign + strings.Join(append([]string{cmd.Name}, cmd.Aliases...), "|"+j.C.CSign)
 
-		default:
-			log.Infof("Rehash command from outer space: %s", spew.Sdump(v))
+		if cmd.Usage != "" {
+			names += " " + cmd.Usage
 		}
 
-		return err
-	case v.Text == fmt.Sprintf("%sver", j.C.CSign) || v.Text == fmt.Sprintf("%sversion", j.C.CSign):
-		var (
-			answer = fmt.Sprintf("Version %s", j.C.Version)
-		)
+		lines = append(lines, fmt.Sprintf("%s - %s", names, cmd.Help))
+	}
 
-		dest := v.Remote
+	return strings.Join(lines, "\n")
+}
 
-		if v.Type == "groupchat" {
-			dest = (strings.SplitN(v.Remote, "/", 2))[0]
-		}
+// cmdRehash перечитывает белый и чёрный списки.
+func (j *Jabber) cmdRehash(r *CmdRequest) string {
+	var problems []string
 
-		if _, err := j.Talk.Send(
-			xmpp.Chat{ //nolint:exhaustruct
-				Remote: dest,
-				Text:   strings.TrimSpace(answer),
-				Type:   v.Type,
-			},
-		); err != nil {
-			err = fmt.Errorf("unable to send message to %s: %w", v.Remote, err)
+	if err := j.ReadWhitelist(); err != nil {
+		problems = append(problems, fmt.Sprint(err))
+	}
 
-			return err
+	if err := j.ReadBlacklist(); err != nil {
+		problems = append(problems, fmt.Sprint(err))
+	}
+
+	if len(problems) > 0 {
+		return strings.Join(problems, "\n")
+	}
+
+	log.Infof("White and black lists reloaded by %s(%s)", r.JID, r.Msg.Remote)
+
+	return "Сделано"
+}
+
+// cmdRules показывает самые частые правила или правила, которые давно не срабатывали.
+func (j *Jabber) cmdRules(r *CmdRequest) string {
+	if r.Args[0] != "top" && r.Args[0] != "stale" {
+		return r.Usage(j.C.CSign)
+	}
+
+	// По-умолчанию 10 самых частых правил и правила, не срабатывавшие 30 дней.
+	n := 10
+
+	if r.Args[0] == "stale" {
+		n = 30
+	}
+
+	if len(r.Args) == 2 {
+		var err error
+
+		n, err = strconv.Atoi(r.Args[1])
+
+		if err != nil || n <= 0 {
+			return fmt.Sprintf("Incorrect number %q", r.Args[1])
 		}
+	}
 
-	default:
-		return err
+	if r.Args[0] == "top" {
+		return j.TopRules(n)
 	}
 
-	return err
+	return j.StaleRules(n)
+}
+
+// cmdMode показывает или переключает режимы комнат и правил.
+func (j *Jabber) cmdMode(r *CmdRequest) string {
+	switch len(r.Args) {
+	case 0:
+		return j.DescribeModes()
+	case 1:
+		return r.Usage(j.C.CSign)
+	}
+
+	mode := r.Args[1]
+
+	// default возвращает режим из конфига или чёрного списка.
+	if mode == "default" {
+		mode = ""
+	}
+
+	if err := j.SetMode(r.Args[0], mode); err != nil {
+		return fmt.Sprint(err)
+	}
+
+	log.Infof("Mode of %s switched to %s by %s(%s)", r.Args[0], r.Args[1], r.JID, r.Msg.Remote)
+
+	return "Сделано"
+}
+
+// cmdTest показывает, какие правила чёрного списка сработали бы на фразу, ник или jid. Из привата комнаты проверяются
+// правила этой комнаты, иначе - правила всех комнат.
+func (j *Jabber) cmdTest(r *CmdRequest) string {
+	var (
+		kind  = "phrase"
+		value = r.Text
+		room  string
+	)
+
+	if channel := j.GetRoomConfig(r.Room); channel != nil {
+		room = channel.Name
+	}
+
+	for _, k := range []string{"nick", "jid"} {
+		if rest, found := strings.CutPrefix(value, k+" "); found {
+			kind = k
+			value = strings.TrimSpace(rest)
+		}
+	}
+
+	return j.TestRules(room, kind, value)
+}
+
+// cmdVersion сообщает версию бота.
+func (j *Jabber) cmdVersion(_ *CmdRequest) string {
+	return fmt.Sprintf("Version %s", j.C.Version)
+}
+
+// cmdStatus сообщает, как у бота дела.
+func (j *Jabber) cmdStatus(_ *CmdRequest) string {
+	return j.Status()
 }
 
 /* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,191 @@
+package jabber
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/eleksir/go-xmpp"
+	log "github.com/sirupsen/logrus"
+)
+
+// nsCorrection - пространство имён исправлений сообщений, xep-0308.
+const nsCorrection = "urn:xmpp:message-correct:0"
+
+// MessageChain - последнее сообщение участника и цепочка его исправлений. Исправить по xep-0308 можно только
+// последнее сообщение, поэтому одной цепочки на участника достаточно.
+type MessageChain struct {
+	// IDs - id исходного сообщения и исправлений, на которые может ссылаться следующее исправление.
+	IDs []string
+
+	// Original - исходный текст, Corrections - тексты исправлений по порядку.
+	Original    string
+	Corrections []string
+
+	// Time - когда пришло исходное сообщение.
+	Time time.Time
+
+	// StanzaID - stanza-id исходного сообщения, который проставила комната. Удалять исправленное сообщение надо по
+	// нему, клиенты удалят и все исправления.
+	StanzaID string
+}
+
+// messageElemAttr возвращает атрибут attr первого вложенного в сообщение элемента local из пространства имён space.
+func messageElemAttr(v xmpp.Chat, space, local, attr string) string {
+	for _, e := range v.OtherElem {
+		if e.XMLName.Local != local || e.XMLName.Space != space {
+			continue
+		}
+
+		for _, a := range e.Attr {
+			if a.Name.Local == attr {
+				return a.Value
+			}
+		}
+
+		return ""
+	}
+
+	return ""
+}
+
+// correctionOf возвращает id сообщения, которое исправляет v, или пустую строку, если v - не исправление.
+func correctionOf(v xmpp.Chat) string {
+	return messageElemAttr(v, nsCorrection, "replace", "id")
+}
+
+// originID возвращает id сообщения, который проставил клиент отправителя (xep-0359). go-xmpp не отдаёт атрибут id
+// самого сообщения, а клиенты, которые умеют исправления, проставляют origin-id с тем же значением.
+func originID(v xmpp.Chat) string {
+	return messageElemAttr(v, nsStanzaID, "origin-id", "id")
+}
+
+// RememberMessage запоминает сообщение участника как последнее: следующее исправление будет относиться к нему.
+// stanzaID - stanza-id сообщения, который проставила комната.
+func (j *Jabber) RememberMessage(v xmpp.Chat, stanzaID string) {
+	var ids []string
+
+	if id := originID(v); id != "" {
+		ids = []string{id}
+	}
+
+	j.UpdateOccupant(v.Remote, func(o *Occupant) {
+		o.LastMessage = MessageChain{IDs: ids, Original: v.Text, Time: time.Now(), StanzaID: stanzaID} //nolint:exhaustruct
+	})
+}
+
+// BunyCorrection обрабатывает исправление сообщения: дописывает его в цепочку исправлений участника, прогоняет
+// исправленный текст через все проверки сообщений и проверяет, не слишком ли часто участник исправляет сообщения.
+// replaced - id исправляемого сообщения, stanzaID - stanza-id самого исправления.
+func (j *Jabber) BunyCorrection(v xmpp.Chat, replaced, stanzaID string) error {
+	var (
+		room    = strings.SplitN(v.Remote, "/", 2)[0]
+		channel = j.GetRoomConfig(room)
+		now     = time.Now()
+		chain   MessageChain
+		edits   int
+	)
+
+	if channel == nil {
+		return nil
+	}
+
+	window := time.Duration(channel.Corrections.Window) * time.Second
+
+	j.UpdateOccupant(v.Remote, func(o *Occupant) {
+		if !slices.Contains(o.LastMessage.IDs, replaced) {
+			log.Infof("%s corrects message %s, which is not the last one we know, assuming it is", v.Remote, replaced)
+		}
+
+		// Слайсы копируем, чтобы не задеть копии сведений об участнике, полученные раньше.
+		chain = MessageChain{
+			IDs:         slices.Clone(o.LastMessage.IDs),
+			Original:    o.LastMessage.Original,
+			Corrections: append(slices.Clone(o.LastMessage.Corrections), v.Text),
+			Time:        o.LastMessage.Time,
+			StanzaID:    o.LastMessage.StanzaID,
+		}
+
+		if id := originID(v); id != "" {
+			chain.IDs = append(chain.IDs, id)
+		}
+
+		recent := []time.Time{now}
+
+		for _, t := range o.Edits {
+			if now.Sub(t) < window {
+				recent = append(recent, t)
+			}
+		}
+
+		o.LastMessage = chain
+		o.Edits = recent
+		edits = len(recent)
+	})
+
+	log.Infof(
+		"%s corrected message %q to %q (correction %d)",
+		v.Remote,
+		chain.Original,
+		v.Text,
+		len(chain.Corrections),
+	)
+
+	// Если исходное сообщение неизвестно, то удалять придётся хотя бы исправление.
+	if chain.StanzaID != "" {
+		stanzaID = chain.StanzaID
+	}
+
+	// Исправленный текст проверяем так же, как новое сообщение.
+	if err := j.BunyChat(v, stanzaID); err != nil {
+		return err
+	}
+
+	if edits > channel.Corrections.MaxEdits {
+		j.flagEditChurn(channel, v, edits)
+	}
+
+	return nil
+}
+
+// flagEditChurn реагирует на слишком частые исправления сообщений: добавляет участнику очки, если в комнате включён их
+// подсчёт, иначе применяет corrections.default_action.
+func (j *Jabber) flagEditChurn(channel *MyChannel, v xmpp.Chat, edits int) {
+	var (
+		realJID = j.GetRealJIDfromNick(v.Remote)
+		why     = fmt.Sprintf("%d edits in %d seconds", edits, channel.Corrections.Window)
+	)
+
+	log.Warnf("%s (%s) edits messages too often: %s", v.Remote, realJID, why)
+
+	p, found := j.GetPresence(v.Remote)
+
+	if found && j.IsProtected(p) {
+		return
+	}
+
+	if channel.Scoring.Enabled && channel.Scoring.Signals.Edits > 0 {
+		j.AddScore(channel.Name, v.Remote, realJID, channel.Scoring.Signals.Edits, why)
+
+		return
+	}
+
+	j.Sanction(
+		v.Remote,
+		ModAction{ //nolint:exhaustruct
+			JID:    realJID,
+			Action: channel.Corrections.DefaultAction,
+			Reason: j.RenderReason(
+				channel.Name,
+				nil,
+				ReasonData{Kind: "edits", Match: v.Text, Why: why, Action: channel.Corrections.DefaultAction}, //nolint:exhaustruct
+				false,
+			),
+			VType: v.Type,
+			Why:   why,
+		},
+	)
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
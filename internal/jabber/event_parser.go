@@ -17,6 +17,9 @@ import (
 
 // ParseEvent парсит ивенты, прилетающие из модуля xmpp (изменения presence, фразы участников, ошибки).
 func (j *Jabber) ParseEvent(e interface{}) { //nolint:maintidx,gocognit,gocyclo
+	j.EventMu.Lock()
+	defer j.EventMu.Unlock()
+
 	j.LastServerActivity = time.Now().Unix()
 
 	switch v := e.(type) {
@@ -25,7 +28,21 @@ func (j *Jabber) ParseEvent(e interface{}) { //nolint:maintidx,gocognit,gocyclo
 		log.Debugf("Looks like message, ChatType: %s, From: %s, Subject: %s Text: %s",
 			v.Type, v.Remote, v.Subject, v.Text)
 
-		// Топик чятика присылается в виде сообщения с subject, но без text
+		// Сообщения из архива комнаты приходят от самой комнаты, завёрнутыми в <result/>
+		if archived, err := j.CatchupArchived(v); archived {
+			if err != nil {
+				j.GTomb.Kill(err)
+			}
+
+			return
+		}
+
+		// Топик чятика присылается в виде сообщения с subject, но без text. После входа в комнату топик приходит
+		// последним, после истории.
+		if v.Type == "groupchat" && v.Subject != "" {
+			j.Catchup.EndHistory(strings.SplitN(v.Remote, "/", 2)[0])
+		}
+
 		// В то же время сообщения от людей приходят с пустым subject, но с заполненным text
 		if v.Text != "" {
 			// Чятики бывают групповые и не групповые, от этого зависит Remote, куда направлять сообщение
@@ -36,26 +53,52 @@ func (j *Jabber) ParseEvent(e interface{}) { //nolint:maintidx,gocognit,gocyclo
 				var (
 					room = strings.SplitN(v.Remote, "/", 2)[0]
 					nick = strings.SplitN(v.Remote, "/", 2)[1]
+					id   = stanzaID(v, room)
 				)
 
 				log.Debugf("Message from public chat: %s", v.Text)
 
-				if nick == j.GetBotNickFromRoomConfig(room) {
-					log.Debug("Skipping message from myself")
+				// Сообщения из истории комнаты и прочие отложенные - пропущенные, их только проверяем.
+				if j.Catchup.InHistory(room) || !v.Stamp.IsZero() {
+					if err := j.CheckMissed(v, id, ""); err != nil {
+						j.GTomb.Kill(err)
+					}
 
 					return
 				}
 
-				if err := j.Cmd(v); err != nil {
-					j.GTomb.Kill(err)
+				j.Catchup.Mark(room, id, time.Now())
+
+				if nick == j.GetBotNickFromRoomConfig(room) {
+					log.Debug("Skipping message from myself")
 
 					return
 				}
 
-				if err := j.BunyChat(v); err != nil {
-					j.GTomb.Kill(err)
+				// Последние сообщения участника удаляются, если его банят, для этого нужны их stanza-id.
+				j.TrackMessage(v.Remote, id)
 
-					return
+				// Исправление сообщения (xep-0308) проверяем, как новое сообщение, но команды в нём не выполняем.
+				if replaced := correctionOf(v); replaced != "" {
+					if err := j.BunyCorrection(v, replaced, id); err != nil {
+						j.GTomb.Kill(err)
+
+						return
+					}
+				} else {
+					j.RememberMessage(v, id)
+
+					if err := j.Cmd(v); err != nil {
+						j.GTomb.Kill(err)
+
+						return
+					}
+
+					if err := j.BunyChat(v, id); err != nil {
+						j.GTomb.Kill(err)
+
+						return
+					}
 				}
 
 				j.LastActivity = j.LastServerActivity
@@ -187,6 +230,7 @@ func (j *Jabber) ParseEvent(e interface{}) { //nolint:maintidx,gocognit,gocyclo
 					answer += "<feature var=\"http://jabber.org/protocol/caps\" />"
 					answer += "<feature var=\"http://jabber.org/protocol/disco#info\" />"
 					answer += "<feature var=\"http://jabber.org/protocol/muc\" />"
+					answer += "<feature var=\"http://jabber.org/protocol/commands\" />"
 					answer += "</query>"
 
 					if id, err := j.Talk.RawInformation(
@@ -209,8 +253,22 @@ func (j *Jabber) ParseEvent(e interface{}) { //nolint:maintidx,gocognit,gocyclo
 
 					parseError = false
 
-				// Спрашивают список команд, чтобы поуправлять этим клиентом (xep-0030)
+				// Спрашивают список ad-hoc команд, чтобы поуправлять этим клиентом (xep-0050)
 				case xmpp.XMPPNS_DISCO_ITEMS:
+					if iqStruct.Node == nsCommands {
+						log.Infof("Got IQ get disco#items request for ad-hoc commands from %s", v.From)
+
+						if err := j.AdHocItems(v); err != nil {
+							j.GTomb.Kill(err)
+
+							return
+						}
+
+						parseError = false
+
+						break
+					}
+
 					log.Infof("Got IQ get disco#items request from %s, answer service unavailable", v.From)
 
 					if _, err := j.Talk.ErrorServiceUnavailable(
@@ -351,11 +409,25 @@ func (j *Jabber) ParseEvent(e interface{}) { //nolint:maintidx,gocognit,gocyclo
 			}
 
 			switch {
+			// Подтверждение модерирующих действий (бан, кик, devoice), отправленных ActionWorker-ом
+			case j.Actions.IsInFlight(v.ID):
+				j.ActionsDone(v.ID, true)
+
+				log.Infof("Got moderation request %s successful from %s to %s", v.ID, v.From, v.To)
+
+			// Ответ на запрос к архиву комнаты
+			case j.Catchup.IsQuery(v.ID):
+				j.ArchiveQueryDone(v)
+
 			// Похоже на pong от сервера (по стандарту в ответе нету query, но go-xmpp нам подсовывает это)
 			case v.From == j.C.Jabber.Server && v.To == j.Talk.JID() && string(v.Query) == "<XMLElement></XMLElement>":
 				log.Debugf("Got S2C pong answer from %s to %s", v.From, v.To)
 				j.ServerPingTimestampRx = time.Now().Unix() //nolint:wsl
 
+				if !j.ServerPingSent.IsZero() {
+					j.ServerPingRTT = time.Since(j.ServerPingSent)
+				}
+
 			// Похоже на понг второй стадии xep-0410 MUC-Ping-а, который у нас не реализован.
 			case v.To == j.Talk.JID() && string(v.Query) == "<XMLElement></XMLElement>":
 				mucNameMatch := slices.Contains(j.RoomsConnected, v.From)
@@ -384,51 +456,17 @@ func (j *Jabber) ParseEvent(e interface{}) { //nolint:maintidx,gocognit,gocyclo
 					}
 				}
 
-			// Подтверждение бана
-			case v.To == j.Talk.JID() && v.ID == "ban1":
-				mucNickMatch := false
-
-				// Если ник, которому предназначается сообщение, совпадает с ником, из конфига бота (глобального или для
-				// комнаты), то считаем, что мы есть в этой комнате. Потому что в противном случае в roomsConnected не
-				// будет искомой комнаты и мы не сможем составить ник бота, чтобы сравнить его с тем, кому адресовано
-				// уведомление.
-				for _, room := range j.RoomsConnected {
-					mucNick := fmt.Sprintf("%s/%s", room, j.GetBotNickFromRoomConfig(room))
-
-					if v.To == mucNick {
-						mucNickMatch = true
-
-						break
-					}
-				}
-
-				// Формально, ответ должен парситься как пустой result и совпадать с типом jabberSimpleIqGetQuery
-				// Ответ приходит с 2 xmlns, похоже, он парсится неправильно в go-xmpp.
-				// TODO: после исправления go-xmpp, надо исправить это тут
-				var iqStruct SimpleIqGetQuery
-
-				if err := xml.Unmarshal(v.Query, &iqStruct); err == nil {
-					if iqStruct.Xmlns == "http://jabber.org/protocol/muc#admin" && iqStruct.Text == "" {
-						if mucNickMatch {
-							// Поскольку никакой логики у нас на этот счёт не предусмотрено, то просто пропускаем ответ
-							log.Infof("Got ban successful from %s to %s", v.From, v.To)
-						} else {
-							log.Infof("Got ban successful from %s to %s, from room we are not in", v.From, v.To)
-							log.Debug(spew.Sdump(e))
-						}
-					} else {
-						log.Infof("Got strange ban successful message from %s to %s", v.From, v.To)
-						log.Debug(spew.Sdump(e))
-					}
-				} else {
-					log.Infof("Got strange ban successful message from %s to %s", v.From, v.To)
-					log.Debug(spew.Sdump(e))
-				}
-
 			// Ответ с результатом адресован нам.
 			case v.To == j.Talk.JID():
 				var softwareVersion IqResultSoftwareVersion
 				if err := xml.Unmarshal(v.Query, &softwareVersion); err == nil {
+					// Ответ пришёл, снимаем запрос с ожидания. Пустое название клиента - тоже повод для подозрений.
+					if q, ok := j.SoftwareVersionAnswered(v.ID); ok && strings.TrimSpace(softwareVersion.Name) == "" {
+						if channel := j.GetRoomConfig(q.Room); channel != nil {
+							j.ApplyVersionPolicy(q, channel.VersionQuery.EmptyName, "answered with empty name")
+						}
+					}
+
 					if softwareVersion.Os == "" {
 						log.Infof(
 							"Recieved software version query result for %s: software=%s version=%s",
@@ -446,6 +484,10 @@ func (j *Jabber) ParseEvent(e interface{}) { //nolint:maintidx,gocognit,gocyclo
 						)
 					}
 
+					if _, known := j.GetOccupant(v.From); known {
+						j.UpdateOccupant(v.From, func(o *Occupant) { o.Client = softwareVersion })
+					}
+
 					if err = j.BunySoftwareVersion(v, softwareVersion); err != nil {
 						log.Errorf("Unable to query client software version: %s", err)
 
@@ -465,7 +507,7 @@ func (j *Jabber) ParseEvent(e interface{}) { //nolint:maintidx,gocognit,gocyclo
 				log.Debug(spew.Sdump(e))
 			}
 
-		// Этот бот не управляется со стороны сервера, поэтому все попытки порулить игнорируем
+		// Этот бот управляется только ad-hoc командами (xep-0050), остальные попытки порулить игнорируем
 		case xmpp.IQTypeSet:
 			if muc, _ := strings.CutSuffix(v.To, "/"); muc != "" {
 				if slices.Contains(j.RoomsConnected, muc) {
@@ -473,6 +515,18 @@ func (j *Jabber) ParseEvent(e interface{}) { //nolint:maintidx,gocognit,gocyclo
 				}
 			}
 
+			handled, err := j.AdHoc(v)
+
+			if err != nil {
+				j.GTomb.Kill(err)
+
+				return
+			}
+
+			if handled {
+				return
+			}
+
 			log.Info("Got an IQ request for set something. Answer not implemented")
 
 			if id, err := j.Talk.ErrorNotImplemented(
@@ -495,6 +549,32 @@ func (j *Jabber) ParseEvent(e interface{}) { //nolint:maintidx,gocognit,gocyclo
 
 		// Нам прилетело сообщение об ошибке
 		case xmpp.IQTypeError:
+			// Сервер отказался выполнять модерирующее действие, например, у бота нет прав админа в комнате.
+			if j.Actions.IsInFlight(v.ID) {
+				log.Errorf("Moderation request %s failed, got error from %s", v.ID, v.From)
+				log.Debug(spew.Sdump(e))
+
+				j.ActionsDone(v.ID, false)
+
+				return
+			}
+
+			// Комната не смогла отдать архив.
+			if j.Catchup.IsQuery(v.ID) {
+				j.ArchiveQueryDone(v)
+
+				return
+			}
+
+			// Участник ответил ошибкой на запрос версии клиента, применяем политику error комнаты.
+			if q, ok := j.SoftwareVersionAnswered(v.ID); ok {
+				if channel := j.GetRoomConfig(q.Room); channel != nil {
+					j.ApplyVersionPolicy(q, channel.VersionQuery.Error, "answered with error")
+				}
+
+				return
+			}
+
 			// Если сервер не хочет пинговаться и отвечает ошибкой на пинг, то наверно он не умеет в пинги,
 			// хотя если мы его пингуем, значит он анонсировал такой capability. Вот, засранец!
 			var (
@@ -621,19 +701,23 @@ func (j *Jabber) ParseEvent(e interface{}) { //nolint:maintidx,gocognit,gocyclo
 				return
 			}
 
-			// Это наш собственный Presence
-			if v.Show == "" && v.Status == "" {
-				if nick == j.GetBotNickFromRoomConfig(room) {
+			// Это наш собственный Presence. Presence об уходе приходит, когда бот вышел из комнаты сам.
+			if v.Show == "" && v.Status == "" && v.Type != "unavailable" {
+				if nick == j.GetBotNickFromRoomConfig(room) && !slices.Contains(j.RoomsConnected, room) {
 					j.RoomsConnected = append(j.RoomsConnected, room)
-					// На всякий случай дедуплицируем список комнат, к которым мы заджойнились.
 					sort.Strings(j.RoomsConnected)
-					slices.Compact(j.RoomsConnected)
+
+					// Бот зашёл в комнату, в том числе после реконнекта: пора снова завести таймеры возврата голоса.
+					j.RescheduleMutes(room)
 				}
 			}
 
 			switch v.Role {
 			// Участник ушёл
 			case "none":
+				// Ушедшему наказание за неответ на запрос версии уже ни к чему.
+				j.ForgetSoftwareVersion(v.From)
+
 				if presenceJSONInterface, present := j.RoomPresences.Get(room); present {
 					presenceJSONStrings := InterfaceToStringSlice(presenceJSONInterface)
 
@@ -682,16 +766,30 @@ func (j *Jabber) ParseEvent(e interface{}) { //nolint:maintidx,gocognit,gocyclo
 				j.RoomPresences.Set(room, newPresenceJSONStrings)
 			}
 
+			newcomer := false
+
+			if nick != j.GetBotNickFromRoomConfig(room) {
+				newcomer = j.TrackOccupantPresence(v)
+			}
+
 			// Проверяем, а не злодей ли зашёл? Сделать это мы можем, только если мы находимся в комнате.
 			// По правилам, мы можем что-то делать, только после того, как нам прилетит наш собственный presence, это
 			// значит, что мы вошли в комнату.
 			if slices.Contains(j.RoomsConnected, room) {
 				if v.Affiliation != "outcast" {
-					if err := j.BunyPresense(v); err != nil {
+					acted, err := j.BunyPresense(v)
+
+					if err != nil {
 						j.GTomb.Kill(err)
 
 						return
 					}
+
+					// Участники, которые были в комнате до нас, новичками не считаются. Тому, по кому уже сработало
+					// правило, очки ни к чему.
+					if newcomer && !acted && !j.IsProtected(v) {
+						j.ScoreNewcomer(v)
+					}
 				}
 			}
 		}
@@ -730,6 +828,14 @@ func (j *Jabber) ParseEvent(e interface{}) { //nolint:maintidx,gocognit,gocyclo
 			case "pubsub":
 				log.Debugf("PubSub component %s reply to disco#info, skipping", v.From)
 
+			// Ответ клиента участника комнаты, запоминаем, что этот клиент умеет.
+			case "client":
+				if _, known := j.GetOccupant(v.From); known {
+					log.Debugf("Occupant %s announced that his client supports features: %s", v.From, v.Features)
+
+					j.UpdateOccupant(v.From, func(o *Occupant) { o.Caps = v.Features })
+				}
+
 			default:
 				log.Debug("Got unknown reply to disco#info")
 				log.Debug(spew.Sdump(e))
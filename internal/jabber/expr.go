@@ -0,0 +1,647 @@
+package jabber
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Маленький язык выражений для правил чёрного списка. Выражение комбинирует несколько признаков участника, например:
+//
+//	nick =~ "^[a-z]{8}$" && client.name == "Gajim" && domain != "jabber.ru"
+//
+// Поля: jid, nick, domain, status, client.name, client.version, client.os, text - строки; caps - список строк;
+// age (сколько секунд участник в комнате) и reputation - числа.
+//
+// Операторы: ==, !=, =~, !~ (регулярка, только строковый литерал справа), <, <=, >, >= (числа, а строки сравниваются как
+// версии), in (строка в списке), contains (подстрока в строке или элемент в списке), &&, ||, ! и их словесные
+// синонимы and, or, not. Литералы: "строки" или 'строки', числа, числа с суффиксом s, m, h, d (секунды, минуты, часы,
+// сутки), true, false, списки ["a", "b"].
+//
+// Выражение разбирается и проверяется на типы один раз, при загрузке чёрного списка.
+
+// ExprEnv - значения полей, доступных выражению, для конкретного участника и события.
+type ExprEnv struct {
+	JID           string
+	Nick          string
+	Domain        string
+	Status        string
+	ClientName    string
+	ClientVersion string
+	ClientOs      string
+	Caps          []string
+	Text          string
+	Age           time.Duration
+	Reputation    int
+}
+
+// Expr скомпилированное выражение.
+type Expr struct {
+	// Source - выражение, как оно записано в чёрном списке.
+	Source string
+
+	root   exprNode
+	fields map[string]bool
+}
+
+// CompileExpr разбирает выражение и проверяет типы. Выражение должно быть логическим.
+func CompileExpr(source string) (*Expr, error) {
+	tokens, err := exprLex(source)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens: tokens, pos: 0, fields: make(map[string]bool)}
+
+	root, err := p.parseOr()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos) //nolint:goerr113
+	}
+
+	if root.typ() != exprBool {
+		return nil, fmt.Errorf("expression must be boolean, got %s", root.typ()) //nolint:goerr113
+	}
+
+	return &Expr{Source: source, root: root, fields: p.fields}, nil
+}
+
+// Uses сообщает, обращается ли выражение к полю field.
+func (e *Expr) Uses(field string) bool {
+	return e.fields[field]
+}
+
+// Eval вычисляет выражение.
+func (e *Expr) Eval(env *ExprEnv) bool {
+	return e.root.eval(env).b
+}
+
+// String возвращает выражение в том виде, как оно записано в чёрном списке, для логов.
+func (e *Expr) String() string {
+	return e.Source
+}
+
+// exprType - тип значения в выражении.
+type exprType int
+
+const (
+	exprString exprType = iota
+	exprNumber
+	exprBool
+	exprList
+)
+
+func (t exprType) String() string {
+	switch t {
+	case exprString:
+		return "string"
+	case exprNumber:
+		return "number"
+	case exprBool:
+		return "bool"
+	case exprList:
+		return "list"
+	}
+
+	return "unknown"
+}
+
+// exprValue - значение в выражении, используется поле, соответствующее типу.
+type exprValue struct {
+	s string
+	n float64
+	b bool
+	l []string
+}
+
+// exprField - поле, доступное выражению.
+type exprField struct {
+	t   exprType
+	get func(env *ExprEnv) exprValue
+}
+
+var exprFields = map[string]exprField{
+	"jid":            {exprString, func(env *ExprEnv) exprValue { return exprValue{s: env.JID} }},                 //nolint:exhaustruct
+	"nick":           {exprString, func(env *ExprEnv) exprValue { return exprValue{s: env.Nick} }},                //nolint:exhaustruct
+	"domain":         {exprString, func(env *ExprEnv) exprValue { return exprValue{s: env.Domain} }},              //nolint:exhaustruct
+	"status":         {exprString, func(env *ExprEnv) exprValue { return exprValue{s: env.Status} }},              //nolint:exhaustruct
+	"client.name":    {exprString, func(env *ExprEnv) exprValue { return exprValue{s: env.ClientName} }},          //nolint:exhaustruct
+	"client.version": {exprString, func(env *ExprEnv) exprValue { return exprValue{s: env.ClientVersion} }},       //nolint:exhaustruct
+	"client.os":      {exprString, func(env *ExprEnv) exprValue { return exprValue{s: env.ClientOs} }},            //nolint:exhaustruct
+	"text":           {exprString, func(env *ExprEnv) exprValue { return exprValue{s: env.Text} }},                //nolint:exhaustruct
+	"caps":           {exprList, func(env *ExprEnv) exprValue { return exprValue{l: env.Caps} }},                  //nolint:exhaustruct
+	"age":            {exprNumber, func(env *ExprEnv) exprValue { return exprValue{n: env.Age.Seconds()} }},       //nolint:exhaustruct
+	"reputation":     {exprNumber, func(env *ExprEnv) exprValue { return exprValue{n: float64(env.Reputation)} }}, //nolint:exhaustruct,lll
+}
+
+// exprNode - узел синтаксического дерева выражения.
+type exprNode interface {
+	typ() exprType
+	eval(env *ExprEnv) exprValue
+}
+
+type exprLiteral struct {
+	t exprType
+	v exprValue
+}
+
+func (n *exprLiteral) typ() exprType             { return n.t }
+func (n *exprLiteral) eval(_ *ExprEnv) exprValue { return n.v }
+
+type exprFieldRef struct {
+	field exprField
+}
+
+func (n *exprFieldRef) typ() exprType               { return n.field.t }
+func (n *exprFieldRef) eval(env *ExprEnv) exprValue { return n.field.get(env) }
+
+type exprNot struct {
+	x exprNode
+}
+
+func (n *exprNot) typ() exprType { return exprBool }
+
+func (n *exprNot) eval(env *ExprEnv) exprValue {
+	return exprValue{b: !n.x.eval(env).b} //nolint:exhaustruct
+}
+
+type exprLogic struct {
+	and  bool
+	l, r exprNode
+}
+
+func (n *exprLogic) typ() exprType { return exprBool }
+
+func (n *exprLogic) eval(env *ExprEnv) exprValue {
+	l := n.l.eval(env).b
+
+	// Вычисляем по короткой схеме.
+	if n.and != l {
+		return exprValue{b: l} //nolint:exhaustruct
+	}
+
+	return exprValue{b: n.r.eval(env).b} //nolint:exhaustruct
+}
+
+type exprCompare struct {
+	op   string
+	l, r exprNode
+	re   *regexp.Regexp
+}
+
+func (n *exprCompare) typ() exprType { return exprBool }
+
+func (n *exprCompare) eval(env *ExprEnv) exprValue { //nolint:cyclop
+	var (
+		l   = n.l.eval(env)
+		r   = n.r.eval(env)
+		res bool
+	)
+
+	switch n.op {
+	case "==", "!=":
+		switch n.l.typ() { //nolint:exhaustive
+		case exprString:
+			res = l.s == r.s
+		case exprNumber:
+			res = l.n == r.n
+		case exprBool:
+			res = l.b == r.b
+		}
+
+		if n.op == "!=" {
+			res = !res
+		}
+
+	case "=~":
+		res = n.re.MatchString(l.s)
+	case "!~":
+		res = !n.re.MatchString(l.s)
+
+	case "<", "<=", ">", ">=":
+		var cmp int
+
+		if n.l.typ() == exprNumber {
+			switch {
+			case l.n < r.n:
+				cmp = -1
+			case l.n > r.n:
+				cmp = 1
+			}
+		} else {
+			cmp = CompareVersions(l.s, r.s)
+		}
+
+		switch n.op {
+		case "<":
+			res = cmp < 0
+		case "<=":
+			res = cmp <= 0
+		case ">":
+			res = cmp > 0
+		case ">=":
+			res = cmp >= 0
+		}
+
+	case "in":
+		res = slices.Contains(r.l, l.s)
+
+	case "contains":
+		if n.l.typ() == exprList {
+			res = slices.Contains(l.l, r.s)
+		} else {
+			res = strings.Contains(l.s, r.s)
+		}
+	}
+
+	return exprValue{b: res} //nolint:exhaustruct
+}
+
+// Лексер.
+
+type exprTokenKind int
+
+const (
+	tokEOF exprTokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+)
+
+type exprToken struct {
+	kind exprTokenKind
+	text string
+	pos  int
+
+	// str - значение строкового литерала, num - числового.
+	str string
+	num float64
+}
+
+// exprOperators - операторы, более длинные идут раньше, чтобы "<=" не разобрался как "<" и "=".
+var exprOperators = []string{"==", "!=", "=~", "!~", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ","}
+
+func exprLex(s string) ([]exprToken, error) { //nolint:cyclop
+	var (
+		tokens []exprToken
+		runes  = []rune(s)
+	)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '"' || r == '\'':
+			start := i
+			i++
+
+			for i < len(runes) && runes[i] != r {
+				if runes[i] == '\\' {
+					i++
+				}
+
+				i++
+			}
+
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at position %d", start) //nolint:goerr113
+			}
+
+			i++
+
+			text := string(runes[start:i])
+			str := text[1 : len(text)-1]
+
+			if r == '"' {
+				var err error
+
+				if str, err = strconv.Unquote(text); err != nil {
+					return nil, fmt.Errorf("incorrect string at position %d: %w", start, err)
+				}
+			}
+
+			tokens = append(tokens, exprToken{kind: tokString, text: text, pos: start, str: str, num: 0})
+
+		case unicode.IsDigit(r):
+			start := i
+
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+
+			num, err := strconv.ParseFloat(string(runes[start:i]), 64)
+
+			if err != nil {
+				return nil, fmt.Errorf("incorrect number at position %d: %w", start, err)
+			}
+
+			// Суффиксы длительностей, всё переводится в секунды.
+			if i < len(runes) {
+				multiplier := map[rune]float64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400}[runes[i]]
+
+				if multiplier != 0 && (i+1 == len(runes) || !isExprIdentRune(runes[i+1])) {
+					num *= multiplier
+					i++
+				}
+			}
+
+			if i < len(runes) && isExprIdentRune(runes[i]) {
+				return nil, fmt.Errorf("incorrect number at position %d", start) //nolint:goerr113
+			}
+
+			tokens = append(tokens, exprToken{kind: tokNumber, text: string(runes[start:i]), pos: start, str: "", num: num})
+
+		case isExprIdentRune(r):
+			start := i
+
+			for i < len(runes) && (isExprIdentRune(runes[i]) || runes[i] == '.') {
+				i++
+			}
+
+			tokens = append(tokens, exprToken{kind: tokIdent, text: string(runes[start:i]), pos: start, str: "", num: 0})
+
+		default:
+			found := false
+
+			for _, op := range exprOperators {
+				if strings.HasPrefix(string(runes[i:]), op) {
+					tokens = append(tokens, exprToken{kind: tokOp, text: op, pos: i, str: "", num: 0})
+					i += len([]rune(op))
+					found = true
+
+					break
+				}
+			}
+
+			if !found {
+				return nil, fmt.Errorf("unexpected character %q at position %d", r, i) //nolint:goerr113
+			}
+		}
+	}
+
+	return append(tokens, exprToken{kind: tokEOF, text: "end of expression", pos: len(runes), str: "", num: 0}), nil
+}
+
+func isExprIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// Парсер, рекурсивный спуск. Приоритеты, от низшего к высшему: ||, &&, !, сравнения.
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+
+	// fields - поля, к которым обращается выражение.
+	fields map[string]bool
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	tok := p.tokens[p.pos]
+
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+
+	return tok
+}
+
+// accept съедает следующий токен, если это один из даденных операторов или ключевых слов.
+func (p *exprParser) accept(ops ...string) (string, bool) {
+	tok := p.peek()
+
+	if tok.kind != tokOp && tok.kind != tokIdent {
+		return "", false
+	}
+
+	for _, op := range ops {
+		if tok.text == op {
+			p.next()
+
+			return op, true
+		}
+	}
+
+	return "", false
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	return p.parseLogic(false, []string{"||", "or"}, p.parseAnd)
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	return p.parseLogic(true, []string{"&&", "and"}, p.parseNot)
+}
+
+func (p *exprParser) parseLogic(and bool, ops []string, operand func() (exprNode, error)) (exprNode, error) {
+	l, err := operand()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		pos := p.peek().pos
+
+		op, ok := p.accept(ops...)
+
+		if !ok {
+			return l, nil
+		}
+
+		r, err := operand()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if l.typ() != exprBool || r.typ() != exprBool {
+			return nil, fmt.Errorf( //nolint:goerr113
+				"operator %s at position %d needs boolean operands, got %s and %s", op, pos, l.typ(), r.typ(),
+			)
+		}
+
+		l = &exprLogic{and: and, l: l, r: r}
+	}
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	pos := p.peek().pos
+
+	if op, ok := p.accept("!", "not"); ok {
+		x, err := p.parseNot()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if x.typ() != exprBool {
+			return nil, fmt.Errorf("operator %s at position %d needs boolean operand, got %s", op, pos, x.typ()) //nolint:goerr113,lll
+		}
+
+		return &exprNot{x: x}, nil
+	}
+
+	return p.parseCompare()
+}
+
+func (p *exprParser) parseCompare() (exprNode, error) { //nolint:cyclop
+	l, err := p.parsePrimary()
+
+	if err != nil {
+		return nil, err
+	}
+
+	pos := p.peek().pos
+
+	op, ok := p.accept("==", "!=", "=~", "!~", "<", "<=", ">", ">=", "in", "contains")
+
+	if !ok {
+		return l, nil
+	}
+
+	r, err := p.parsePrimary()
+
+	if err != nil {
+		return nil, err
+	}
+
+	node := &exprCompare{op: op, l: l, r: r, re: nil}
+	mismatch := fmt.Errorf( //nolint:goerr113
+		"operator %s at position %d can not be applied to %s and %s", op, pos, l.typ(), r.typ(),
+	)
+
+	switch op {
+	case "==", "!=":
+		if l.typ() != r.typ() || l.typ() == exprList {
+			return nil, mismatch
+		}
+
+	case "=~", "!~":
+		lit, isLiteral := r.(*exprLiteral)
+
+		if l.typ() != exprString || !isLiteral || lit.t != exprString {
+			return nil, fmt.Errorf("operator %s at position %d needs string on the left and string literal on the right", op, pos) //nolint:goerr113,lll
+		}
+
+		if node.re, err = regexp.Compile(lit.v.s); err != nil {
+			return nil, fmt.Errorf("incorrect regexp at position %d: %w", pos, err)
+		}
+
+	case "<", "<=", ">", ">=":
+		if l.typ() != r.typ() || (l.typ() != exprNumber && l.typ() != exprString) {
+			return nil, mismatch
+		}
+
+	case "in":
+		if l.typ() != exprString || r.typ() != exprList {
+			return nil, mismatch
+		}
+
+	case "contains":
+		if (l.typ() != exprString && l.typ() != exprList) || r.typ() != exprString {
+			return nil, mismatch
+		}
+	}
+
+	return node, nil
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) { //nolint:cyclop
+	tok := p.next()
+
+	switch tok.kind {
+	case tokString:
+		return &exprLiteral{t: exprString, v: exprValue{s: tok.str}}, nil //nolint:exhaustruct
+
+	case tokNumber:
+		return &exprLiteral{t: exprNumber, v: exprValue{n: tok.num}}, nil //nolint:exhaustruct
+
+	case tokIdent:
+		switch tok.text {
+		case "true", "false":
+			return &exprLiteral{t: exprBool, v: exprValue{b: tok.text == "true"}}, nil //nolint:exhaustruct
+		}
+
+		field, exist := exprFields[tok.text]
+
+		if !exist {
+			return nil, fmt.Errorf("unknown field %s at position %d", tok.text, tok.pos) //nolint:goerr113
+		}
+
+		p.fields[tok.text] = true
+
+		return &exprFieldRef{field: field}, nil
+
+	case tokOp:
+		switch tok.text {
+		case "(":
+			x, err := p.parseOr()
+
+			if err != nil {
+				return nil, err
+			}
+
+			if _, ok := p.accept(")"); !ok {
+				return nil, fmt.Errorf("expected ) at position %d", p.peek().pos) //nolint:goerr113
+			}
+
+			return x, nil
+
+		case "[":
+			return p.parseList()
+		}
+
+	case tokEOF:
+		return nil, errors.New("unexpected end of expression") //nolint:goerr113
+	}
+
+	return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos) //nolint:goerr113
+}
+
+// parseList разбирает список строковых литералов, открывающая скобка уже съедена.
+func (p *exprParser) parseList() (exprNode, error) {
+	list := &exprLiteral{t: exprList, v: exprValue{l: []string{}}} //nolint:exhaustruct
+
+	if _, ok := p.accept("]"); ok {
+		return list, nil
+	}
+
+	for {
+		tok := p.next()
+
+		if tok.kind != tokString {
+			return nil, fmt.Errorf("expected string in list at position %d, got %q", tok.pos, tok.text) //nolint:goerr113
+		}
+
+		list.v.l = append(list.v.l, tok.str)
+
+		if _, ok := p.accept("]"); ok {
+			return list, nil
+		}
+
+		if _, ok := p.accept(","); !ok {
+			return nil, fmt.Errorf("expected , or ] at position %d", p.peek().pos) //nolint:goerr113
+		}
+	}
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
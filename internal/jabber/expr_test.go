@@ -0,0 +1,155 @@
+package jabber
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCompileExprErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+	}{
+		{"empty", ""},
+		{"not boolean", `nick`},
+		{"number is not boolean", `42`},
+		{"unknown field", `login == "x"`},
+		{"unterminated string", `nick == "abc`},
+		{"unexpected character", `nick == "a" # x`},
+		{"trailing token", `nick == "a" "b"`},
+		{"missing paren", `(nick == "a"`},
+		{"string compared to number", `nick == 1`},
+		{"list equality", `caps == ["a"]`},
+		{"regexp on number", `age =~ "1"`},
+		{"regexp from field", `nick =~ status`},
+		{"broken regexp", `nick =~ "("`},
+		{"number less than string", `age < "1.0"`},
+		{"bool ordering", `true < false`},
+		{"in needs list", `nick in "abc"`},
+		{"in on number", `age in ["1"]`},
+		{"contains number", `caps contains 1`},
+		{"contains on number", `age contains "1"`},
+		{"number in list", `caps contains "a" || nick in [1]`},
+		{"unclosed list", `nick in ["a" "b"]`},
+		{"bad duration suffix", `age > 5x`},
+		{"negative number", `reputation < -1`},
+		{"not on string", `!nick`},
+		{"and on string", `nick && true`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if e, err := CompileExpr(tt.source); err == nil {
+				t.Errorf("CompileExpr(%q) = %q, want error", tt.source, e)
+			}
+		})
+	}
+}
+
+func TestExprEval(t *testing.T) {
+	env := &ExprEnv{ //nolint:exhaustruct
+		JID:           "spammer@example.org",
+		Nick:          "abcdefgh",
+		Domain:        "example.org",
+		Status:        "buy cheap",
+		ClientName:    "Gajim",
+		ClientVersion: "1.8.4",
+		ClientOs:      "Windows",
+		Caps:          []string{"urn:xmpp:jingle:1", "http://jabber.org/protocol/caps"},
+		Text:          "hello world",
+		Age:           90 * time.Second,
+		Reputation:    -3,
+	}
+
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		// Сравнения строк, чисел и логических значений.
+		{`nick == "abcdefgh"`, true},
+		{`nick != "abcdefgh"`, false},
+		{`domain == 'example.org'`, true},
+		{`reputation < 0`, true},
+		{`0 > reputation`, true},
+		{`reputation >= 0`, false},
+		{`age > 60`, true},
+		{`age >= 90`, true},
+		{`age < 90`, false},
+		{`true == true`, true},
+		{`true != false`, true},
+
+		// Длительности переводятся в секунды.
+		{`age > 1m`, true},
+		{`age < 2m`, true},
+		{`age == 90s`, true},
+		{`age < 1h`, true},
+		{`age > 1d`, false},
+		{`age >= 1.5m`, true},
+
+		// Регулярки.
+		{`nick =~ "^[a-z]{8}$"`, true},
+		{`nick !~ "^[a-z]{8}$"`, false},
+		{`status =~ "(?i)BUY"`, true},
+		{`jid =~ "@jabber\\.ru$"`, false},
+
+		// Строки сравниваются как версии.
+		{`client.version >= "1.8"`, true},
+		{`client.version < "1.10"`, true},
+		{`client.version > "1.8.4"`, false},
+		{`client.version == "1.8.4"`, true},
+
+		// in и contains.
+		{`client.name in ["Gajim", "Psi"]`, true},
+		{`client.os in []`, false},
+		{`caps contains "urn:xmpp:jingle:1"`, true},
+		{`caps contains "urn:xmpp:jingle"`, false},
+		{`text contains "world"`, true},
+		{`text contains "World"`, false},
+
+		// Приоритеты: ! сильнее &&, && сильнее ||.
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		{`!false && false`, false},
+		{`!(false && false)`, true},
+		{`false || !false`, true},
+		{`nick == "x" || client.name == "Gajim" && age > 60`, true},
+		{`(nick == "x" || client.name == "Gajim") && age > 120`, false},
+
+		// Словесные синонимы.
+		{`not false and true`, true},
+		{`false or domain == "example.org"`, true},
+		{`not (nick == "abcdefgh" and age > 60)`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			e, err := CompileExpr(tt.source)
+
+			if err != nil {
+				t.Fatalf("CompileExpr(%q): %s", tt.source, err)
+			}
+
+			if got := e.Eval(env); got != tt.want {
+				t.Errorf("Eval(%q) = %t, want %t", tt.source, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExprUses(t *testing.T) {
+	e, err := CompileExpr(`caps contains "x" || (nick == "a" && !(client.version < "2"))`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for field, want := range map[string]bool{
+		"caps": true, "nick": true, "client.version": true, "client.name": false, "text": false,
+	} {
+		if got := e.Uses(field); got != want {
+			t.Errorf("Uses(%q) = %t, want %t", field, got, want)
+		}
+	}
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
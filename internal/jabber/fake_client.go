@@ -0,0 +1,149 @@
+package jabber
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/eleksir/go-xmpp"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// FakeClient - xmpp-клиент без сервера. Он ничего никуда не отправляет, а только пересказывает сообщения, которые бот
+// отправил бы участникам, в Out. События ему взять неоткуда, их в ParseEvent подаёт тот, кто его использует.
+type FakeClient struct {
+	// Jid - jid бота.
+	Jid string
+
+	// Out - куда писать отправленные сообщения, может быть nil.
+	Out io.Writer
+
+	mu sync.Mutex
+}
+
+// JID возвращает jid бота.
+func (c *FakeClient) JID() string {
+	return c.Jid
+}
+
+// Recv всегда возвращает io.EOF, сервера нет.
+func (c *FakeClient) Recv() (interface{}, error) {
+	return xmpp.Chat{}, io.EOF //nolint:exhaustruct
+}
+
+// Close ничего не делает.
+func (c *FakeClient) Close() error {
+	return nil
+}
+
+// Send пересказывает сообщение в Out.
+func (c *FakeClient) Send(chat xmpp.Chat) (int, error) {
+	c.printf("message to %s (%s): %s", chat.Remote, chat.Type, chat.Text)
+
+	return len(chat.Text), nil
+}
+
+// SendPresence ничего не делает.
+func (c *FakeClient) SendPresence(presence xmpp.Presence) (int, error) {
+	log.Debugf("Fake client: presence to %s", presence.To)
+
+	return 0, nil
+}
+
+// SendKeepAlive ничего не делает.
+func (c *FakeClient) SendKeepAlive() (int, error) {
+	return 0, nil
+}
+
+// JoinMUCNoHistory ничего не делает.
+func (c *FakeClient) JoinMUCNoHistory(jid, nick string) (int, error) {
+	log.Debugf("Fake client: join %s as %s", jid, nick)
+
+	return 0, nil
+}
+
+// JoinMUC ничего не делает, истории не будет.
+func (c *FakeClient) JoinMUC(jid, nick string, historyType, history int, historyDate *time.Time) (int, error) {
+	log.Debugf("Fake client: join %s as %s with history", jid, nick)
+
+	return 0, nil
+}
+
+// DiscoverInfo ничего не делает, ответа не будет.
+func (c *FakeClient) DiscoverInfo(from, to string) (string, error) {
+	log.Debugf("Fake client: disco#info from %s to %s", from, to)
+
+	return "info3", nil
+}
+
+// RawInformation ничего не делает, ответа не будет.
+func (c *FakeClient) RawInformation(from, to, id, iqType, body string) (string, error) {
+	log.Debugf("Fake client: iq %s %s from %s to %s: %s", id, iqType, from, to, body)
+
+	return id, nil
+}
+
+// RawInformationQuery ничего не делает, ответа не будет.
+func (c *FakeClient) RawInformationQuery(from, to, id, iqType, requestNamespace, body string) (string, error) {
+	log.Debugf("Fake client: iq %s %s %s from %s to %s: %s", id, iqType, requestNamespace, from, to, body)
+
+	return id, nil
+}
+
+// PingC2S ничего не делает.
+func (c *FakeClient) PingC2S(jid, server string) error {
+	return nil
+}
+
+// PingS2S ничего не делает.
+func (c *FakeClient) PingS2S(fromServer, toServer string) error {
+	return nil
+}
+
+// PingResponse ничего не делает.
+func (c *FakeClient) PingResponse(v xmpp.IQ) (string, error) {
+	return v.ID, nil
+}
+
+// IqVersionResponse ничего не делает.
+func (c *FakeClient) IqVersionResponse(v xmpp.IQ, name, version, os string) (string, error) {
+	return v.ID, nil
+}
+
+// JabberIqLastResponse ничего не делает.
+func (c *FakeClient) JabberIqLastResponse(v xmpp.IQ, lastActivity int64) (string, error) {
+	return v.ID, nil
+}
+
+// UrnXMPPTimeResponse ничего не делает.
+func (c *FakeClient) UrnXMPPTimeResponse(v xmpp.IQ, timezoneOffset string) (string, error) {
+	return v.ID, nil
+}
+
+// ErrorNotImplemented ничего не делает.
+func (c *FakeClient) ErrorNotImplemented(v xmpp.IQ, xmlns, feature string) (string, error) {
+	return v.ID, nil
+}
+
+// ErrorServiceUnavailable ничего не делает.
+func (c *FakeClient) ErrorServiceUnavailable(v xmpp.IQ, queryXmlns, node string) (string, error) {
+	return uuid.New().String(), nil
+}
+
+// printf пишет строку в Out.
+func (c *FakeClient) printf(format string, args ...interface{}) {
+	if c.Out == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := fmt.Fprintf(c.Out, format+"\n", args...); err != nil {
+		log.Errorf("Fake client: unable to write output: %s", err)
+	}
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,155 @@
+package jabber
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// WhiteListJid прототип записи белого списка. В файле она может быть записана просто строкой с шаблоном jid-а, либо
+// объектом с полями jid и expires, если запись временная.
+type WhiteListJid struct {
+	// Jid - шаблон jid-а: точный bare jid, "*@domain.tld", "domain.tld" (весь сервер целиком) или "/регулярка/".
+	Jid string `json:"jid"`
+
+	// Expires - после этого момента запись перестаёт действовать. Формат "2006-01-02" или RFC 3339.
+	Expires string `json:"expires,omitempty"`
+}
+
+// UnmarshalJSON позволяет записывать в белом списке вместо объекта просто строку с шаблоном jid-а.
+func (w *WhiteListJid) UnmarshalJSON(data []byte) error {
+	var s string
+
+	if err := json.Unmarshal(data, &s); err == nil {
+		w.Jid = s
+		w.Expires = ""
+
+		return nil
+	}
+
+	type plain WhiteListJid
+
+	var p plain
+
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	*w = WhiteListJid(p)
+
+	return nil
+}
+
+// JidPattern скомпилированный шаблон jid-а.
+type JidPattern struct {
+	// Source - шаблон, как он записан в файле.
+	Source string
+
+	// Expires - когда шаблон перестаёт действовать, нулевое значение - никогда.
+	Expires time.Time
+
+	exact  string
+	domain string
+	re     *regexp.Regexp
+}
+
+// CompileJidPattern компилирует шаблон jid-а. Поддерживаются:
+//   - точный bare jid: user@domain.tld;
+//   - все пользователи домена: *@domain.tld;
+//   - весь сервер целиком, то есть домен и его поддомены: domain.tld;
+//   - регулярка, совпадающая с bare jid-ом: /^bot[0-9]+@domain\.tld$/.
+func CompileJidPattern(pattern, expires string) (*JidPattern, error) {
+	var (
+		p   = &JidPattern{Source: pattern} //nolint:exhaustruct
+		err error
+	)
+
+	pattern = strings.TrimSpace(pattern)
+
+	switch {
+	case pattern == "":
+		return nil, errors.New("empty jid pattern") //nolint:goerr113
+
+	case len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+		if p.re, err = regexp.Compile(pattern[1 : len(pattern)-1]); err != nil {
+			return nil, fmt.Errorf("incorrect regexp in jid pattern %s: %w", pattern, err)
+		}
+
+	case strings.HasPrefix(pattern, "*@"):
+		p.domain = strings.ToLower(strings.TrimPrefix(pattern, "*@"))
+
+	case !strings.Contains(pattern, "@"):
+		p.domain = strings.ToLower(pattern)
+
+	default:
+		p.exact = strings.ToLower(pattern)
+	}
+
+	if expires != "" {
+		if p.Expires, err = parseExpires(expires); err != nil {
+			return nil, fmt.Errorf("incorrect expiration date of jid pattern %s: %w", pattern, err)
+		}
+	}
+
+	return p, nil
+}
+
+// Expired сообщает, истёк ли срок действия шаблона.
+func (p *JidPattern) Expired() bool {
+	return !p.Expires.IsZero() && time.Now().After(p.Expires)
+}
+
+// Match проверяет, подходит ли bare jid под шаблон. Просроченные шаблоны не совпадают ни с чем.
+func (p *JidPattern) Match(bareJid string) bool {
+	if p.Expired() {
+		return false
+	}
+
+	if p.re != nil {
+		return p.re.MatchString(bareJid)
+	}
+
+	bareJid = strings.ToLower(bareJid)
+
+	if p.exact != "" {
+		return p.exact == bareJid
+	}
+
+	domain := bareJid
+
+	if at := strings.LastIndex(bareJid, "@"); at >= 0 {
+		domain = bareJid[at+1:]
+	}
+
+	return domain == p.domain || strings.HasSuffix(domain, "."+p.domain)
+}
+
+// String возвращает шаблон в том виде, в котором он записан в файле, для логов.
+func (p *JidPattern) String() string {
+	if p.Expires.IsZero() {
+		return p.Source
+	}
+
+	return fmt.Sprintf("%s (expires %s)", p.Source, p.Expires.Format(time.RFC3339))
+}
+
+// parseExpires разбирает дату окончания действия записи: либо дата, либо дата и время в RFC 3339. Дата без времени
+// действует до конца дня по локальному времени.
+func parseExpires(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+
+	if err != nil {
+		return t, fmt.Errorf("expected YYYY-MM-DD or RFC 3339 date, got %s", s) //nolint:goerr113
+	}
+
+	return t.AddDate(0, 0, 1), nil
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,137 @@
+package jabber
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestJidPatternMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		jid     string
+		want    bool
+	}{
+		// Точный jid, без учёта регистра.
+		{"user@example.org", "user@example.org", true},
+		{"user@example.org", "User@Example.ORG", true},
+		{"User@Example.org", "user@example.org", true},
+		{"user@example.org", "user2@example.org", false},
+		{"user@example.org", "user@example.org.evil", false},
+		{" user@example.org ", "user@example.org", true},
+
+		// Все пользователи домена.
+		{"*@example.org", "anyone@example.org", true},
+		{"*@example.org", "anyone@EXAMPLE.org", true},
+		{"*@example.org", "anyone@example.com", false},
+		{"*@example.org", "anyone@badexample.org", false},
+
+		// Сервер целиком, с поддоменами.
+		{"example.org", "user@example.org", true},
+		{"example.org", "user@conference.example.org", true},
+		{"example.org", "example.org", true},
+		{"example.org", "user@badexample.org", false},
+		{"example.org", "user@example.org.evil", false},
+
+		// Регулярки совпадают с bare jid-ом как есть.
+		{`/^bot[0-9]+@example\.org$/`, "bot42@example.org", true},
+		{`/^bot[0-9]+@example\.org$/`, "botx@example.org", false},
+		{`/^bot[0-9]+@example\.org$/`, "BOT42@example.org", false},
+		{`/(?i)^bot[0-9]+@example\.org$/`, "BOT42@example.org", true},
+		{`/spam/`, "nospamhere@example.org", true},
+
+		// "//" слишком короткий для регулярки и считается доменом.
+		{"//", "user@example.org", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.jid, func(t *testing.T) {
+			p, err := CompileJidPattern(tt.pattern, "")
+
+			if err != nil {
+				t.Fatalf("CompileJidPattern(%q): %s", tt.pattern, err)
+			}
+
+			if got := p.Match(tt.jid); got != tt.want {
+				t.Errorf("%q.Match(%q) = %t, want %t", tt.pattern, tt.jid, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileJidPatternErrors(t *testing.T) {
+	tests := []struct {
+		pattern string
+		expires string
+	}{
+		{"", ""},
+		{"   ", ""},
+		{"/[/", ""},
+		{"user@example.org", "tomorrow"},
+		{"user@example.org", "2024-13-01"},
+		{"user@example.org", "01.02.2024"},
+	}
+
+	for _, tt := range tests {
+		if _, err := CompileJidPattern(tt.pattern, tt.expires); err == nil {
+			t.Errorf("CompileJidPattern(%q, %q) succeeded, want error", tt.pattern, tt.expires)
+		}
+	}
+}
+
+func TestJidPatternExpires(t *testing.T) {
+	var (
+		now       = time.Now()
+		yesterday = now.AddDate(0, 0, -1).Format("2006-01-02")
+		today     = now.Format("2006-01-02")
+	)
+
+	tests := []struct {
+		expires string
+		want    bool
+	}{
+		{"", true},
+		{yesterday, false},
+
+		// Дата без времени действует до конца дня.
+		{today, true},
+		{now.Add(time.Hour).Format(time.RFC3339), true},
+		{now.Add(-time.Minute).Format(time.RFC3339), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expires, func(t *testing.T) {
+			p, err := CompileJidPattern("user@example.org", tt.expires)
+
+			if err != nil {
+				t.Fatalf("CompileJidPattern: %s", err)
+			}
+
+			if got := p.Match("user@example.org"); got != tt.want {
+				t.Errorf("Match with expires %q = %t, want %t", tt.expires, got, tt.want)
+			}
+
+			if p.Expired() == tt.want {
+				t.Errorf("Expired with expires %q = %t, want %t", tt.expires, p.Expired(), !tt.want)
+			}
+		})
+	}
+}
+
+func TestWhiteListJidUnmarshal(t *testing.T) {
+	var list []WhiteListJid
+
+	data := `["user@example.org", {"jid": "*@example.com", "expires": "2030-01-01"}]`
+
+	if err := json.Unmarshal([]byte(data), &list); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []WhiteListJid{{Jid: "user@example.org", Expires: ""}, {Jid: "*@example.com", Expires: "2030-01-01"}}
+
+	if len(list) != len(want) || list[0] != want[0] || list[1] != want[1] {
+		t.Errorf("got %+v, want %+v", list, want)
+	}
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
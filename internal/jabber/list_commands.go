@@ -0,0 +1,666 @@
+package jabber
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// blacklistKinds - виды правил чёрного списка, которые можно добавлять командой.
+var blacklistKinds = []string{"phrase", "nick", "jid", "expr"}
+
+// registerListCommands добавляет в реестр команды правки белого и чёрного списков. Изменённый список сразу начинает
+// действовать и записывается в тот файл, из которого был загружен. Владельцы, администраторы и модераторы комнаты
+// видят и правят только записи своей комнаты, глобальные записи - только для bot_masters.
+func registerListCommands(r *CommandRegistry) {
+	r.Register(&Command{ //nolint:exhaustruct
+		Name:       "bl",
+		Aliases:    []string{"чс"},
+		Usage:      "add <phrase|nick|jid|expr> <room|global> <rule> | del <rule id> | del <kind> <room|global> <rule> | list [room|global]",
+		Help:       "edit blacklist",
+		MinArgs:    1,
+		MaxArgs:    -1,
+		Permission: PermRoomAdmin,
+		Places:     CmdAnywhere,
+		Private:    true,
+		Run:        (*Jabber).cmdBlacklist,
+	})
+
+	r.Register(&Command{ //nolint:exhaustruct
+		Name:       "wl",
+		Aliases:    []string{"бс"},
+		Usage:      "add <jid> [room|global] [expires] | del <jid> [room|global] | list [room|global]",
+		Help:       "edit whitelist",
+		MinArgs:    1,
+		MaxArgs:    4,
+		Permission: PermRoomAdmin,
+		Places:     CmdAnywhere,
+		Private:    true,
+		Run:        (*Jabber).cmdWhitelist,
+	})
+}
+
+// listRoom разбирает аргумент с комнатой: "global" означает глобальную запись списка, иначе комната должна быть в
+// конфиге.
+func (j *Jabber) listRoom(arg string) (string, error) {
+	if strings.EqualFold(arg, "global") {
+		return "", nil
+	}
+
+	if j.GetRoomConfig(arg) == nil {
+		return "", fmt.Errorf("room %s is not configured, use room name or global", arg) //nolint:goerr113
+	}
+
+	return arg, nil
+}
+
+// listVisible сообщает, можно ли автору вызова r видеть и править записи списков комнаты room (пустая - глобальные).
+func (j *Jabber) listVisible(r *CmdRequest, room string) bool {
+	return j.IsMaster(r.JID) || (room != "" && j.IsRoomAdmin(room, r.JID))
+}
+
+// roomTitle - название комнаты записи списка для ответов и логов.
+func roomTitle(room string) string {
+	if room == "" {
+		return "global"
+	}
+
+	return room
+}
+
+// cmdBlacklist разбирает подкоманды !bl.
+func (j *Jabber) cmdBlacklist(r *CmdRequest) string {
+	args := r.Args[1:]
+
+	switch strings.ToLower(r.Args[0]) {
+	case "add":
+		if len(args) < 3 {
+			return r.Usage(j.C.CSign)
+		}
+
+		return j.blacklistAdd(r, strings.ToLower(args[0]), args[1], strings.Join(args[2:], " "))
+
+	case "del":
+		switch {
+		case len(args) == 1:
+			return j.blacklistDel(r, args[0], "", "", "")
+		case len(args) >= 3:
+			return j.blacklistDel(r, "", strings.ToLower(args[0]), args[1], strings.Join(args[2:], " "))
+		}
+
+	case "list":
+		switch len(args) {
+		case 0:
+			return j.blacklistList(r, nil)
+		case 1:
+			room, err := j.listRoom(args[0])
+
+			if err != nil {
+				return fmt.Sprint(err)
+			}
+
+			if !j.CmdRoomPermitted(r, room) {
+				return deniedAnswer
+			}
+
+			return j.blacklistList(r, &room)
+		}
+	}
+
+	return r.Usage(j.C.CSign)
+}
+
+// validateBlacklistRule проверяет правило так же, как это делает check: регулярка или выражение должны разбираться, не
+// должны совпадать с чем угодно и не должны задевать самого бота или его мастеров.
+func (j *Jabber) validateBlacklistRule(kind, room, rule string) error {
+	if !slices.Contains(blacklistKinds, kind) {
+		return fmt.Errorf("unknown rule kind %s, expected one of %s", kind, strings.Join(blacklistKinds, ", ")) //nolint:goerr113
+	}
+
+	if kind == "expr" {
+		if _, err := CompileExpr(rule); err != nil {
+			return fmt.Errorf("incorrect expr %q: %w", rule, err)
+		}
+
+		return nil
+	}
+
+	re, err := regexp.Compile(rule)
+
+	if err != nil {
+		return fmt.Errorf("incorrect regexp %q: %w", rule, err)
+	}
+
+	if matchesEverything(re) {
+		return fmt.Errorf("%s matches everything", rule) //nolint:goerr113
+	}
+
+	c := &checker{} //nolint:exhaustruct
+
+	c.checkBotMatch(kind, kind, re, room, &j.C)
+
+	if len(c.problems) > 0 {
+		return errors.New(c.problems[0].Message) //nolint:goerr113
+	}
+
+	return nil
+}
+
+// ruleSources возвращает список правил записи чёрного списка данного вида.
+func (b *BlackListEntry) ruleSources(kind string) *[]string {
+	switch kind {
+	case "jid":
+		return &b.JidRe
+	case "nick":
+		return &b.NickRe
+	case "phrase":
+		return &b.PhraseRe
+	case "expr":
+		return &b.Expr
+	}
+
+	return nil
+}
+
+// plain сообщает, что запись чёрного списка - простой бан без очков, срока, режима и особой причины. Правила,
+// добавленные командой, попадают в такую запись.
+func (b *BlackListEntry) plain() bool {
+	return (b.Action == "ban" || b.Action == "") && b.Score == 0 && b.Reason == "" && !b.ReasonEnable && b.Expires == "" && b.Mode == ""
+}
+
+// ruleIDOf считает RuleID правила так же, как его считает TrackRules: выражения - по разобранному виду.
+func ruleIDOf(room, kind, rule string) string {
+	if kind == "expr" {
+		if expr, err := CompileExpr(rule); err == nil {
+			rule = expr.String()
+		}
+	}
+
+	return RuleID(room, kind, rule)
+}
+
+// blacklistAdd добавляет правило в чёрный список.
+func (j *Jabber) blacklistAdd(r *CmdRequest, kind, roomArg, rule string) string {
+	room, err := j.listRoom(roomArg)
+
+	if err != nil {
+		return fmt.Sprint(err)
+	}
+
+	if !j.CmdRoomPermitted(r, room) {
+		return deniedAnswer
+	}
+
+	if err := j.validateBlacklistRule(kind, room, rule); err != nil {
+		return fmt.Sprint(err)
+	}
+
+	err = j.editBlacklist(func(bl *MyBlackList) error {
+		var target *BlackListEntry
+
+		for n := range bl.Blacklist {
+			bEntry := &bl.Blacklist[n]
+
+			if bEntry.RoomName != room {
+				continue
+			}
+
+			if slices.Contains(*bEntry.ruleSources(kind), rule) {
+				return fmt.Errorf("%s rule %q is already in %s blacklist", kind, rule, roomTitle(room)) //nolint:goerr113
+			}
+
+			if target == nil && bEntry.plain() {
+				target = bEntry
+			}
+		}
+
+		if target == nil {
+			bl.Blacklist = append(bl.Blacklist, BlackListEntry{RoomName: room, Action: "ban"}) //nolint:exhaustruct
+			target = &bl.Blacklist[len(bl.Blacklist)-1]
+		}
+
+		sources := target.ruleSources(kind)
+		*sources = append(*sources, rule)
+
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Sprint(err)
+	}
+
+	id := ruleIDOf(room, kind, rule)
+
+	j.auditListChange(r, "blacklist add", room, id, kind+" "+rule)
+
+	return fmt.Sprintf("Added %s rule %s to %s blacklist", kind, id, roomTitle(room))
+}
+
+// blacklistDel удаляет правило из чёрного списка: по его id или по виду, комнате и самому правилу. Записи, в которых не
+// осталось правил, удаляются целиком. Правила чужих комнат по id не находятся.
+func (j *Jabber) blacklistDel(r *CmdRequest, id, kind, roomArg, rule string) string {
+	var (
+		room    string
+		removed []string
+		err     error
+	)
+
+	if id == "" {
+		if room, err = j.listRoom(roomArg); err != nil {
+			return fmt.Sprint(err)
+		}
+
+		if !j.CmdRoomPermitted(r, room) {
+			return deniedAnswer
+		}
+	}
+
+	err = j.editBlacklist(func(bl *MyBlackList) error {
+		for n := range bl.Blacklist {
+			bEntry := &bl.Blacklist[n]
+
+			if !j.listVisible(r, bEntry.RoomName) {
+				continue
+			}
+
+			for _, k := range blacklistKinds {
+				sources := bEntry.ruleSources(k)
+
+				*sources = slices.DeleteFunc(*sources, func(source string) bool {
+					var match bool
+
+					if id != "" {
+						match = ruleIDOf(bEntry.RoomName, k, source) == id
+					} else {
+						match = bEntry.RoomName == room && k == kind && source == rule
+					}
+
+					if match {
+						removed = append(removed, ruleIDOf(bEntry.RoomName, k, source))
+						room = bEntry.RoomName
+						kind = k
+						rule = source
+					}
+
+					return match
+				})
+			}
+		}
+
+		if len(removed) == 0 {
+			return errors.New("no such rule in blacklist") //nolint:goerr113
+		}
+
+		bl.Blacklist = slices.DeleteFunc(bl.Blacklist, func(bEntry BlackListEntry) bool {
+			return len(bEntry.JidRe)+len(bEntry.NickRe)+len(bEntry.PhraseRe)+len(bEntry.UserAgent)+len(bEntry.Expr) == 0
+		})
+
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Sprint(err)
+	}
+
+	j.auditListChange(r, "blacklist del", room, removed[0], kind+" "+rule)
+
+	return fmt.Sprintf("Removed %s rule %s from %s blacklist", kind, removed[0], roomTitle(room))
+}
+
+// blacklistList перечисляет правила чёрного списка вместе с их id: все, что видны автору вызова r, или только для одной
+// комнаты.
+func (j *Jabber) blacklistList(r *CmdRequest, room *string) string {
+	var lines []string
+
+	for _, bEntry := range j.BlackList.Blacklist {
+		if (room != nil && bEntry.RoomName != *room) || !j.listVisible(r, bEntry.RoomName) {
+			continue
+		}
+
+		for _, rule := range bEntry.rules() {
+			lines = append(
+				lines,
+				fmt.Sprintf(
+					"%s %s %s %s: %s",
+					RuleID(bEntry.RoomName, rule.kind, rule.pattern),
+					roomTitle(bEntry.RoomName),
+					bEntry.Action,
+					rule.kind,
+					rule.pattern,
+				),
+			)
+		}
+	}
+
+	if len(lines) == 0 {
+		return "Blacklist is empty"
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// cmdWhitelist разбирает подкоманды !wl.
+func (j *Jabber) cmdWhitelist(r *CmdRequest) string {
+	var (
+		args    = r.Args[1:]
+		room    string
+		expires string
+		err     error
+	)
+
+	switch strings.ToLower(r.Args[0]) {
+	case "add":
+		if len(args) < 1 {
+			return r.Usage(j.C.CSign)
+		}
+
+		if len(args) > 1 {
+			if room, err = j.listRoom(args[1]); err != nil {
+				return fmt.Sprint(err)
+			}
+		}
+
+		if len(args) > 2 {
+			expires = args[2]
+		}
+
+		if !j.CmdRoomPermitted(r, room) {
+			return deniedAnswer
+		}
+
+		return j.whitelistAdd(r, args[0], room, expires)
+
+	case "del":
+		if len(args) < 1 || len(args) > 2 {
+			return r.Usage(j.C.CSign)
+		}
+
+		if len(args) > 1 {
+			if room, err = j.listRoom(args[1]); err != nil {
+				return fmt.Sprint(err)
+			}
+		}
+
+		if !j.CmdRoomPermitted(r, room) {
+			return deniedAnswer
+		}
+
+		return j.whitelistDel(r, args[0], room)
+
+	case "list":
+		switch len(args) {
+		case 0:
+			return j.whitelistList(r, nil)
+		case 1:
+			if room, err = j.listRoom(args[0]); err != nil {
+				return fmt.Sprint(err)
+			}
+
+			if !j.CmdRoomPermitted(r, room) {
+				return deniedAnswer
+			}
+
+			return j.whitelistList(r, &room)
+		}
+	}
+
+	return r.Usage(j.C.CSign)
+}
+
+// whitelistAdd добавляет шаблон jid-а в белый список комнаты room или в глобальный.
+func (j *Jabber) whitelistAdd(r *CmdRequest, jid, room, expires string) string {
+	pattern, err := CompileJidPattern(jid, expires)
+
+	if err != nil {
+		return fmt.Sprint(err)
+	}
+
+	// Слишком широкий шаблон выключил бы бота во всей комнате, а jid с ресурсом не совпадёт ни с чем: сравниваются
+	// bare jid-ы.
+	switch {
+	case pattern.re != nil && matchesEverything(pattern.re):
+		return fmt.Sprintf("%s matches every jid", jid)
+	case pattern.domain != "" && !strings.Contains(pattern.domain, "."):
+		return fmt.Sprintf("%s covers the whole top-level domain", jid)
+	case pattern.re == nil && strings.Contains(jid, "/"):
+		return fmt.Sprintf("%s has a resource, whitelist matches bare jids only", jid)
+	case pattern.Expired():
+		return fmt.Sprintf("%s is already expired", pattern)
+	}
+
+	err = j.editWhitelist(func(wl *MyWhiteList) error {
+		var target *WhiteListEntry
+
+		for n := range wl.Whitelist {
+			wEntry := &wl.Whitelist[n]
+
+			if wEntry.RoomName != room {
+				continue
+			}
+
+			for _, w := range wEntry.Jid {
+				if strings.EqualFold(w.Jid, jid) {
+					return fmt.Errorf("%s is already in %s whitelist", jid, roomTitle(room)) //nolint:goerr113
+				}
+			}
+
+			if target == nil {
+				target = wEntry
+			}
+		}
+
+		if target == nil {
+			wl.Whitelist = append(wl.Whitelist, WhiteListEntry{RoomName: room}) //nolint:exhaustruct
+			target = &wl.Whitelist[len(wl.Whitelist)-1]
+		}
+
+		target.Jid = append(target.Jid, WhiteListJid{Jid: jid, Expires: expires})
+
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Sprint(err)
+	}
+
+	j.auditListChange(r, "whitelist add", room, "", pattern.String())
+
+	return fmt.Sprintf("Added %s to %s whitelist", pattern, roomTitle(room))
+}
+
+// whitelistDel удаляет шаблон jid-а из белого списка комнаты room или из глобального. Пустые записи удаляются целиком.
+func (j *Jabber) whitelistDel(r *CmdRequest, jid, room string) string {
+	err := j.editWhitelist(func(wl *MyWhiteList) error {
+		removed := false
+
+		for n := range wl.Whitelist {
+			wEntry := &wl.Whitelist[n]
+
+			if wEntry.RoomName != room {
+				continue
+			}
+
+			wEntry.Jid = slices.DeleteFunc(wEntry.Jid, func(w WhiteListJid) bool {
+				if strings.EqualFold(w.Jid, jid) {
+					removed = true
+
+					return true
+				}
+
+				return false
+			})
+		}
+
+		if !removed {
+			return fmt.Errorf("%s is not in %s whitelist", jid, roomTitle(room)) //nolint:goerr113
+		}
+
+		wl.Whitelist = slices.DeleteFunc(wl.Whitelist, func(wEntry WhiteListEntry) bool {
+			return len(wEntry.Jid) == 0 && !wEntry.WipeBans
+		})
+
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Sprint(err)
+	}
+
+	j.auditListChange(r, "whitelist del", room, "", jid)
+
+	return fmt.Sprintf("Removed %s from %s whitelist", jid, roomTitle(room))
+}
+
+// whitelistList перечисляет шаблоны белого списка: все, что видны автору вызова r, или только для одной комнаты.
+func (j *Jabber) whitelistList(r *CmdRequest, room *string) string {
+	var lines []string
+
+	for _, wEntry := range j.WhiteList.Whitelist {
+		if (room != nil && wEntry.RoomName != *room) || !j.listVisible(r, wEntry.RoomName) {
+			continue
+		}
+
+		for _, pattern := range wEntry.jids {
+			line := roomTitle(wEntry.RoomName) + ": " + pattern.String()
+
+			if pattern.Expired() {
+				line += " (expired)"
+			}
+
+			lines = append(lines, line)
+		}
+	}
+
+	if len(lines) == 0 {
+		return "Whitelist is empty"
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// errListNotLoaded - список не был загружен из файла, так что править его некуда.
+var errListNotLoaded = errors.New("list was not loaded from file, nowhere to save it")
+
+// editBlacklist применяет правку edit к копии чёрного списка в том виде, как он был прочитан из файла, записывает
+// результат в файл и только после этого подменяет им действующий список.
+func (j *Jabber) editBlacklist(edit func(bl *MyBlackList) error) error {
+	var bl MyBlackList
+
+	if j.BlacklistFile == "" || j.blacklistRaw == nil {
+		return errListNotLoaded
+	}
+
+	if err := json.Unmarshal(j.blacklistRaw, &bl); err != nil {
+		return fmt.Errorf("unable to copy blacklist: %w", err)
+	}
+
+	if err := edit(&bl); err != nil {
+		return err
+	}
+
+	raw, err := saveList(j.BlacklistFile, bl)
+
+	if err != nil {
+		log.Errorf("Unable to save blacklist: %s", err)
+
+		return err
+	}
+
+	prepareBlacklist(&bl)
+
+	j.BlackList = bl
+	j.blacklistRaw = raw
+	j.TrackRules()
+
+	return nil
+}
+
+// editWhitelist применяет правку edit к копии белого списка в том виде, как он был прочитан из файла, записывает
+// результат в файл и только после этого подменяет им действующий список.
+func (j *Jabber) editWhitelist(edit func(wl *MyWhiteList) error) error {
+	var wl MyWhiteList
+
+	if j.WhitelistFile == "" || j.whitelistRaw == nil {
+		return errListNotLoaded
+	}
+
+	if err := json.Unmarshal(j.whitelistRaw, &wl); err != nil {
+		return fmt.Errorf("unable to copy whitelist: %w", err)
+	}
+
+	if err := edit(&wl); err != nil {
+		return err
+	}
+
+	raw, err := saveList(j.WhitelistFile, wl)
+
+	if err != nil {
+		log.Errorf("Unable to save whitelist: %s", err)
+
+		return err
+	}
+
+	prepareWhitelist(&wl)
+
+	j.WhiteList = wl
+	j.whitelistRaw = raw
+
+	return nil
+}
+
+// saveList атомарно записывает список в файл path и возвращает записанное. Перед каждой записью прежнее содержимое
+// файла копируется в path.bak, так что там всегда предыдущая версия, в том числе поправленная руками. Сам файл пишется
+// обычным json-ом: комментарии и прочие вольности hjson при этом теряются и остаются только в path.bak до следующей
+// правки, о чём пишем в лог.
+func saveList(path string, list interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	// Регулярки в файле должны остаться читаемыми, поэтому <, > и & не экранируем.
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "\t")
+
+	if err := enc.Encode(list); err != nil {
+		return nil, fmt.Errorf("unable to serialize %s: %w", path, err)
+	}
+
+	if old, err := os.ReadFile(path); err == nil && !json.Valid(old) {
+		log.Warnf("%s is not plain json, hjson comments are dropped from it and kept only in %s.bak", path, path)
+	}
+
+	if err := copyFile(path, path+".bak"); err != nil {
+		return nil, fmt.Errorf("unable to back up %s: %w", path, err)
+	}
+
+	if err := WriteFileAtomic(path, buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// auditListChange пишет в лог и журнал модерации, кто и как поменял список.
+func (j *Jabber) auditListChange(r *CmdRequest, action, room, rule, what string) {
+	if rule != "" {
+		log.Infof("%s in %s: %s (%s) by %s(%s)", action, roomTitle(room), what, rule, r.JID, r.Msg.Remote)
+	} else {
+		log.Infof("%s in %s: %s by %s(%s)", action, roomTitle(room), what, r.JID, r.Msg.Remote)
+	}
+
+	j.Audit(AuditRecord{ //nolint:exhaustruct
+		Room:   room,
+		Action: action,
+		Rule:   rule,
+		Why:    what,
+		By:     r.JID,
+	})
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,53 @@
+package jabber
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveListBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "whitelist.json")
+
+	steps := []struct {
+		// before - что оператор положил в файл руками перед правкой, пустое - ничего.
+		before string
+		list   MyWhiteList
+	}{
+		{"{\n\t# комментарий\n\twhitelist: []\n}\n", MyWhiteList{Whitelist: []WhiteListEntry{{RoomName: "a"}}}}, //nolint:exhaustruct
+		{"", MyWhiteList{Whitelist: []WhiteListEntry{{RoomName: "b"}}}},                                         //nolint:exhaustruct
+		{`{"whitelist": [{"room_name": "hand"}]}`, MyWhiteList{Whitelist: nil}},
+	}
+
+	var written []byte
+
+	for n, step := range steps {
+		want := written
+
+		if step.before != "" {
+			if err := os.WriteFile(path, []byte(step.before), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			want = []byte(step.before)
+		}
+
+		raw, err := saveList(path, step.list)
+
+		if err != nil {
+			t.Fatalf("step %d: %s", n, err)
+		}
+
+		if got, _ := os.ReadFile(path); string(got) != string(raw) {
+			t.Errorf("step %d: file is %q, want %q", n, got, raw)
+		}
+
+		if got, _ := os.ReadFile(path + ".bak"); string(got) != string(want) {
+			t.Errorf("step %d: backup is %q, want %q", n, got, want)
+		}
+
+		written = raw
+	}
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -6,22 +6,42 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// ResetState задаёт начальное значение глобальным переменным и загружает сохранённое состояние из state_dir.
+func (j *Jabber) ResetState() {
+	j.ServerPingTimestampRx = 0
+	j.ServerPingTimestampTx = 0
+	j.ServerPingSent = time.Time{}
+	j.ServerPingRTT = 0
+	j.RoomsConnected = make([]string, 1)
+	j.LastActivity = 0
+	j.LastServerActivity = 0
+	j.LastMucActivity = NewCollection()
+	j.ServerCapsQueried = false
+	j.ServerCapsList = NewCollection()
+	j.MucCapsList = NewCollection()
+	j.RoomPresences = NewCollection()
+	j.Actions = NewActionQueue(j.C.Jabber.ActionQueue.Size)
+	j.VersionQueries = NewCollection()
+	j.Occupants = NewCollection()
+	j.Reputations = NewCollection()
+	j.Nicks = NewCollection()
+	j.Mutes = NewCollection()
+	j.Scores = NewCollection()
+	j.TempBans = j.LoadTempBans()
+	j.TempMutes = j.LoadTempMutes()
+	j.RuleStats = j.LoadRuleStats()
+	j.TrackRules()
+	j.Modes = j.LoadModes()
+	j.Catchup = j.LoadCatchup()
+	j.Rooms = j.LoadRooms()
+	j.ApplyRooms()
+	j.Commands = NewCommandRegistry()
+}
+
 // MyLoop - основной цикл программы.
 func (j *Jabber) MyLoop() error {
 	for {
-		// Зададим начальное значение глобальным переменным
-		j.ServerPingTimestampRx = 0
-		j.ServerPingTimestampTx = 0
-		j.RoomsConnected = make([]string, 1)
-		j.LastActivity = 0
-		j.LastServerActivity = 0
-		j.LastMucActivity = NewCollection()
-		j.ServerCapsQueried = false
-		j.ServerCapsList = NewCollection()
-		j.MucCapsList = NewCollection()
-		j.ServerPingTimestampTx = 0
-		j.ServerPingTimestampRx = 0
-		j.RoomPresences = NewCollection()
+		j.ResetState()
 
 		// Установим коннект
 		if err := j.EstablishConnection(); err != nil {
@@ -30,6 +50,17 @@ func (j *Jabber) MyLoop() error {
 			return err
 		}
 
+		// Баны, кики и прочие действия выполняются воркерами, чтобы не блокировать приём событий.
+		for i := 0; i < j.C.Jabber.ActionQueue.Workers; i++ {
+			j.GTomb.Go(func() error { return j.ActionWorker() })
+		}
+
+		j.GTomb.Go(func() error { return j.LogActionQueueStats() })
+		j.GTomb.Go(func() error { return j.PruneScores() })
+		j.GTomb.Go(func() error { return j.TempBanWorker() })
+		j.GTomb.Go(func() error { return j.RuleStatsWorker() })
+		j.GTomb.Go(func() error { return j.CatchupWorker() })
+
 		j.ServerPingTimestampRx = time.Now().Unix() // Считаем, что если коннект запустился, то первый пинг успешен.
 
 		// Тыкаем сервер палочкой, проверяем, что коннект жив и вываливаемся из mainLoop, если он не жив.
@@ -72,6 +103,7 @@ func (j *Jabber) MyLoop() error {
 				return err
 			}
 
+			j.CaptureEvent(chat)
 			j.ParseEvent(chat)
 		}
 
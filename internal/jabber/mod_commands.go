@@ -0,0 +1,311 @@
+package jabber
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// registerModerationCommands добавляет в реестр команды ручной модерации: ban, unban, kick, mute и unmute. Комнату
+// можно указать первым аргументом, иначе берётся та, откуда пришла команда. Кроме bot_masters, команды доступны
+// владельцам, администраторам и модераторам комнаты, но только в ней.
+func registerModerationCommands(r *CommandRegistry) {
+	r.Register(&Command{ //nolint:exhaustruct
+		Name:       "ban",
+		Aliases:    []string{"бан"},
+		Usage:      "[room] <nick|jid> [duration] [reason]",
+		Help:       "ban occupant, for duration if given (90m, 12h, 3d, 2w)",
+		MinArgs:    1,
+		MaxArgs:    -1,
+		Permission: PermRoomAdmin,
+		Places:     CmdAnywhere,
+		Run:        (*Jabber).cmdBan,
+	})
+
+	r.Register(&Command{ //nolint:exhaustruct
+		Name:       "unban",
+		Aliases:    []string{"разбан"},
+		Usage:      "[room] <jid>",
+		Help:       "lift ban",
+		MinArgs:    1,
+		MaxArgs:    2,
+		Permission: PermRoomAdmin,
+		Places:     CmdAnywhere,
+		Run:        (*Jabber).cmdUnban,
+	})
+
+	r.Register(&Command{ //nolint:exhaustruct
+		Name:       "kick",
+		Aliases:    []string{"кик"},
+		Usage:      "[room] <nick> [reason]",
+		Help:       "kick occupant out of the room",
+		MinArgs:    1,
+		MaxArgs:    -1,
+		Permission: PermRoomAdmin,
+		Places:     CmdAnywhere,
+		Run:        (*Jabber).cmdKick,
+	})
+
+	r.Register(&Command{ //nolint:exhaustruct
+		Name:       "mute",
+		Aliases:    []string{"заткнуть"},
+		Usage:      "[room] <nick> [duration]",
+		Help:       "revoke voice, for duration if given",
+		MinArgs:    1,
+		MaxArgs:    3,
+		Permission: PermRoomAdmin,
+		Places:     CmdAnywhere,
+		Run:        (*Jabber).cmdMute,
+	})
+
+	r.Register(&Command{ //nolint:exhaustruct
+		Name:       "unmute",
+		Aliases:    []string{"отпустить"},
+		Usage:      "[room] <nick>",
+		Help:       "grant voice back",
+		MinArgs:    1,
+		MaxArgs:    2,
+		Permission: PermRoomAdmin,
+		Places:     CmdAnywhere,
+		Run:        (*Jabber).cmdUnmute,
+	})
+}
+
+// cmdRoom возвращает комнату, к которой относится команда, и оставшиеся аргументы. Если первый аргумент - комната из
+// конфига, то команда относится к ней, иначе - к комнате, откуда пришла команда.
+func (j *Jabber) cmdRoom(r *CmdRequest) (string, []string) {
+	if len(r.Args) > 1 && j.GetRoomConfig(r.Args[0]) != nil {
+		return r.Args[0], r.Args[1:]
+	}
+
+	return r.Room, r.Args
+}
+
+// resolveTarget находит участника комнаты room по нику или jid-у. Возвращает его полный ник вида
+// room@conference.server/nick (или просто room, если участника в комнате нет) и bare real jid, если он известен.
+func (j *Jabber) resolveTarget(room, target string) (string, string) {
+	fullNick := room + "/" + target
+
+	if o, known := j.GetOccupant(fullNick); known && o.JID != "" {
+		return fullNick, o.JID
+	}
+
+	if jid := j.GetRealJIDfromNick(fullNick); jid != "" {
+		return fullNick, strings.SplitN(jid, "/", 2)[0]
+	}
+
+	if !strings.Contains(target, "@") {
+		if _, found := j.GetPresence(fullNick); found {
+			return fullNick, ""
+		}
+
+		return room, ""
+	}
+
+	// Похоже на jid, поищем, под каким ником он сидит в комнате.
+	var (
+		bareJid = strings.SplitN(target, "/", 2)[0]
+		from    = room
+	)
+
+	j.Occupants.Range(func(_, value interface{}) bool {
+		if o := value.(*Occupant); o.JID == bareJid && strings.SplitN(o.From, "/", 2)[0] == room {
+			from = o.From
+
+			return false
+		}
+
+		return true
+	})
+
+	return from, bareJid
+}
+
+// untouchable сообщает, почему команда не будет применена к jid-у, или пустую строку, если будет. Ни себя, ни своих
+// мастеров бот не трогает.
+func (j *Jabber) untouchable(jid string) string {
+	switch {
+	case jid == strings.SplitN(j.Talk.JID(), "/", 2)[0]:
+		return "Not going to do that to myself"
+	case j.IsMaster(jid):
+		return fmt.Sprintf("Not going to do that to bot master %s", jid)
+	}
+
+	return ""
+}
+
+// targetIsAdmin сообщает, является ли цель команды (участник from или jid) владельцем, администратором или модератором
+// комнаты room. Если real jid участника неизвестен, то affiliation берётся из его presence-а.
+func (j *Jabber) targetIsAdmin(room, from, jid string) bool {
+	if j.IsRoomAdmin(room, jid) {
+		return true
+	}
+
+	p, found := j.GetPresence(from)
+
+	return found && (p.Affiliation == "owner" || p.Affiliation == "admin")
+}
+
+// manualAction применяет к участнику действие, отданное командой, тем же путём, что и автоматические действия. Режим
+// shadow ручные действия не касается. Если участника лишают голоса на время, то по истечении срока голос ему вернут.
+func (j *Jabber) manualAction(r *CmdRequest, from string, a ModAction) string {
+	if reason := j.untouchable(a.JID); reason != "" {
+		return reason
+	}
+
+	// Владельцев и администраторов комнаты бот руками её модераторов не трогает: действует-то он со своими правами,
+	// которых у модератора может и не быть.
+	if room := strings.SplitN(from, "/", 2)[0]; !j.IsMaster(r.JID) && j.targetIsAdmin(room, from, a.JID) {
+		return fmt.Sprintf("Only bot masters may do that to admins of %s", room)
+	}
+
+	a.By = r.JID
+	a.Mode = ModeEnforce
+	a.VType = "groupchat"
+	a.Why = "manual " + a.Action
+
+	if a.Duration > 0 {
+		a.Why += " for " + a.Duration.String()
+	}
+
+	log.Infof("Command %s%s: %s %s (%s) ordered by %s(%s)", j.C.CSign, r.Name, a.Action, from, a.JID, r.JID, r.Msg.Remote)
+
+	j.Sanction(from, a)
+
+	// Новый !mute или !unmute отменяет срок, назначенный прежним !mute.
+	if a.Action == "devoice" || a.Action == "voice" {
+		j.cancelMute(from, a.JID)
+	}
+
+	if a.Action == "devoice" && a.Duration > 0 {
+		j.scheduleUnmute(from, a)
+	}
+
+	return "Сделано"
+}
+
+// cmdBan банит участника комнаты по нику или jid-у, навсегда или на время.
+func (j *Jabber) cmdBan(r *CmdRequest) string {
+	room, args := j.cmdRoom(r)
+
+	if room == "" {
+		return r.Usage(j.C.CSign)
+	}
+
+	if !j.CmdRoomPermitted(r, room) {
+		return deniedAnswer
+	}
+
+	from, jid := j.resolveTarget(room, args[0])
+
+	if jid == "" {
+		return fmt.Sprintf("Unable to find real jid of %s in %s", args[0], room)
+	}
+
+	a := ModAction{JID: jid, Action: "ban"} //nolint:exhaustruct
+
+	if len(args) > 1 {
+		if d, err := ParseDuration(args[1]); err == nil {
+			a.Action = "tempban"
+			a.Duration = d
+			args = args[1:]
+		}
+	}
+
+	a.Reason = strings.Join(args[1:], " ")
+
+	return j.manualAction(r, from, a)
+}
+
+// cmdUnban снимает бан с jid-а.
+func (j *Jabber) cmdUnban(r *CmdRequest) string {
+	room, args := j.cmdRoom(r)
+
+	if room == "" || len(args) != 1 || !strings.Contains(args[0], "@") {
+		return r.Usage(j.C.CSign)
+	}
+
+	if !j.CmdRoomPermitted(r, room) {
+		return deniedAnswer
+	}
+
+	return j.manualAction(r, room, ModAction{JID: strings.SplitN(args[0], "/", 2)[0], Action: "unban"}) //nolint:exhaustruct
+}
+
+// cmdKick выгоняет участника из комнаты.
+func (j *Jabber) cmdKick(r *CmdRequest) string {
+	room, args := j.cmdRoom(r)
+
+	if room == "" {
+		return r.Usage(j.C.CSign)
+	}
+
+	if !j.CmdRoomPermitted(r, room) {
+		return deniedAnswer
+	}
+
+	from, jid := j.resolveTarget(room, args[0])
+
+	if from == room {
+		return fmt.Sprintf("There is no %s in %s", args[0], room)
+	}
+
+	return j.manualAction(r, from, ModAction{JID: jid, Action: "kick", Reason: strings.Join(args[1:], " ")}) //nolint:exhaustruct
+}
+
+// cmdMute лишает участника голоса, навсегда или на время. Голос участник получит обратно и при перезаходе в комнату.
+func (j *Jabber) cmdMute(r *CmdRequest) string {
+	room, args := j.cmdRoom(r)
+
+	if room == "" || len(args) > 2 {
+		return r.Usage(j.C.CSign)
+	}
+
+	if !j.CmdRoomPermitted(r, room) {
+		return deniedAnswer
+	}
+
+	from, jid := j.resolveTarget(room, args[0])
+
+	if from == room {
+		return fmt.Sprintf("There is no %s in %s", args[0], room)
+	}
+
+	a := ModAction{JID: jid, Action: "devoice"} //nolint:exhaustruct
+
+	if len(args) == 2 {
+		d, err := ParseDuration(args[1])
+
+		if err != nil {
+			return fmt.Sprint(err)
+		}
+
+		a.Duration = d
+	}
+
+	return j.manualAction(r, from, a)
+}
+
+// cmdUnmute возвращает участнику голос.
+func (j *Jabber) cmdUnmute(r *CmdRequest) string {
+	room, args := j.cmdRoom(r)
+
+	if room == "" || len(args) != 1 {
+		return r.Usage(j.C.CSign)
+	}
+
+	if !j.CmdRoomPermitted(r, room) {
+		return deniedAnswer
+	}
+
+	from, jid := j.resolveTarget(room, args[0])
+
+	if from == room {
+		return fmt.Sprintf("There is no %s in %s", args[0], room)
+	}
+
+	return j.manualAction(r, from, ModAction{JID: jid, Action: "voice"}) //nolint:exhaustruct
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,264 @@
+package jabber
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eleksir/go-xmpp"
+	log "github.com/sirupsen/logrus"
+)
+
+// modesState - имя файла состояния с режимами, переключёнными командой.
+const modesState = "modes.json"
+
+// Режимы работы комнаты или правила. В режиме shadow бот ничего не делает с участниками, а только пишет в лог и
+// журнал модерации и сообщает bot_masters, что бы он сделал.
+const (
+	ModeEnforce = "enforce"
+	ModeShadow  = "shadow"
+)
+
+// Отчёты о действиях в режиме shadow копятся shadowReportDelay и уходят bot_masters одним сообщением, в котором не
+// больше shadowReportLines строк. Во время набега иначе каждому мастеру пришло бы по сообщению на каждое действие.
+const (
+	shadowReportDelay = 30 * time.Second
+	shadowReportLines = 20
+)
+
+// ModeList - режимы комнат и правил, переключённые командой. Они перекрывают режимы из конфига и чёрного списка и
+// сохраняются в state_dir, чтобы переживать перезапуск бота.
+type ModeList struct {
+	mu sync.Mutex
+
+	// Rooms - режимы комнат, Rules - режимы правил чёрного списка, по id правила.
+	Rooms map[string]string `json:"rooms,omitempty"`
+	Rules map[string]string `json:"rules,omitempty"`
+
+	// reports - ещё не отправленные bot_masters отчёты о действиях в режиме shadow.
+	reports []string
+}
+
+// validMode сообщает, является ли mode допустимым режимом. Пустой режим означает "как у комнаты" или "как в конфиге".
+func validMode(mode string) bool {
+	return mode == "" || mode == ModeEnforce || mode == ModeShadow
+}
+
+// LoadModes загружает переключённые командой режимы из state_dir.
+func (j *Jabber) LoadModes() *ModeList {
+	l := &ModeList{Rooms: make(map[string]string), Rules: make(map[string]string)} //nolint:exhaustruct
+
+	if err := j.LoadState(modesState, l); err != nil {
+		log.Errorf("Unable to load room and rule modes, using modes from config: %s", err)
+	}
+
+	if l.Rooms == nil {
+		l.Rooms = make(map[string]string)
+	}
+
+	if l.Rules == nil {
+		l.Rules = make(map[string]string)
+	}
+
+	return l
+}
+
+// RoomMode возвращает режим комнаты: переключённый командой, либо заданный в конфиге, либо enforce.
+func (j *Jabber) RoomMode(room string) string {
+	if j.Modes != nil {
+		j.Modes.mu.Lock()
+		mode := j.Modes.Rooms[room]
+		j.Modes.mu.Unlock()
+
+		if mode != "" {
+			return mode
+		}
+	}
+
+	if channel := j.GetRoomConfig(room); channel != nil && channel.Mode != "" {
+		return channel.Mode
+	}
+
+	return ModeEnforce
+}
+
+// RuleMode возвращает режим правила rule из записи чёрного списка bEntry: переключённый командой, либо заданный в
+// записи. Пустая строка означает, что у правила своего режима нет и действует режим комнаты.
+func (j *Jabber) RuleMode(bEntry BlackListEntry, rule string) string {
+	if j.Modes != nil {
+		j.Modes.mu.Lock()
+		mode := j.Modes.Rules[rule]
+		j.Modes.mu.Unlock()
+
+		if mode != "" {
+			return mode
+		}
+	}
+
+	return bEntry.Mode
+}
+
+// SetMode переключает режим комнаты или правила. target - имя комнаты или id правила, пустой mode возвращает режим
+// из конфига. Комната должна быть в конфиге, а правило - в чёрном списке, иначе опечатка выглядела бы как успешно
+// переключённый режим. Вернуть режим по-умолчанию можно и для забытой комнаты или правила, чтобы их можно было убрать из
+// modes.json.
+func (j *Jabber) SetMode(target, mode string) error {
+	if !validMode(mode) {
+		return fmt.Errorf("unknown mode %s, use %s or %s", mode, ModeShadow, ModeEnforce) //nolint:goerr113
+	}
+
+	j.Modes.mu.Lock()
+	defer j.Modes.mu.Unlock()
+
+	var (
+		room  = strings.Contains(target, "@")
+		modes = j.Modes.Rules
+	)
+
+	if room {
+		modes = j.Modes.Rooms
+	}
+
+	if _, switched := modes[target]; !switched || mode != "" {
+		switch {
+		case room && j.GetRoomConfig(target) == nil:
+			return fmt.Errorf("there is no room %s in config", target) //nolint:goerr113
+		case !room && !j.knownRule(target):
+			return fmt.Errorf("there is no rule %s in blacklist, see %sbl list", target, j.C.CSign) //nolint:goerr113
+		}
+	}
+
+	if mode == "" {
+		delete(modes, target)
+	} else {
+		modes[target] = mode
+	}
+
+	if err := j.SaveState(modesState, j.Modes); err != nil {
+		return fmt.Errorf("mode is switched, but will be lost after restart: %w", err)
+	}
+
+	return nil
+}
+
+// knownRule сообщает, есть ли в чёрном списке правило с id rule (см. RuleID).
+func (j *Jabber) knownRule(rule string) bool {
+	for n := range j.BlackList.Blacklist {
+		bEntry := &j.BlackList.Blacklist[n]
+
+		for _, r := range bEntry.rules() {
+			if RuleID(bEntry.RoomName, r.kind, r.pattern) == rule {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// DescribeModes возвращает режимы всех комнат и переключённые командой режимы правил.
+func (j *Jabber) DescribeModes() string {
+	var lines []string
+
+	for _, channel := range j.C.Jabber.Channels {
+		lines = append(lines, fmt.Sprintf("%s: %s", channel.Name, j.RoomMode(channel.Name)))
+	}
+
+	j.Modes.mu.Lock()
+
+	rules := make([]string, 0, len(j.Modes.Rules))
+
+	for rule, mode := range j.Modes.Rules {
+		rules = append(rules, fmt.Sprintf("rule %s: %s", rule, mode))
+	}
+
+	j.Modes.mu.Unlock()
+
+	sort.Strings(rules)
+
+	return strings.Join(append(lines, rules...), "\n")
+}
+
+// Shadow обрабатывает действие a в режиме shadow: вместо того чтобы что-то делать с участником, пишет в лог и журнал
+// модерации, что бы бот сделал, и сообщает об этом bot_masters. Сообщения копятся и отправляются пачкой, см.
+// shadowReportDelay.
+func (j *Jabber) Shadow(from string, a ModAction) {
+	action := a.Action
+
+	if action == "ban" && a.Duration > 0 {
+		action = "tempban"
+	}
+
+	if a.Duration > 0 {
+		action += " for " + a.Duration.String()
+	}
+
+	who := from
+
+	if a.JID != "" {
+		who = fmt.Sprintf("%s (%s)", from, a.JID)
+	}
+
+	text := fmt.Sprintf("Shadow mode: would %s %s for %s", action, who, a.Why)
+
+	log.Info(text)
+
+	a.Mode = ModeShadow
+	j.AuditAction(a)
+
+	l := j.Modes
+
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	l.reports = append(l.reports, strings.TrimPrefix(text, "Shadow mode: "))
+	first := len(l.reports) == 1
+	l.mu.Unlock()
+
+	// При прогоне записи ждать некогда, отчёт нужен сразу.
+	if j.Replaying {
+		j.sendShadowReports(l)
+
+		return
+	}
+
+	// Первый отчёт в пачке заводит таймер, остальные просто ждут его.
+	if first {
+		time.AfterFunc(shadowReportDelay, func() { j.InEventLoop(func() { j.sendShadowReports(l) }) })
+	}
+}
+
+// sendShadowReports отправляет bot_masters накопленные в l отчёты о действиях в режиме shadow одним сообщением.
+func (j *Jabber) sendShadowReports(l *ModeList) {
+	l.mu.Lock()
+	reports := l.reports
+	l.reports = nil
+	l.mu.Unlock()
+
+	if len(reports) == 0 || !j.IsConnected {
+		return
+	}
+
+	lines := []string{"Shadow mode:"}
+
+	if len(reports) > shadowReportLines {
+		lines = append(lines, reports[:shadowReportLines]...)
+		lines = append(lines, fmt.Sprintf("... and %d more, see audit log", len(reports)-shadowReportLines))
+	} else {
+		lines = append(lines, reports...)
+	}
+
+	text := strings.Join(lines, "\n")
+
+	for _, master := range j.C.Jabber.BotMasters {
+		if _, err := j.Talk.Send(xmpp.Chat{Remote: master, Type: "chat", Text: text}); err != nil { //nolint:exhaustruct
+			log.Errorf("Unable to send shadow mode report to %s: %s", master, err)
+		}
+	}
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,214 @@
+package jabber
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/eleksir/go-xmpp"
+	log "github.com/sirupsen/logrus"
+)
+
+// Occupant - то, что бот знает об участнике комнаты: когда зашёл, каким клиентом пользуется и что этот клиент умеет.
+type Occupant struct {
+	// From - полный ник участника вида room@conference.server/nick.
+	From string
+
+	// JID - bare jid участника, если известен.
+	JID string
+
+	// Status - текст статуса из последнего presence-а.
+	Status string
+
+	// Affiliation и Role - affiliation и роль участника в комнате из последнего presence-а.
+	Affiliation string
+	Role        string
+
+	// Joined - когда участник зашёл в комнату (или когда бот впервые его увидел).
+	Joined time.Time
+
+	// Client - ответ на запрос версии клиента, если он был.
+	Client IqResultSoftwareVersion
+
+	// Caps - список фич клиента из ответа на disco#info.
+	Caps []string
+
+	// LastMessage - последнее сообщение участника вместе с цепочкой его исправлений.
+	LastMessage MessageChain
+
+	// Edits - когда участник исправлял свои сообщения, за последние corrections.window секунд.
+	Edits []time.Time
+
+	// Messages - stanza-id последних retract.on_ban сообщений участника, от старых к новым.
+	Messages []string
+}
+
+// Age возвращает, как давно участник в комнате.
+func (o *Occupant) Age() time.Duration {
+	return time.Since(o.Joined)
+}
+
+// GetOccupant возвращает копию сведений об участнике комнаты по полному nick-у.
+func (j *Jabber) GetOccupant(fullNick string) (Occupant, bool) {
+	value, exist := j.Occupants.Get(fullNick)
+
+	if !exist {
+		return Occupant{}, false //nolint:exhaustruct
+	}
+
+	return *value.(*Occupant), true
+}
+
+// UpdateOccupant изменяет сведения об участнике комнаты. Если участника ещё нет, то он заводится.
+// Сведения не меняются на месте, а заменяются целиком, поэтому полученные ранее GetOccupant-ом копии остаются
+// консистентными.
+func (j *Jabber) UpdateOccupant(fullNick string, f func(o *Occupant)) {
+	o := Occupant{From: fullNick, Joined: time.Now()} //nolint:exhaustruct
+
+	if value, exist := j.Occupants.Get(fullNick); exist {
+		o = *value.(*Occupant)
+	}
+
+	f(&o)
+
+	j.Occupants.Set(fullNick, &o)
+}
+
+// TrackOccupantPresence обновляет сведения об участнике по его presence-у. Возвращает true, если участник новый.
+func (j *Jabber) TrackOccupantPresence(v xmpp.Presence) bool {
+	if v.Role == "none" || v.Type == "unavailable" {
+		j.Occupants.Delete(v.From)
+
+		return false
+	}
+
+	_, known := j.GetOccupant(v.From)
+
+	j.UpdateOccupant(v.From, func(o *Occupant) {
+		if v.JID != "" {
+			o.JID = strings.SplitN(v.JID, "/", 2)[0]
+		}
+
+		o.Status = v.Status
+		o.Affiliation = v.Affiliation
+		o.Role = v.Role
+	})
+
+	if o, _ := j.GetOccupant(v.From); o.JID != "" {
+		if n := strings.SplitN(v.From, "/", 2); len(n) > 1 {
+			j.TrackNick(o.JID, n[1])
+		}
+	}
+
+	// Узнаем, что умеет клиент нового участника, если это нужно правилам комнаты. Ответ придёт в виде DiscoResult-а.
+	// Спрашивать всех подряд не стоит: при заходе в большую комнату или при набеге это сотни запросов разом.
+	if !known && j.CapsWanted(strings.SplitN(v.From, "/", 2)[0]) {
+		if _, err := j.Talk.DiscoverInfo(j.Talk.JID(), v.From); err != nil {
+			log.Errorf("Unable to send disco#info to %s: %s", v.From, err)
+		}
+	}
+
+	return !known
+}
+
+// CapsWanted сообщает, обращается ли к полю caps хоть одно выражение чёрного списка, действующее в комнате room.
+func (j *Jabber) CapsWanted(room string) bool {
+	for _, bEntry := range j.BlackList.Blacklist {
+		if bEntry.RoomName != "" && bEntry.RoomName != room {
+			continue
+		}
+
+		for _, expr := range bEntry.exprs {
+			if expr.Uses("caps") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// NewExprEnv собирает значения полей для выражений чёрного списка. from - полный ник участника, jid - его real jid,
+// если известен, text - текст сообщения, если выражение вычисляется для сообщения.
+func (j *Jabber) NewExprEnv(from, jid, text string) *ExprEnv {
+	var (
+		o, _    = j.GetOccupant(from)
+		bareJid = strings.SplitN(jid, "/", 2)[0]
+		env     = &ExprEnv{ //nolint:exhaustruct
+			JID:           bareJid,
+			Status:        o.Status,
+			ClientName:    o.Client.Name,
+			ClientVersion: o.Client.Version,
+			ClientOs:      o.Client.Os,
+			Caps:          o.Caps,
+			Text:          text,
+			Reputation:    j.Reputation(bareJid),
+		}
+	)
+
+	if n := strings.SplitN(from, "/", 2); len(n) > 1 {
+		env.Nick = n[1]
+	}
+
+	if at := strings.LastIndex(bareJid, "@"); at >= 0 {
+		env.Domain = bareJid[at+1:]
+	} else {
+		env.Domain = bareJid
+	}
+
+	if !o.Joined.IsZero() {
+		env.Age = o.Age()
+	}
+
+	return env
+}
+
+// Reputation возвращает репутацию участника: количество сообщений, отправленных им с подключения бота и не вызвавших
+// никаких санкций. Репутация привязана к bare jid-у, поэтому переживает перезаход в комнату.
+func (j *Jabber) Reputation(bareJid string) int {
+	if bareJid == "" {
+		return 0
+	}
+
+	if value, exist := j.Reputations.Get(bareJid); exist {
+		return value.(int)
+	}
+
+	return 0
+}
+
+// maxNickHistory - сколько последних ников участника помнит бот.
+const maxNickHistory = 10
+
+// TrackNick запоминает ник, под которым участник с bare jid-ом bareJid зашёл в какую-нибудь из комнат. Помнятся
+// maxNickHistory последних разных ников, история, как и репутация, живёт до реконнекта.
+func (j *Jabber) TrackNick(bareJid, nick string) {
+	nicks := slices.DeleteFunc(j.NickHistory(bareJid), func(n string) bool { return n == nick })
+	nicks = append(nicks, nick)
+
+	if len(nicks) > maxNickHistory {
+		nicks = nicks[len(nicks)-maxNickHistory:]
+	}
+
+	j.Nicks.Set(bareJid, nicks)
+}
+
+// NickHistory возвращает копию списка ников участника, от старых к новым.
+func (j *Jabber) NickHistory(bareJid string) []string {
+	if value, exist := j.Nicks.Get(bareJid); exist {
+		return slices.Clone(value.([]string))
+	}
+
+	return nil
+}
+
+// GainReputation увеличивает репутацию участника на единицу.
+func (j *Jabber) GainReputation(bareJid string) {
+	if bareJid == "" {
+		return
+	}
+
+	j.Reputations.Set(bareJid, j.Reputation(bareJid)+1)
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
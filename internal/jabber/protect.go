@@ -0,0 +1,189 @@
+package jabber
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/eleksir/go-xmpp"
+	log "github.com/sirupsen/logrus"
+)
+
+// MyProtect прототип структурки с политикой неприкосновенности: кого из участников комнаты бот не трогает, что бы ни
+// сработало.
+type MyProtect struct {
+	// Affiliations - неприкосновенные affiliation-ы, по-умолчанию owner и admin.
+	Affiliations []string `json:"affiliations"`
+
+	// Roles - неприкосновенные роли, по-умолчанию moderator.
+	Roles []string `json:"roles"`
+
+	// Jids - неприкосновенные jid-ы, в том же формате, что и в белом списке: bare jid, "*@domain.tld", "domain.tld"
+	// или "/регулярка/".
+	Jids []string `json:"jids"`
+
+	// Patterns - регулярки для bare jid-ов неприкосновенных участников.
+	Patterns []string `json:"patterns"`
+
+	// jids - скомпилированные при чтении конфига Jids.
+	jids []*JidPattern
+
+	// patterns - скомпилированные при чтении конфига Patterns.
+	patterns []*regexp.Regexp
+}
+
+// setProtectDefaults проставляет значения по-умолчанию для политики неприкосновенности. Не заданные в настройках
+// комнаты списки берутся из глобальной политики def, если она есть. Явно заданный пустой список означает "никого".
+func setProtectDefaults(p *MyProtect, def *MyProtect) {
+	if def == nil {
+		def = &MyProtect{ //nolint:exhaustruct
+			Affiliations: []string{"owner", "admin"},
+			Roles:        []string{"moderator"},
+			Jids:         []string{},
+			Patterns:     []string{},
+		}
+	}
+
+	if p.Affiliations == nil {
+		p.Affiliations = def.Affiliations
+	}
+
+	if p.Roles == nil {
+		p.Roles = def.Roles
+	}
+
+	if p.Jids == nil {
+		p.Jids = def.Jids
+	}
+
+	if p.Patterns == nil {
+		p.Patterns = def.Patterns
+	}
+}
+
+// compile компилирует шаблоны и регулярки политики неприкосновенности.
+func (p *MyProtect) compile() error {
+	p.jids = make([]*JidPattern, 0, len(p.Jids))
+
+	for _, jid := range p.Jids {
+		pattern, err := CompileJidPattern(jid, "")
+
+		if err != nil {
+			return err
+		}
+
+		p.jids = append(p.jids, pattern)
+	}
+
+	p.patterns = make([]*regexp.Regexp, 0, len(p.Patterns))
+
+	for _, pattern := range p.Patterns {
+		re, err := regexp.Compile(pattern)
+
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+
+		p.patterns = append(p.patterns, re)
+	}
+
+	return nil
+}
+
+// GetRoomProtect возвращает политику неприкосновенности для комнаты. Если комната в конфиге не описана, возвращает
+// глобальную политику.
+func (j *Jabber) GetRoomProtect(room string) *MyProtect {
+	if channel := j.GetRoomConfig(room); channel != nil {
+		return &channel.Protect
+	}
+
+	return &j.C.Jabber.Protect
+}
+
+// IsProtected решает, можно ли применять санкции к участнику комнаты. p - presence участника, достаточно полей From,
+// JID, Affiliation и Role. Путь, по которому принято решение, пишется в лог.
+func (j *Jabber) IsProtected(p xmpp.Presence) bool {
+	var (
+		room    = strings.SplitN(p.From, "/", 2)[0]
+		bareJid = strings.SplitN(p.JID, "/", 2)[0]
+		protect = j.GetRoomProtect(room)
+	)
+
+	log.Debugf(
+		"Checking protection of %s (%s) in %s: affiliation=%s, role=%s",
+		p.From, bareJid, room, p.Affiliation, p.Role,
+	)
+
+	// Себя никогда не трогаем.
+	if p.JID != "" && bareJid == strings.SplitN(j.Talk.JID(), "/", 2)[0] {
+		log.Debugf("%s is protected: this is me", p.From)
+
+		return true
+	}
+
+	if p.Affiliation != "" && slices.Contains(protect.Affiliations, p.Affiliation) {
+		log.Infof("%s (%s) is protected in %s: affiliation %s", p.From, bareJid, room, p.Affiliation)
+
+		return true
+	}
+
+	if p.Role != "" && slices.Contains(protect.Roles, p.Role) {
+		log.Infof("%s (%s) is protected in %s: role %s", p.From, bareJid, room, p.Role)
+
+		return true
+	}
+
+	// Без real jid-а дальше проверять нечего.
+	if bareJid == "" {
+		log.Debugf("%s is not protected in %s: real jid is unknown", p.From, room)
+
+		return false
+	}
+
+	for _, pattern := range protect.jids {
+		if pattern.Match(bareJid) {
+			log.Infof("%s (%s) is protected in %s: jid matches protect entry %s", p.From, bareJid, room, pattern)
+
+			return true
+		}
+	}
+
+	for _, re := range protect.patterns {
+		if re.MatchString(bareJid) {
+			log.Infof("%s (%s) is protected in %s: jid matches protect pattern %s", p.From, bareJid, room, re)
+
+			return true
+		}
+	}
+
+	if j.IsWhitelisted(room, bareJid) {
+		log.Infof("%s (%s) is protected in %s: jid is whitelisted", p.From, bareJid, room)
+
+		return true
+	}
+
+	log.Debugf("%s (%s) is not protected in %s", p.From, bareJid, room)
+
+	return false
+}
+
+// IsWhitelisted проверяет, подходит ли bare jid под шаблоны глобального белого списка или белого списка комнаты.
+func (j *Jabber) IsWhitelisted(room, bareJid string) bool {
+	for _, good := range j.WhiteList.Whitelist {
+		if good.RoomName != "" && good.RoomName != room {
+			continue
+		}
+
+		for _, pattern := range good.jids {
+			if pattern.Match(bareJid) {
+				log.Debugf("%s matches whitelist entry %s for room %q", bareJid, pattern, good.RoomName)
+
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
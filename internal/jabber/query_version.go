@@ -2,12 +2,31 @@ package jabber
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/eleksir/go-xmpp"
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 )
 
+// PendingVersionQuery - отправленный, но ещё не отвеченный запрос jabber:iq:version.
+type PendingVersionQuery struct {
+	// Room - комната, в которой находится участник.
+	Room string
+
+	// From - полный ник участника, вида room@conference.server/nick, ему и был отправлен запрос.
+	From string
+
+	// JID - real jid участника, если он известен.
+	JID string
+
+	// Sent - когда был отправлен запрос.
+	Sent time.Time
+
+	timer *time.Timer
+}
+
 // QuerySoftwareVersion запрошивает версию и название клиента.
 func (j *Jabber) QuerySoftwareVersion(jid string) (string, error) {
 	var (
@@ -34,3 +53,115 @@ func (j *Jabber) QuerySoftwareVersion(jid string) (string, error) {
 
 	return id, err
 }
+
+// IsSoftwareVersionPending сообщает, ждём ли мы уже ответа на запрос версии от данного участника комнаты.
+func (j *Jabber) IsSoftwareVersionPending(from string) bool {
+	pending := false
+
+	j.VersionQueries.Range(func(_, value interface{}) bool {
+		if value.(*PendingVersionQuery).From == from {
+			pending = true
+
+			return false
+		}
+
+		return true
+	})
+
+	return pending
+}
+
+// WaitSoftwareVersion запоминает отправленный запрос версии и заводит таймер, по истечении которого к участнику,
+// так и не ответившему на запрос, применяется политика no_answer комнаты.
+func (j *Jabber) WaitSoftwareVersion(id string, v xmpp.Presence) {
+	var (
+		room    = strings.SplitN(v.From, "/", 2)[0]
+		timeout = 30 * time.Second
+	)
+
+	if channel := j.GetRoomConfig(room); channel != nil {
+		timeout = time.Duration(channel.VersionQuery.Timeout) * time.Second
+	}
+
+	q := &PendingVersionQuery{
+		Room:  room,
+		From:  v.From,
+		JID:   strings.SplitN(v.JID, "/", 2)[0],
+		Sent:  time.Now(),
+		timer: nil,
+	}
+
+	j.VersionQueries.Set(id, q)
+
+	q.timer = time.AfterFunc(timeout, func() { j.InEventLoop(func() { j.softwareVersionTimeout(id) }) })
+}
+
+// SoftwareVersionAnswered снимает запрос версии с ожидания. Возвращает запомненный запрос и true, если запрос с таким id
+// был отправлен нами и ещё ждал ответа. Если ответ и таймаут пришли одновременно, запрос достанется только одному.
+func (j *Jabber) SoftwareVersionAnswered(id string) (*PendingVersionQuery, bool) {
+	value, exist := j.VersionQueries.GetAndDelete(id)
+
+	if !exist {
+		return nil, false
+	}
+
+	q := value.(*PendingVersionQuery)
+
+	if q.timer != nil {
+		q.timer.Stop()
+	}
+
+	return q, true
+}
+
+// ForgetSoftwareVersion снимает с ожидания запросы версии, отправленные участнику from, например, когда он ушёл из
+// комнаты.
+func (j *Jabber) ForgetSoftwareVersion(from string) {
+	j.VersionQueries.Range(func(key, value interface{}) bool {
+		if value.(*PendingVersionQuery).From == from {
+			j.SoftwareVersionAnswered(key.(string))
+		}
+
+		return true
+	})
+}
+
+// softwareVersionTimeout вызывается по таймеру, если участник так и не ответил на запрос версии.
+func (j *Jabber) softwareVersionTimeout(id string) {
+	// Соединение уже переустанавливается, действовать от имени старого соединения не надо.
+	select {
+	case <-j.GTomb.Dying():
+		return
+	default:
+	}
+
+	q, exist := j.SoftwareVersionAnswered(id)
+
+	if !exist {
+		return
+	}
+
+	channel := j.GetRoomConfig(q.Room)
+
+	if channel == nil {
+		return
+	}
+
+	j.ApplyVersionPolicy(
+		q,
+		channel.VersionQuery.NoAnswer,
+		fmt.Sprintf("no answer in %s", time.Since(q.Sent).Round(time.Second)),
+	)
+}
+
+// ApplyVersionPolicy применяет к участнику действие, заданное политикой запроса версии: ignore, log, devoice, kick или
+// ban. why - человекочитаемая причина, она попадает в лог.
+func (j *Jabber) ApplyVersionPolicy(q *PendingVersionQuery, policy, why string) {
+	if policy == "ignore" {
+		return
+	}
+
+	j.Punish(q.From, q.JID, policy, "software version query "+why)
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/hjson/hjson-go"
 	log "github.com/sirupsen/logrus"
@@ -28,14 +29,7 @@ func (j *Jabber) ReadConfig() error { //nolint:gocognit,gocyclo
 		return err
 	}
 
-	configJSONPath := fmt.Sprintf("%s/data/config.json", filepath.Dir(executablePath))
-
-	locations := []string{
-		"~/.buny-jabber-bot.json",
-		"~/buny-jabber-bot.json",
-		"/etc/buny-jabber-bot.json",
-		configJSONPath,
-	}
+	locations := ConfigLocations(executablePath)
 
 	for _, location := range locations {
 		fileInfo, err := os.Stat(location)
@@ -93,188 +87,407 @@ func (j *Jabber) ReadConfig() error { //nolint:gocognit,gocyclo
 			continue
 		}
 
-		// Значения для Jabber-клиента
-		if sampleConfig.Jabber.Server == "" {
-			log.Error("Jabber server is not defined in config, using localhost")
-			sampleConfig.Jabber.Server = "localhost" //nolint:wsl
+		if err := prepareConfig(&sampleConfig, filepath.Dir(executablePath)); err != nil {
+			return err
 		}
 
-		if sampleConfig.Jabber.Port == 0 {
-			sampleConfig.Jabber.Port = 5222
+		if err := os.MkdirAll(sampleConfig.Jabber.StateDir, 0o750); err != nil {
+			return fmt.Errorf("unable to create state dir %s: %w", sampleConfig.Jabber.StateDir, err)
+		}
+
+		j.C = sampleConfig
+		configLoaded = true
+
+		log.Infof("Using %s as config file", location)
+
+		break
+	}
+
+	if !configLoaded {
+		return errors.New("config was not loaded") //nolint:goerr113
+	}
 
-			if sampleConfig.Jabber.Ssl {
-				if !sampleConfig.Jabber.StartTLS {
-					sampleConfig.Jabber.Port = 5223
+	return err //nolint:wrapcheck
+}
 
-					log.Info("Jabber port is not defined in config, using 5223")
-				} else {
-					log.Info("Jabber port is not defined in config, using 5222")
-				}
+// ConfigLocations возвращает, где и в каком порядке искать конфиг. executablePath - путь к бинарнику бота.
+func ConfigLocations(executablePath string) []string {
+	return []string{
+		"~/.buny-jabber-bot.json",
+		"~/buny-jabber-bot.json",
+		"/etc/buny-jabber-bot.json",
+		fmt.Sprintf("%s/data/config.json", filepath.Dir(executablePath)),
+	}
+}
+
+// prepareConfig валидирует прочитанный конфиг и выставляет default-ы. exeDir - каталог, где лежит бинарник бота, от
+// него считается state_dir по-умолчанию. Ничего, кроме самого конфига, не трогает, поэтому годится и для проверки
+// конфига командой check.
+func prepareConfig(sampleConfig *MyConfig, exeDir string) error { //nolint:gocognit,gocyclo,cyclop,maintidx
+	var err error
+
+	// Значения для Jabber-клиента
+	if sampleConfig.Jabber.Server == "" {
+		log.Error("Jabber server is not defined in config, using localhost")
+		sampleConfig.Jabber.Server = "localhost" //nolint:wsl
+	}
+
+	if sampleConfig.Jabber.Port == 0 {
+		sampleConfig.Jabber.Port = 5222
+
+		if sampleConfig.Jabber.Ssl {
+			if !sampleConfig.Jabber.StartTLS {
+				sampleConfig.Jabber.Port = 5223
+
+				log.Info("Jabber port is not defined in config, using 5223")
+			} else {
+				log.Info("Jabber port is not defined in config, using 5222")
 			}
 		}
+	}
 
-		if !sampleConfig.Jabber.Ssl {
-			sampleConfig.Jabber.StartTLS = false
-		}
+	if !sampleConfig.Jabber.Ssl {
+		sampleConfig.Jabber.StartTLS = false
+	}
 
-		if !sampleConfig.Jabber.Ssl || !sampleConfig.Jabber.StartTLS {
-			sampleConfig.Jabber.SslVerify = false
-		}
+	if !sampleConfig.Jabber.Ssl || !sampleConfig.Jabber.StartTLS {
+		sampleConfig.Jabber.SslVerify = false
+	}
 
-		// sampleConfig.Jabber.InsecureAllowUnencryptedAuth = false, если не задан
+	// sampleConfig.Jabber.InsecureAllowUnencryptedAuth = false, если не задан
 
-		if sampleConfig.Jabber.ConnectionTimeout == 0 {
-			sampleConfig.Jabber.ConnectionTimeout = 10
+	if sampleConfig.Jabber.ConnectionTimeout == 0 {
+		sampleConfig.Jabber.ConnectionTimeout = 10
 
-			log.Info("Jabber server connection_timeout not defined in config, using 10 seconds")
-		}
+		log.Info("Jabber server connection_timeout not defined in config, using 10 seconds")
+	}
 
-		if sampleConfig.Jabber.ReconnectDelay == 0 {
-			sampleConfig.Jabber.ReconnectDelay = 3
+	if sampleConfig.Jabber.ReconnectDelay == 0 {
+		sampleConfig.Jabber.ReconnectDelay = 3
 
-			log.Info("Jabber server reconnect_delay not defined in config, using 3 seconds")
-		}
+		log.Info("Jabber server reconnect_delay not defined in config, using 3 seconds")
+	}
 
-		if sampleConfig.Jabber.ServerPingDelay == 0 {
-			sampleConfig.Jabber.ServerPingDelay = 60
+	if sampleConfig.Jabber.ServerPingDelay == 0 {
+		sampleConfig.Jabber.ServerPingDelay = 60
 
-			log.Info("Jabber server_ping_delay not defined in config, using 60 seconds")
-		}
+		log.Info("Jabber server_ping_delay not defined in config, using 60 seconds")
+	}
 
-		if sampleConfig.Jabber.MucPingDelay == 0 {
-			sampleConfig.Jabber.MucPingDelay = 900
+	if sampleConfig.Jabber.MucPingDelay == 0 {
+		sampleConfig.Jabber.MucPingDelay = 900
 
-			log.Info("Jabber muc_ping_delay not defined in config, using 900 seconds")
-		}
+		log.Info("Jabber muc_ping_delay not defined in config, using 900 seconds")
+	}
 
-		if sampleConfig.Jabber.MucRejoinDelay == 0 {
-			sampleConfig.Jabber.MucRejoinDelay = 3
+	if sampleConfig.Jabber.MucRejoinDelay == 0 {
+		sampleConfig.Jabber.MucRejoinDelay = 3
 
-			log.Info("Jabber muc_rejoin_delay not defined in config, using 3 seconds")
-		}
+		log.Info("Jabber muc_rejoin_delay not defined in config, using 3 seconds")
+	}
 
-		if sampleConfig.Jabber.PingSplayDelay == 0 {
-			sampleConfig.Jabber.PingSplayDelay = 3
+	if sampleConfig.Jabber.PingSplayDelay == 0 {
+		sampleConfig.Jabber.PingSplayDelay = 3
 
-			log.Info("Jabber ping_splay_delay not defined in config, using 3 seconds")
-		}
+		log.Info("Jabber ping_splay_delay not defined in config, using 3 seconds")
+	}
 
-		if sampleConfig.Jabber.Nick == "" {
-			return errors.New("jabber nick is not defined in config, quitting") //nolint:goerr113
-		}
+	if sampleConfig.Jabber.Nick == "" {
+		return errors.New("jabber nick is not defined in config, quitting") //nolint:goerr113
+	}
 
-		if sampleConfig.Jabber.Resource == "" {
-			sampleConfig.Jabber.Resource = "bunyPresense bot"
+	if sampleConfig.Jabber.Resource == "" {
+		sampleConfig.Jabber.Resource = "bunyPresense bot"
 
-			log.Info("Jabber resource not defined in config, using bunyPresense bot")
-		}
+		log.Info("Jabber resource not defined in config, using bunyPresense bot")
+	}
 
-		if sampleConfig.Jabber.User == "" {
-			sampleConfig.Jabber.User = fmt.Sprintf("%s@%s", sampleConfig.Jabber.Nick, sampleConfig.Jabber.Server)
+	if sampleConfig.Jabber.User == "" {
+		sampleConfig.Jabber.User = fmt.Sprintf("%s@%s", sampleConfig.Jabber.Nick, sampleConfig.Jabber.Server)
 
-			log.Infof("Jabber user not defined in config, guessing, it can be %s", sampleConfig.Jabber.User)
-		}
+		log.Infof("Jabber user not defined in config, guessing, it can be %s", sampleConfig.Jabber.User)
+	}
 
-		// Если sampleConfig.Jabber.Password не задан, то авторизации не будет
+	// Если sampleConfig.Jabber.Password не задан, то авторизации не будет
 
-		// Если не задано ни одного мастера, то бот сам себе мастер
-		if len(sampleConfig.Jabber.BotMasters) == 0 {
-			sampleConfig.Jabber.BotMasters[0] = sampleConfig.Jabber.User
+	// Если не задано ни одного мастера, то бот сам себе мастер
+	if len(sampleConfig.Jabber.BotMasters) == 0 {
+		sampleConfig.Jabber.BotMasters = []string{sampleConfig.Jabber.User}
+	}
+
+	// Нам бот нужен в каких-то чат-румах, а не "просто так"
+	if len(sampleConfig.Jabber.Channels) < 1 {
+		return errors.New("no jabber channels/rooms defined in config, quitting") //nolint:goerr113
+	}
+
+	// Шаблон причины бана и часовой пояс проверяем сразу, чтобы не узнать об ошибке в момент бана
+	if sampleConfig.Jabber.reasonTemplate, err = CompileReasonTemplate(
+		"reason_template",
+		sampleConfig.Jabber.ReasonTemplate,
+	); err != nil {
+		return err
+	}
+
+	if sampleConfig.Jabber.Timezone != "" {
+		if sampleConfig.Jabber.location, err = time.LoadLocation(sampleConfig.Jabber.Timezone); err != nil {
+			return fmt.Errorf("incorrect timezone %s: %w", sampleConfig.Jabber.Timezone, err)
 		}
+	}
+
+	// Глобальная политика неприкосновенности, она же - умолчание для комнат
+	setProtectDefaults(&sampleConfig.Jabber.Protect, nil)
+
+	if err := sampleConfig.Jabber.Protect.compile(); err != nil {
+		return fmt.Errorf("incorrect pattern in protect: %w", err)
+	}
 
-		// Нам бот нужен в каких-то чат-румах, а не "просто так"
-		if len(sampleConfig.Jabber.Channels) < 1 {
-			return errors.New("no jabber channels/rooms defined in config, quitting") //nolint:goerr113
+	for n := range sampleConfig.Jabber.Channels {
+		if err := prepareChannel(&sampleConfig.Jabber.Channels[n], sampleConfig); err != nil {
+			return err
 		}
+	}
 
-		for n, channel := range sampleConfig.Jabber.Channels {
-			if channel.Name == "" {
-				return errors.New("no \"name\" entry in jabber channel config") //nolint:goerr113
-			}
+	// Если список фраз с которыми стартует бот пустой, вносим в него 1 запись с пустой строкой
+	if len(sampleConfig.Jabber.StartupStatus) == 0 {
+		sampleConfig.Jabber.StartupStatus = []string{""}
+	}
 
-			if channel.Nick == "" {
-				sampleConfig.Jabber.Channels[n].Nick = sampleConfig.Jabber.Nick
-			}
+	// Если список статусов, с которыми работает бот пустой, вносим в него 1 запись с пустой строкой
+	if len(sampleConfig.Jabber.RuntimeStatus.Text) == 0 {
+		sampleConfig.Jabber.RuntimeStatus.Text = []string{""}
+	}
 
-			// channel.Password может быть пустым, тогда пароля нет
-			// channel.Bayes.Enabled будет false, если не проставлен
+	// Если sampleConfig.Jabber.RuntimeStatus.RotationTime не задан, то он равен 0
+	// Если sampleConfig.Jabber.RuntimeStatus.RotationSplayTime не задан, то он равен 0
 
-			if channel.Bayes.MinLength < 40 {
-				channel.Bayes.MinLength = 40
-			}
+	// Если sampleConfig.Jabber.BanDelay не задан, то он равен 0
+	// Если sampleConfig.Jabber.BanPhrasesEnable не задан, то он false
 
-			if channel.Bayes.MinWords < 8 {
-				channel.Bayes.MinWords = 8
-			}
+	// Если список фраз, с которыми банят пустой, то вносим в него одну позицию с пустой строкой
+	if len(sampleConfig.Jabber.BanPhrases) == 0 {
+		sampleConfig.Jabber.BanPhrases = []string{""}
+	}
 
-			switch channel.Bayes.DefaultAction {
-			case "kick":
-			case "ban":
-			case "devoice":
-			default:
-				channel.Bayes.DefaultAction = "log"
-			}
+	// Состояние бота, которое должно переживать перезапуск, хранится рядом с конфигом
+	if sampleConfig.Jabber.StateDir == "" {
+		sampleConfig.Jabber.StateDir = filepath.Join(exeDir, "data", "state")
 
-			// channel.AllCaps.Enabled будет false, если не указан
-			if channel.AllCaps.MinLength < 10 {
-				channel.AllCaps.MinLength = 10
-			}
+		log.Infof("Jabber state_dir not defined in config, using %s", sampleConfig.Jabber.StateDir)
+	}
 
-			switch channel.AllCaps.DefaultAction {
-			case "kick":
-			case "ban":
-			case "devoice":
-			default:
-				channel.AllCaps.DefaultAction = "log"
-			}
-		}
+	if sampleConfig.Jabber.AuditLog == "" {
+		sampleConfig.Jabber.AuditLog = filepath.Join(sampleConfig.Jabber.StateDir, "audit.jsonl")
 
-		// Если список фраз с которыми стартует бот пустой, вносим в него 1 запись с пустой строкой
-		if len(sampleConfig.Jabber.StartupStatus) == 0 {
-			sampleConfig.Jabber.StartupStatus[0] = ""
-		}
+		log.Infof("Jabber audit_log not defined in config, using %s", sampleConfig.Jabber.AuditLog)
+	}
 
-		// Если список статусов, с которыми работает бот пустой, вносим в него 1 запись с пустой строкой
-		if len(sampleConfig.Jabber.RuntimeStatus.Text) == 0 {
-			sampleConfig.Jabber.RuntimeStatus.Text[0] = ""
-		}
+	// Настройки очереди модерирующих действий
+	if sampleConfig.Jabber.ActionQueue.Size < 1 {
+		sampleConfig.Jabber.ActionQueue.Size = 1000
 
-		// Если sampleConfig.Jabber.RuntimeStatus.RotationTime не задан, то он равен 0
-		// Если sampleConfig.Jabber.RuntimeStatus.RotationSplayTime не задан, то он равен 0
+		log.Info("Jabber action_queue size not defined in config, using 1000")
+	}
 
-		// Если sampleConfig.Jabber.BanDelay не задан, то он равен 0
-		// Если sampleConfig.Jabber.BanPhrasesEnable не задан, то он false
+	if sampleConfig.Jabber.ActionQueue.Workers < 1 {
+		sampleConfig.Jabber.ActionQueue.Workers = 2
 
-		// Если список фраз, с которыми банят пустой, то вносим в него одну позицию с пустой строкой
-		if len(sampleConfig.Jabber.BanPhrases) == 0 {
-			sampleConfig.Jabber.BanPhrases[0] = ""
-		}
+		log.Info("Jabber action_queue workers not defined in config, using 2")
+	}
+
+	if sampleConfig.Jabber.ActionQueue.RoomInterval < 1 {
+		sampleConfig.Jabber.ActionQueue.RoomInterval = 500
+
+		log.Info("Jabber action_queue room_interval not defined in config, using 500 milliseconds")
+	}
+
+	if sampleConfig.Jabber.ActionQueue.BatchSize < 1 {
+		sampleConfig.Jabber.ActionQueue.BatchSize = 10
 
-		if sampleConfig.CSign == "" {
-			sampleConfig.CSign = "!"
+		log.Info("Jabber action_queue batch_size not defined in config, using 10")
+	}
+
+	// Если sampleConfig.Jabber.ActionQueue.BatchWait не задан, то он равен 0 и пачкуются только те действия, которые
+	// уже лежат в очереди
+
+	if sampleConfig.Jabber.ActionQueue.StatsInterval < 1 {
+		sampleConfig.Jabber.ActionQueue.StatsInterval = 300
+
+		log.Info("Jabber action_queue stats_interval not defined in config, using 300 seconds")
+	}
+
+	if sampleConfig.CSign == "" {
+		sampleConfig.CSign = "!"
+	}
+
+	if sampleConfig.Loglevel == "" {
+		sampleConfig.Loglevel = "info"
+
+		log.Info("loglevel not defined in config, using info")
+	}
+
+	// sampleConfig.Log = "" if not set
+
+	return nil
+}
+
+// prepareChannel валидирует настройки комнаты и выставляет default-ы, часть из них берётся из глобальных настроек cfg.
+// Годится и для комнат из конфига, и для комнат, в которые бота позвали командой.
+func prepareChannel(channel *MyChannel, cfg *MyConfig) error { //nolint:gocognit,gocyclo,cyclop
+	var err error
+
+	if channel.Name == "" {
+		return errors.New("no \"name\" entry in jabber channel config") //nolint:goerr113
+	}
+
+	if channel.Nick == "" {
+		channel.Nick = cfg.Jabber.Nick
+	}
+
+	// channel.Password может быть пустым, тогда пароля нет
+	// channel.Bayes.Enabled будет false, если не проставлен
+
+	if channel.Bayes.MinLength < 40 {
+		channel.Bayes.MinLength = 40
+	}
+
+	if channel.Bayes.MinWords < 8 {
+		channel.Bayes.MinWords = 8
+	}
+
+	switch channel.Bayes.DefaultAction {
+	case "kick":
+	case "ban":
+	case "devoice":
+	default:
+		channel.Bayes.DefaultAction = "log"
+	}
+
+	// channel.AllCaps.Enabled будет false, если не указан
+	if channel.AllCaps.MinLength < 10 {
+		channel.AllCaps.MinLength = 10
+	}
+
+	switch channel.AllCaps.DefaultAction {
+	case "kick":
+	case "ban":
+	case "devoice":
+	default:
+		channel.AllCaps.DefaultAction = "log"
+	}
+
+	// Больше 3 исправлений сообщений за минуту - подозрительно
+	if channel.Corrections.MaxEdits < 1 {
+		channel.Corrections.MaxEdits = 3
+	}
+
+	if channel.Corrections.Window < 1 {
+		channel.Corrections.Window = 60
+	}
+
+	switch channel.Corrections.DefaultAction {
+	case "kick":
+	case "ban":
+	case "devoice":
+	default:
+		channel.Corrections.DefaultAction = "log"
+	}
+
+	// Правила для устаревших клиентов компилируем сразу, чтобы ошибки в регулярках всплывали при чтении конфига
+	for i := range channel.OutdatedClients {
+		oc := &channel.OutdatedClients[i]
+
+		matcher, err := CompileUserAgent(oc.UserAgent)
+
+		if err != nil {
+			return fmt.Errorf("incorrect outdated_clients entry in channel %s: %w", channel.Name, err)
 		}
 
-		if sampleConfig.Loglevel == "" {
-			sampleConfig.Loglevel = "info"
+		oc.matcher = matcher
 
-			log.Info("loglevel not defined in config, using info")
+		switch oc.Action {
+		case "log":
+		case "devoice":
+		case "kick":
+		case "ban":
+		default:
+			oc.Action = "log"
 		}
+	}
 
-		// sampleConfig.Log = "" if not set
+	if !validMode(channel.Mode) {
+		log.Warnf("Unknown mode %s for channel %s, using %s", channel.Mode, channel.Name, ModeEnforce)
 
-		j.C = sampleConfig
-		configLoaded = true
+		channel.Mode = ModeEnforce
+	}
 
-		log.Infof("Using %s as config file", location)
+	// Очки по-умолчанию помним 10 минут
+	if channel.Scoring.Window < 1 {
+		channel.Scoring.Window = 600
+	}
 
-		break
+	// Пропущенные сообщения по-умолчанию проверяем за последний час, не больше сотни
+	if channel.Catchup.MaxAge < 1 {
+		channel.Catchup.MaxAge = 3600
 	}
 
-	if !configLoaded {
-		return errors.New("config was not loaded") //nolint:goerr113
+	if channel.Catchup.MaxMessages < 1 {
+		channel.Catchup.MaxMessages = 100
 	}
 
-	return err //nolint:wrapcheck
+	// channel.Retract.Enabled будет false, если не указан, а отрицательное on_ban - то же, что 0
+	if channel.Retract.OnBan < 0 {
+		channel.Retract.OnBan = 0
+	}
+
+	if channel.Scoring.WarnText == "" {
+		channel.Scoring.WarnText = "Please behave, or you will be removed from the room."
+	}
+
+	if channel.reasonTemplate, err = CompileReasonTemplate(
+		channel.Name+" reason_template",
+		channel.ReasonTemplate,
+	); err != nil {
+		return err
+	}
+
+	if channel.Timezone != "" {
+		if channel.location, err = time.LoadLocation(channel.Timezone); err != nil {
+			return fmt.Errorf("incorrect timezone %s for channel %s: %w", channel.Timezone, channel.Name, err)
+		}
+	}
+
+	setProtectDefaults(&channel.Protect, &cfg.Jabber.Protect)
+
+	if err := channel.Protect.compile(); err != nil {
+		return fmt.Errorf("incorrect pattern in protect of channel %s: %w", channel.Name, err)
+	}
+
+	// Сколько ждать ответа на запрос версии клиента, прежде чем применить политику no_answer
+	if channel.VersionQuery.Timeout < 1 {
+		channel.VersionQuery.Timeout = 30
+	}
+
+	for _, policy := range []*string{
+		&channel.VersionQuery.NoAnswer,
+		&channel.VersionQuery.Error,
+		&channel.VersionQuery.EmptyName,
+	} {
+		switch *policy {
+		case "ignore":
+		case "log":
+		case "devoice":
+		case "kick":
+		case "ban":
+		case "":
+			*policy = "log"
+		default:
+			log.Warnf("Unknown version_query policy %s for channel %s, using log", *policy, channel.Name)
+
+			*policy = "log"
+		}
+	}
+
+	return nil
 }
 
 /* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
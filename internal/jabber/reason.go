@@ -0,0 +1,125 @@
+package jabber
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ReasonData - поля, доступные в шаблоне причины бана, например:
+//
+//	{{.Action}} by rule {{.Rule}}: {{.Kind}} matches {{.Match}} at {{.Time.Format "2006.01.02 15:04:05"}}
+type ReasonData struct {
+	// Rule - id сработавшего правила, Kind - его вид (jid, nick, phrase, user_agent, expr), Pattern - само правило.
+	Rule    string
+	Kind    string
+	Pattern string
+
+	// Match - то, что совпало с правилом: jid, ник, текст сообщения или клиент.
+	Match string
+
+	// Why - человекочитаемое объяснение, за что.
+	Why string
+
+	Nick     string
+	JID      string
+	Room     string
+	Action   string
+	Duration string
+
+	// Time - текущее время в часовом поясе timezone из конфига.
+	Time time.Time
+
+	// Version - версия бота.
+	Version string
+}
+
+// CompileReasonTemplate разбирает шаблон причины бана и проверяет его, выполнив на тестовых данных, так что ошибки вроде
+// несуществующих полей обнаруживаются при загрузке, а не в момент бана. Для пустого шаблона возвращает nil.
+func CompileReasonTemplate(name, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse reason template %s: %w", name, err)
+	}
+
+	sample := ReasonData{
+		Rule:     "r0123abcd",
+		Kind:     "phrase",
+		Pattern:  "^spam$",
+		Match:    "spam",
+		Why:      "phrase matches ^spam$",
+		Nick:     "nick",
+		JID:      "user@example.org",
+		Room:     "room@conference.example.org",
+		Action:   "ban",
+		Duration: "",
+		Time:     time.Now(),
+		Version:  "0",
+	}
+
+	if err := tmpl.Execute(io.Discard, sample); err != nil {
+		return nil, fmt.Errorf("incorrect reason template %s: %w", name, err)
+	}
+
+	return tmpl, nil
+}
+
+// ReasonLocation возвращает часовой пояс, в котором подставляется время в причину бана: timezone комнаты, если задан,
+// иначе глобальный.
+func (j *Jabber) ReasonLocation(room string) *time.Location {
+	if channel := j.GetRoomConfig(room); channel != nil && channel.location != nil {
+		return channel.location
+	}
+
+	if j.C.Jabber.location != nil {
+		return j.C.Jabber.location
+	}
+
+	return time.Local
+}
+
+// RenderReason формирует причину бана. Шаблон берётся из правила (tmpl), если его нет - из настроек комнаты, если нет и
+// там - из глобальных настроек. Если шаблонов нет нигде, то при включённом legacy причиной будет "autoban at ...", иначе
+// причина пустая.
+func (j *Jabber) RenderReason(room string, tmpl *template.Template, data ReasonData, legacy bool) string {
+	if tmpl == nil {
+		if channel := j.GetRoomConfig(room); channel != nil && channel.reasonTemplate != nil {
+			tmpl = channel.reasonTemplate
+		} else {
+			tmpl = j.C.Jabber.reasonTemplate
+		}
+	}
+
+	if tmpl == nil {
+		if legacy {
+			return autobanReason()
+		}
+
+		return ""
+	}
+
+	data.Room = room
+	data.Time = time.Now().In(j.ReasonLocation(room))
+	data.Version = strings.TrimSpace(j.C.Version)
+
+	var b strings.Builder
+
+	if err := tmpl.Execute(&b, data); err != nil {
+		log.Errorf("Unable to render reason template %s: %s", tmpl.Name(), err)
+
+		return ""
+	}
+
+	return strings.TrimSpace(b.String())
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,167 @@
+package jabber
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/eleksir/go-xmpp"
+	log "github.com/sirupsen/logrus"
+)
+
+// Replay прогоняет записанные события через ParseEvent, как если бы они пришли от сервера, и пишет в out, что бот
+// при этом сделал бы: баны, кики и прочие действия из очереди, а также сообщения, которые он отправил бы. Команды из
+// записи не выполняются, а только упоминаются. На сервер при этом ничего не отправляется, журнал модерации не пишется,
+// а состояние в state_dir и файлы списков не меняются.
+func (j *Jabber) Replay(events []ReplayEvent, out io.Writer) error {
+	// Всё, что бот захочет сохранить, уйдёт во временный каталог.
+	stateDir, err := os.MkdirTemp("", "buny-jabber-bot-replay-")
+
+	if err != nil {
+		return fmt.Errorf("unable to create temporary state dir: %w", err)
+	}
+
+	defer os.RemoveAll(stateDir) //nolint:errcheck
+
+	// Сохранённые временные баны и счётчики правил к прогону отношения не имеют, а режимы комнат и правил и список
+	// комнат, наоборот, нужны такие же, как у работающего бота, поэтому они берутся копиями.
+	for _, name := range []string{modesState, roomsState} {
+		if err := copyFile(j.StatePath(name), filepath.Join(stateDir, name)); err != nil {
+			return err
+		}
+	}
+
+	// Списки тоже подменяются копиями, на случай если что-то всё-таки захочет их записать.
+	for _, path := range []*string{&j.WhitelistFile, &j.BlacklistFile} {
+		if *path == "" {
+			continue
+		}
+
+		listCopy := filepath.Join(stateDir, filepath.Base(*path))
+
+		if err := copyFile(*path, listCopy); err != nil {
+			return err
+		}
+
+		*path = listCopy
+	}
+
+	j.C.Jabber.StateDir = stateDir
+	j.C.Jabber.AuditLog = ""
+	j.C.Jabber.EventCapture = ""
+	j.Replaying = true
+	j.replayOut = out
+
+	j.ResetState()
+	j.RuleStats = nil
+
+	j.Talk = &FakeClient{Jid: j.C.Jabber.User + "/" + j.C.Jabber.Resource, Out: out} //nolint:exhaustruct
+
+	// В записи может не оказаться нашего собственного presence-а, поэтому считаем, что мы уже во всех комнатах.
+	j.RoomsConnected = make([]string, 0, len(j.C.Jabber.Channels))
+
+	for _, channel := range j.C.Jabber.Channels {
+		j.RoomsConnected = append(j.RoomsConnected, channel.Name)
+	}
+
+	j.IsConnected = true
+
+	for n, e := range events {
+		if v, ok := e.Event.(xmpp.IQ); ok {
+			e.Event = j.rewriteVersionAnswer(v)
+		}
+
+		j.ParseEvent(e.Event)
+
+		prefix := ""
+
+		if !e.Time.IsZero() {
+			prefix = e.Time.Format("2006-01-02 15:04:05") + " "
+		}
+
+		j.printActions(out, prefix)
+
+		if !j.GTomb.Alive() {
+			return fmt.Errorf("event %d stopped the bot: %w", n+1, j.GTomb.Err())
+		}
+	}
+
+	// Ответов на запросы версии, которых не было в записи, уже не будет.
+	j.VersionQueries.Range(func(key, value interface{}) bool {
+		if q := value.(*PendingVersionQuery); q.timer != nil {
+			q.timer.Stop()
+		}
+
+		j.VersionQueries.Delete(key)
+
+		return true
+	})
+
+	return nil
+}
+
+// replayNote пишет в вывод прогона, что бот сделал бы, но при прогоне не делает.
+func (j *Jabber) replayNote(format string, args ...interface{}) {
+	if _, err := fmt.Fprintf(j.replayOut, format+"\n", args...); err != nil {
+		log.Errorf("Unable to write replay output: %s", err)
+	}
+}
+
+// rewriteVersionAnswer подменяет id записанного ответа на запрос версии клиента id-ом запроса, который бот отправил
+// при прогоне: сам запрос у него каждый раз новый, а ответ в записи - на старый.
+func (j *Jabber) rewriteVersionAnswer(v xmpp.IQ) xmpp.IQ {
+	if v.Type != xmpp.IQTypeResult && v.Type != xmpp.IQTypeError {
+		return v
+	}
+
+	if !strings.Contains(string(v.Query), "jabber:iq:version") && v.Type == xmpp.IQTypeResult {
+		return v
+	}
+
+	j.VersionQueries.Range(func(key, value interface{}) bool {
+		if value.(*PendingVersionQuery).From == v.From {
+			v.ID = key.(string)
+
+			return false
+		}
+
+		return true
+	})
+
+	return v
+}
+
+// printActions выгребает из очереди всё, что туда положили при обработке события, и пишет в out, каждую строку
+// начиная с prefix.
+func (j *Jabber) printActions(out io.Writer, prefix string) {
+	for {
+		select {
+		case a := <-j.Actions.ch:
+			action := a.Action
+
+			switch {
+			case action == "ban" && a.Duration > 0:
+				action = "tempban " + a.Duration.String()
+			case action == "retract":
+				action = "retract message " + a.Message + " of"
+			}
+
+			line := fmt.Sprintf("%s%s %s/%s (%s)", prefix, action, a.Room, a.Nick, a.JID)
+
+			// Для правил чёрного списка id правила уже есть в Why.
+			if a.Why != "" {
+				line += ": " + a.Why
+			}
+
+			if _, err := fmt.Fprintln(out, line); err != nil {
+				log.Errorf("Unable to write replay output: %s", err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
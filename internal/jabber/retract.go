@@ -0,0 +1,178 @@
+package jabber
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/eleksir/go-xmpp"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Пространства имён xep-0425 (модерация сообщений) и xep-0424 (отзыв сообщений). Комнаты поддерживают либо текущую
+// версию модерации, либо старую, через xep-0422 (fastening), а то и обе.
+const (
+	nsModerate    = "urn:xmpp:message-moderate:1"
+	nsRetract     = "urn:xmpp:message-retract:1"
+	nsModerateOld = "urn:xmpp:message-moderate:0"
+	nsRetractOld  = "urn:xmpp:message-retract:0"
+	nsFasten      = "urn:xmpp:fasten:0"
+)
+
+// TrackMessage запоминает stanza-id сообщения участника, чтобы при бане можно было удалить его последние сообщения.
+// Помнится не больше retract.on_ban сообщений, неизвестных участников бот не заводит.
+func (j *Jabber) TrackMessage(from, id string) {
+	room := strings.SplitN(from, "/", 2)[0]
+	channel := j.GetRoomConfig(room)
+
+	if id == "" || channel == nil || channel.Retract.OnBan < 1 {
+		return
+	}
+
+	if _, known := j.GetOccupant(from); !known {
+		return
+	}
+
+	j.UpdateOccupant(from, func(o *Occupant) {
+		// Слайс копируем, чтобы не задеть копии сведений об участнике, полученные раньше.
+		messages := append(slices.Clone(o.Messages), id)
+
+		if len(messages) > channel.Retract.OnBan {
+			messages = messages[len(messages)-channel.Retract.OnBan:]
+		}
+
+		o.Messages = messages
+	})
+}
+
+// moderateNamespace возвращает пространство имён модерации сообщений, которое анонсировала комната, или пустую строку,
+// если комната не умеет удалять чужие сообщения.
+func (j *Jabber) moderateNamespace(room string) string {
+	switch {
+	case j.roomSupports(room, nsModerate):
+		return nsModerate
+	case j.roomSupports(room, nsModerateOld):
+		return nsModerateOld
+	}
+
+	return ""
+}
+
+// Retract ставит в очередь удаление сообщений участника, к которому применено действие a: сообщения a.Message, из-за
+// которого сработало правило, если в комнате включён retract, и последних retract.on_ban сообщений, если участника
+// банят. Удалять сообщения можно, только если комната анонсирует urn:xmpp:message-moderate.
+func (j *Jabber) Retract(from string, a ModAction) {
+	channel := j.GetRoomConfig(a.Room)
+
+	if channel == nil || a.Action == "log" {
+		return
+	}
+
+	var ids []string
+
+	if a.Message != "" && channel.Retract.Enabled {
+		ids = append(ids, a.Message)
+	}
+
+	if a.Action == "ban" && channel.Retract.OnBan > 0 {
+		o, _ := j.GetOccupant(from)
+
+		for _, id := range o.Messages {
+			if !slices.Contains(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	if len(ids) == 0 {
+		return
+	}
+
+	if j.moderateNamespace(a.Room) == "" {
+		log.Infof("Room %s does not support message moderation, not retracting messages of %s", a.Room, from)
+
+		return
+	}
+
+	for _, id := range ids {
+		err := j.Enqueue(
+			ModAction{ //nolint:exhaustruct
+				Room:    a.Room,
+				JID:     a.JID,
+				Nick:    a.Nick,
+				Action:  "retract",
+				Message: id,
+				Reason:  channel.Retract.Reason,
+				Rule:    a.Rule,
+				Why:     a.Why,
+				By:      a.By,
+			},
+		)
+
+		if err != nil {
+			log.Errorf("Unable to retract message %s of %s: %s", id, from, err)
+		}
+	}
+}
+
+// retractQuery формирует запрос на удаление сообщения согласно https://xmpp.org/extensions/xep-0425.html в той версии,
+// которую понимает комната.
+func retractQuery(ns string, a ModAction) string {
+	reason := ""
+
+	if a.Reason != "" {
+		reason = "<reason>" + xmlEscape(a.Reason) + "</reason>"
+	}
+
+	if ns == nsModerateOld {
+		return fmt.Sprintf(
+			"<apply-to xmlns='%s' id='%s'><moderate xmlns='%s'><retract xmlns='%s'/>%s</moderate></apply-to>",
+			nsFasten,
+			xmlEscape(a.Message),
+			nsModerateOld,
+			nsRetractOld,
+			reason,
+		)
+	}
+
+	return fmt.Sprintf(
+		"<moderate xmlns='%s' id='%s'><retract xmlns='%s'/>%s</moderate>",
+		nsModerate,
+		xmlEscape(a.Message),
+		nsRetract,
+		reason,
+	)
+}
+
+// sendRetractions отправляет запросы на удаление сообщений в одну комнату. Каждое сообщение удаляется отдельным IQ.
+func (j *Jabber) sendRetractions(group []ModAction) error {
+	room := group[0].Room
+	ns := j.moderateNamespace(room)
+
+	if ns == "" {
+		j.dropActions("room does not support message moderation anymore", group...)
+
+		return nil
+	}
+
+	for n, a := range group {
+		id := "mod-" + uuid.New().String()
+
+		log.Debugf("Retracting message %s of %s (%s) in %s, id=%s", a.Message, a.Nick, a.JID, room, id)
+
+		if _, err := j.Talk.RawInformation(j.Talk.JID(), room, id, xmpp.IQTypeSet, retractQuery(ns, a)); err != nil {
+			j.dropActions("connection failed", group[n:]...)
+
+			return fmt.Errorf("unable to send message retraction to %s: id=%s, err=%w", room, id, err)
+		}
+
+		j.Actions.sent(id, []ModAction{a})
+
+		log.Infof("Sent retraction of message %s of %s (%s) in %s", a.Message, a.JID, a.Nick, room)
+	}
+
+	return nil
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
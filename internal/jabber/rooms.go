@@ -0,0 +1,317 @@
+package jabber
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/eleksir/go-xmpp"
+	log "github.com/sirupsen/logrus"
+)
+
+// roomsState - имя файла состояния с комнатами, в которые бота позвали или из которых его увели командами.
+const roomsState = "rooms.json"
+
+// RoomJoin - комната, в которую бота позвали командой !join, и ник, под которым он в неё заходит.
+type RoomJoin struct {
+	Name string `json:"name"`
+	Nick string `json:"nick,omitempty"`
+}
+
+// RoomList - комнаты, изменённые командами !join и !leave, поверх списка комнат из конфига. Они сохраняются в
+// state_dir, чтобы переживать реконнект и перезапуск бота.
+type RoomList struct {
+	mu sync.Mutex
+
+	// Joined - комнаты, в которые бота позвали (комнаты из конфига - только если под другим ником), Left - комнаты из
+	// конфига, из которых бота увели.
+	Joined []RoomJoin `json:"joined,omitempty"`
+	Left   []string   `json:"left,omitempty"`
+
+	// config - комнаты из конфига, как они были до наложения изменений.
+	config []MyChannel
+}
+
+// LoadRooms загружает изменённые командами комнаты из state_dir. Комнаты из конфига запоминаются при первой загрузке,
+// чтобы при повторной (после реконнекта) изменения не накладывались дважды.
+func (j *Jabber) LoadRooms() *RoomList {
+	l := &RoomList{} //nolint:exhaustruct
+
+	if j.Rooms != nil {
+		l.config = j.Rooms.config
+	} else {
+		l.config = slices.Clone(j.C.Jabber.Channels)
+	}
+
+	if err := j.LoadState(roomsState, l); err != nil {
+		log.Errorf("Unable to load joined and left rooms, using rooms from config: %s", err)
+	}
+
+	return l
+}
+
+// ApplyRooms пересобирает список комнат в конфиге: комнаты из конфига, кроме тех, из которых бота увели, плюс те, в
+// которые его позвали. Настройки новых комнат берутся по-умолчанию, в том числе из глобальных настроек. Список
+// пересобирается в новый слайс, так что полученные раньше указатели на настройки комнат остаются рабочими.
+func (j *Jabber) ApplyRooms() {
+	j.Rooms.mu.Lock()
+	defer j.Rooms.mu.Unlock()
+
+	channels := make([]MyChannel, 0, len(j.Rooms.config)+len(j.Rooms.Joined))
+
+	for _, channel := range j.Rooms.config {
+		if slices.Contains(j.Rooms.Left, channel.Name) {
+			continue
+		}
+
+		// В комнату из конфига бота могли позвать под другим ником.
+		for _, join := range j.Rooms.Joined {
+			if join.Name == channel.Name && join.Nick != "" {
+				channel.Nick = join.Nick
+			}
+		}
+
+		channels = append(channels, channel)
+	}
+
+	for _, join := range j.Rooms.Joined {
+		if j.Rooms.inConfig(join.Name) {
+			continue
+		}
+
+		channel := MyChannel{Name: join.Name, Nick: join.Nick} //nolint:exhaustruct
+
+		if err := prepareChannel(&channel, &j.C); err != nil {
+			log.Errorf("Unable to set up joined room %s, skipping it: %s", join.Name, err)
+
+			continue
+		}
+
+		channels = append(channels, channel)
+	}
+
+	j.C.Jabber.Channels = channels
+}
+
+// inConfig сообщает, описана ли комната в конфиге.
+func (l *RoomList) inConfig(room string) bool {
+	return slices.ContainsFunc(l.config, func(c MyChannel) bool { return c.Name == room })
+}
+
+// saveRooms применяет изменения списка комнат и сохраняет их в state_dir.
+func (j *Jabber) saveRooms() error {
+	j.Rooms.mu.Lock()
+	err := j.SaveState(roomsState, j.Rooms)
+	j.Rooms.mu.Unlock()
+
+	j.ApplyRooms()
+
+	if err != nil {
+		return fmt.Errorf("room list is changed, but will be lost after restart: %w", err)
+	}
+
+	return nil
+}
+
+// JoinRoom заходит в комнату room под ником nick (пустой ник - ник из конфига). В state_dir комната запоминается, только
+// когда бот в неё действительно зашёл. Если зайти не вышло (опечатка в имени комнаты, комната с паролем, таймаут), то
+// изменение списка комнат отменяется, чтобы бот не ломился туда при каждом реконнекте. О том, чем кончилось дело,
+// сообщает done, он вызывается в цикле разбора событий.
+func (j *Jabber) JoinRoom(room, nick string, done func(error)) error {
+	if j.GetRoomConfig(room) != nil {
+		return fmt.Errorf("room %s is already in room list", room) //nolint:goerr113
+	}
+
+	if !j.IsConnected {
+		return fmt.Errorf("not connected, unable to join room %s", room) //nolint:goerr113
+	}
+
+	j.Rooms.mu.Lock()
+
+	// Комнату из конфига, из которой бота увели, возвращаем, вычёркивая её из Left, остальные добавляем в Joined.
+	wasLeft := slices.Contains(j.Rooms.Left, room)
+	joined := !j.Rooms.inConfig(room) || nick != ""
+
+	j.Rooms.Left = slices.DeleteFunc(j.Rooms.Left, func(name string) bool { return name == room })
+
+	if joined {
+		j.Rooms.Joined = append(j.Rooms.Joined, RoomJoin{Name: room, Nick: nick})
+	}
+
+	j.Rooms.mu.Unlock()
+
+	// Настройки комнаты нужны уже для захода в неё, поэтому в памяти список меняется сразу.
+	j.ApplyRooms()
+
+	j.GTomb.Go(func() error {
+		err := j.JoinMuc(room)
+
+		j.InEventLoop(func() {
+			if slices.Contains(j.RoomsConnected, room) {
+				done(j.saveRooms())
+
+				return
+			}
+
+			j.Rooms.mu.Lock()
+
+			if joined {
+				j.Rooms.Joined = slices.DeleteFunc(j.Rooms.Joined, func(join RoomJoin) bool { return join.Name == room })
+			}
+
+			if wasLeft {
+				j.Rooms.Left = append(j.Rooms.Left, room)
+			}
+
+			j.Rooms.mu.Unlock()
+
+			j.ApplyRooms()
+
+			if err != nil {
+				done(fmt.Errorf("unable to join room %s, forgetting it: %w", room, err))
+			} else {
+				done(fmt.Errorf("unable to join room %s, forgetting it", room)) //nolint:goerr113
+			}
+		})
+
+		return err
+	})
+
+	return nil
+}
+
+// LeaveRoom выходит из комнаты room и запоминает это в state_dir.
+func (j *Jabber) LeaveRoom(room string) error {
+	nick := j.GetBotNickFromRoomConfig(room)
+
+	if j.GetRoomConfig(room) == nil {
+		return fmt.Errorf("room %s is not in room list", room) //nolint:goerr113
+	}
+
+	j.Rooms.mu.Lock()
+
+	j.Rooms.Joined = slices.DeleteFunc(j.Rooms.Joined, func(join RoomJoin) bool { return join.Name == room })
+
+	if j.Rooms.inConfig(room) {
+		j.Rooms.Left = append(j.Rooms.Left, room)
+	}
+
+	j.Rooms.mu.Unlock()
+
+	// Из списка подключенных комнат убираем раньше, чем уходим, чтобы наш собственный presence об уходе и прочие
+	// события из комнаты бот уже не обрабатывал.
+	j.RoomsConnected = slices.DeleteFunc(slices.Clone(j.RoomsConnected), func(name string) bool { return name == room })
+	j.RoomPresences.Delete(room)
+	j.LastMucActivity.Delete(room)
+
+	err := j.saveRooms()
+
+	if j.IsConnected {
+		presence := xmpp.Presence{To: room + "/" + nick, Type: "unavailable"} //nolint:exhaustruct
+
+		if _, sendErr := j.Talk.SendPresence(presence); sendErr != nil {
+			return fmt.Errorf("unable to leave room %s: %w", room, sendErr)
+		}
+	}
+
+	return err
+}
+
+// registerRoomCommands добавляет в реестр команды !join и !leave.
+func registerRoomCommands(r *CommandRegistry) {
+	r.Register(&Command{ //nolint:exhaustruct
+		Name:       "join",
+		Aliases:    []string{"зайти"},
+		Usage:      "<room> [nick]",
+		Help:       "join room, settings are taken from global ones",
+		MinArgs:    1,
+		MaxArgs:    2,
+		Permission: PermMaster,
+		Places:     CmdAnywhere,
+		Run:        (*Jabber).cmdJoin,
+	})
+
+	r.Register(&Command{ //nolint:exhaustruct
+		Name:       "leave",
+		Aliases:    []string{"уйти"},
+		Usage:      "[room]",
+		Help:       "leave room, current one by default",
+		MaxArgs:    1,
+		Permission: PermMaster,
+		Places:     CmdAnywhere,
+		Run:        (*Jabber).cmdLeave,
+	})
+}
+
+// cmdJoin заходит в комнату.
+func (j *Jabber) cmdJoin(r *CmdRequest) string {
+	room := r.Args[0]
+	nick := ""
+
+	if len(r.Args) == 2 {
+		nick = r.Args[1]
+	}
+
+	if !strings.Contains(room, "@") || strings.Contains(room, "/") {
+		return fmt.Sprintf("%s does not look like a room jid", room)
+	}
+
+	log.Infof("Command %s%s: join %s ordered by %s(%s)", j.C.CSign, r.Name, room, r.JID, r.Msg.Remote)
+
+	err := j.JoinRoom(room, nick, func(err error) {
+		answer := "Зашёл в " + room
+
+		if err != nil {
+			answer = fmt.Sprint(err)
+		}
+
+		if err := j.CmdReply(r, answer); err != nil {
+			log.Error(err)
+		}
+	})
+
+	if err != nil {
+		return fmt.Sprint(err)
+	}
+
+	return "Захожу"
+}
+
+// cmdLeave выходит из комнаты, указанной в команде, или из той, откуда пришла команда.
+func (j *Jabber) cmdLeave(r *CmdRequest) string {
+	room := r.Room
+
+	if len(r.Args) == 1 {
+		room = r.Args[0]
+	}
+
+	if room == "" {
+		return r.Usage(j.C.CSign)
+	}
+
+	if j.GetRoomConfig(room) == nil {
+		return fmt.Sprintf("Room %s is not in room list", room)
+	}
+
+	log.Infof("Command %s%s: leave %s ordered by %s(%s)", j.C.CSign, r.Name, room, r.JID, r.Msg.Remote)
+
+	// Ответить в комнату, из которой уже ушли, не выйдет, так что отвечаем заранее.
+	answer := "Сделано"
+
+	if room == r.Room && r.Place != CmdInDirect {
+		if err := j.CmdReply(r, "Ухожу"); err != nil {
+			log.Error(err)
+		}
+
+		answer = ""
+	}
+
+	if err := j.LeaveRoom(room); err != nil {
+		return fmt.Sprint(err)
+	}
+
+	return answer
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,128 @@
+package jabber
+
+import (
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RuleSubject - то, что проверяется правилами чёрного списка: вид правил (jid, nick или phrase) и проверяемое значение.
+type RuleSubject struct {
+	Kind  string
+	Value string
+}
+
+// RuleMatch - сработавшее правило чёрного списка.
+type RuleMatch struct {
+	// Entry - запись чёрного списка, в которой находится правило.
+	Entry BlackListEntry
+
+	// Kind - вид правила, Pattern - само правило, Match - то, что с ним совпало.
+	Kind    string
+	Pattern string
+	Match   string
+}
+
+// rulePatterns возвращает регулярки записи чёрного списка для правил вида kind.
+func (b *BlackListEntry) rulePatterns(kind string) []string {
+	switch kind {
+	case "jid":
+		return b.JidRe
+	case "nick":
+		return b.NickRe
+	case "phrase":
+		return b.PhraseRe
+	}
+
+	return nil
+}
+
+// ruleApplies сообщает, действует ли запись чёрного списка в комнате room. Пустая room означает любую комнату.
+func (b *BlackListEntry) ruleApplies(room string) bool {
+	if b.Expired() {
+		return false
+	}
+
+	return room == "" || b.RoomName == "" || b.RoomName == room
+}
+
+// MatchRules проверяет subjects по действующим правилам-регуляркам чёрного списка: глобальным и комнаты room, или, если
+// room пустая, всех комнат. Записи перебираются по порядку, внутри записи - subjects по порядку. На каждое совпадение
+// вызывается fn, если она вернула true, то перебор прекращается и MatchRules тоже возвращает true. Этим пользуются и
+// детекторы, и команда !test, так что правила в них срабатывают одинаково.
+func (j *Jabber) MatchRules(room string, subjects []RuleSubject, fn func(m RuleMatch) bool) bool {
+	for _, bEntry := range j.BlackList.Blacklist {
+		if !bEntry.ruleApplies(room) {
+			continue
+		}
+
+		for _, subject := range subjects {
+			for _, pattern := range bEntry.rulePatterns(subject.Kind) {
+				if pattern == "" {
+					continue
+				}
+
+				re, err := regexp.Compile(pattern)
+
+				if err != nil {
+					log.Errorf("Incorrect %s regexp in blacklist for room %q: %s, skipping", subject.Kind, bEntry.RoomName, pattern)
+
+					continue
+				}
+
+				log.Debugf("Checking %s %s vs blacklist regex %s for room %q", subject.Kind, subject.Value, pattern, bEntry.RoomName)
+
+				if !re.MatchString(subject.Value) {
+					continue
+				}
+
+				if fn(RuleMatch{Entry: bEntry, Kind: subject.Kind, Pattern: pattern, Match: subject.Value}) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// MatchExprs проверяет участника по действующим правилам-выражениям чёрного списка, так же, как MatchRules. Поля для
+// выражений env собираются только тогда, когда есть что проверять.
+func (j *Jabber) MatchExprs(room string, env func() *ExprEnv, fn func(m RuleMatch, env *ExprEnv) bool) bool {
+	var e *ExprEnv
+
+	for _, bEntry := range j.BlackList.Blacklist {
+		if !bEntry.ruleApplies(room) {
+			continue
+		}
+
+		for _, expr := range bEntry.exprs {
+			if e == nil {
+				e = env()
+			}
+
+			log.Debugf("Checking %s vs blacklist expression %s", e.JID, expr)
+
+			if !expr.Eval(e) {
+				continue
+			}
+
+			if fn(RuleMatch{Entry: bEntry, Kind: "expr", Pattern: expr.String(), Match: e.Text}, e) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ruleScope - для логов: глобальное правило или правило комнаты.
+func ruleScope(bEntry BlackListEntry) string {
+	if bEntry.RoomName == "" {
+		return "global"
+	}
+
+	return "room"
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
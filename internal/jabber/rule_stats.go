@@ -0,0 +1,334 @@
+package jabber
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ruleStatsState - имя файла состояния со счётчиками срабатываний правил.
+const ruleStatsState = "rulestats.json"
+
+// RuleStat - счётчики срабатываний одного правила чёрного списка.
+type RuleStat struct {
+	Rule    string `json:"rule"`
+	Room    string `json:"room,omitempty"`
+	Kind    string `json:"kind"`
+	Pattern string `json:"pattern"`
+
+	// Since - когда бот впервые увидел это правило в чёрном списке, от этого момента считается "давно не срабатывало"
+	// для правил, которые не срабатывали ни разу.
+	Since time.Time `json:"since"`
+
+	Hits    int64     `json:"hits"`
+	LastHit time.Time `json:"last_hit,omitempty"`
+
+	// Rooms - число срабатываний по комнатам: у глобальных правил комнат может быть много.
+	Rooms map[string]int64 `json:"rooms,omitempty"`
+}
+
+// RuleStatList - счётчики срабатываний правил, по id правила. Они сохраняются в state_dir, чтобы переживать
+// перезапуск бота.
+type RuleStatList struct {
+	mu    sync.Mutex
+	items map[string]*RuleStat
+	dirty bool
+}
+
+// ruleRef - правило чёрного списка: его вид и само правило в том виде, в котором по нему считается RuleID.
+type ruleRef struct {
+	kind    string
+	pattern string
+}
+
+// rules возвращает все действующие правила записи чёрного списка.
+func (b *BlackListEntry) rules() []ruleRef {
+	var rules []ruleRef
+
+	for _, re := range b.JidRe {
+		rules = append(rules, ruleRef{kind: "jid", pattern: re})
+	}
+
+	for _, re := range b.NickRe {
+		rules = append(rules, ruleRef{kind: "nick", pattern: re})
+	}
+
+	for _, re := range b.PhraseRe {
+		rules = append(rules, ruleRef{kind: "phrase", pattern: re})
+	}
+
+	for _, ua := range b.userAgents {
+		rules = append(rules, ruleRef{kind: "user_agent", pattern: ua.String()})
+	}
+
+	for _, expr := range b.exprs {
+		rules = append(rules, ruleRef{kind: "expr", pattern: expr.String()})
+	}
+
+	return rules
+}
+
+// LoadRuleStats загружает счётчики срабатываний правил из state_dir.
+func (j *Jabber) LoadRuleStats() *RuleStatList {
+	var items []*RuleStat
+
+	l := &RuleStatList{items: make(map[string]*RuleStat)} //nolint:exhaustruct
+
+	if err := j.LoadState(ruleStatsState, &items); err != nil {
+		log.Errorf("Unable to load rule hit counters, starting from scratch: %s", err)
+	}
+
+	for _, stat := range items {
+		l.items[stat.Rule] = stat
+	}
+
+	return l
+}
+
+// TrackRules заводит счётчики для правил из текущего чёрного списка, которых бот раньше не видел.
+func (j *Jabber) TrackRules() {
+	if j.RuleStats == nil {
+		return
+	}
+
+	now := time.Now()
+
+	j.RuleStats.mu.Lock()
+	defer j.RuleStats.mu.Unlock()
+
+	for n := range j.BlackList.Blacklist {
+		bEntry := &j.BlackList.Blacklist[n]
+
+		for _, r := range bEntry.rules() {
+			rule := RuleID(bEntry.RoomName, r.kind, r.pattern)
+
+			if _, exist := j.RuleStats.items[rule]; exist {
+				continue
+			}
+
+			j.RuleStats.items[rule] = &RuleStat{ //nolint:exhaustruct
+				Rule:    rule,
+				Room:    bEntry.RoomName,
+				Kind:    r.kind,
+				Pattern: r.pattern,
+				Since:   now,
+			}
+
+			j.RuleStats.dirty = true
+		}
+	}
+}
+
+// CountRuleHit учитывает срабатывание правила в комнате room.
+func (j *Jabber) CountRuleHit(room string, bEntry BlackListEntry, kind, pattern string) {
+	if j.RuleStats == nil {
+		return
+	}
+
+	var (
+		rule = RuleID(bEntry.RoomName, kind, pattern)
+		now  = time.Now()
+	)
+
+	j.RuleStats.mu.Lock()
+	defer j.RuleStats.mu.Unlock()
+
+	stat, exist := j.RuleStats.items[rule]
+
+	if !exist {
+		stat = &RuleStat{Rule: rule, Room: bEntry.RoomName, Kind: kind, Pattern: pattern, Since: now} //nolint:exhaustruct
+		j.RuleStats.items[rule] = stat
+	}
+
+	if stat.Rooms == nil {
+		stat.Rooms = make(map[string]int64)
+	}
+
+	stat.Hits++
+	stat.LastHit = now
+	stat.Rooms[room]++
+	j.RuleStats.dirty = true
+}
+
+// SaveRuleStats сохраняет счётчики в state_dir, если они изменились с прошлого раза.
+func (j *Jabber) SaveRuleStats() {
+	if j.RuleStats == nil {
+		return
+	}
+
+	j.RuleStats.mu.Lock()
+	defer j.RuleStats.mu.Unlock()
+
+	if !j.RuleStats.dirty {
+		return
+	}
+
+	items := make([]*RuleStat, 0, len(j.RuleStats.items))
+
+	for _, stat := range j.RuleStats.items {
+		items = append(items, stat)
+	}
+
+	sort.Slice(items, func(a, b int) bool { return items[a].Rule < items[b].Rule })
+
+	if err := j.SaveState(ruleStatsState, items); err != nil {
+		log.Errorf("Unable to save rule hit counters: %s", err)
+
+		return
+	}
+
+	j.RuleStats.dirty = false
+}
+
+// RuleStatsWorker периодически сохраняет счётчики срабатываний правил. Каждое срабатывание на диск не пишем, их может
+// быть много, поэтому при падении бота теряется не больше минуты счётчиков.
+func (j *Jabber) RuleStatsWorker() error {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-j.GTomb.Dying():
+			j.SaveRuleStats()
+
+			return nil
+		case <-ticker.C:
+		}
+
+		j.SaveRuleStats()
+	}
+}
+
+// currentRuleStats возвращает копии счётчиков правил, которые есть в текущем чёрном списке. Счётчики удалённых из
+// списка правил в отчёты не попадают.
+func (j *Jabber) currentRuleStats() []RuleStat {
+	if j.RuleStats == nil {
+		return nil
+	}
+
+	var (
+		stats []RuleStat
+		seen  = make(map[string]bool)
+	)
+
+	j.RuleStats.mu.Lock()
+	defer j.RuleStats.mu.Unlock()
+
+	for n := range j.BlackList.Blacklist {
+		bEntry := &j.BlackList.Blacklist[n]
+
+		for _, r := range bEntry.rules() {
+			rule := RuleID(bEntry.RoomName, r.kind, r.pattern)
+
+			// Одно и то же правило может встретиться в нескольких записях одной комнаты.
+			if seen[rule] {
+				continue
+			}
+
+			seen[rule] = true
+
+			if stat, exist := j.RuleStats.items[rule]; exist {
+				stats = append(stats, *stat)
+			}
+		}
+	}
+
+	return stats
+}
+
+// TopRules возвращает отчёт о n самых часто срабатывающих правилах.
+func (j *Jabber) TopRules(n int) string {
+	stats := j.currentRuleStats()
+
+	sort.SliceStable(stats, func(a, b int) bool { return stats[a].Hits > stats[b].Hits })
+
+	var report []string
+
+	for _, stat := range stats {
+		if len(report) >= n || stat.Hits == 0 {
+			break
+		}
+
+		report = append(report, fmt.Sprintf(
+			"%s %s %q: %d hits, last %s, rooms: %s",
+			stat.Rule,
+			stat.Kind,
+			stat.Pattern,
+			stat.Hits,
+			stat.LastHit.Format("2006-01-02 15:04"),
+			formatRuleRooms(stat.Rooms),
+		))
+	}
+
+	if len(report) == 0 {
+		return "No rule has matched yet."
+	}
+
+	return strings.Join(report, "\n")
+}
+
+// StaleRules возвращает отчёт о правилах, которые не срабатывали последние days дней.
+func (j *Jabber) StaleRules(days int) string {
+	var (
+		stats  = j.currentRuleStats()
+		since  = time.Now().AddDate(0, 0, -days)
+		report []string
+	)
+
+	sort.SliceStable(stats, func(a, b int) bool { return stats[a].LastHit.Before(stats[b].LastHit) })
+
+	for _, stat := range stats {
+		if stat.LastHit.After(since) || stat.Since.After(since) {
+			continue
+		}
+
+		room := stat.Room
+
+		if room == "" {
+			room = "all rooms"
+		}
+
+		last := "never"
+
+		if !stat.LastHit.IsZero() {
+			last = stat.LastHit.Format("2006-01-02 15:04")
+		}
+
+		report = append(report, fmt.Sprintf("%s %s %q (%s): last hit %s", stat.Rule, stat.Kind, stat.Pattern, room, last))
+	}
+
+	if len(report) == 0 {
+		return fmt.Sprintf("Every rule has matched in the last %d days.", days)
+	}
+
+	return fmt.Sprintf("%d rules did not match in the last %d days:\n%s", len(report), days, strings.Join(report, "\n"))
+}
+
+// formatRuleRooms форматирует число срабатываний правила по комнатам, начиная с самой "урожайной".
+func formatRuleRooms(rooms map[string]int64) string {
+	names := make([]string, 0, len(rooms))
+
+	for room := range rooms {
+		names = append(names, room)
+	}
+
+	sort.Slice(names, func(a, b int) bool {
+		if rooms[names[a]] != rooms[names[b]] {
+			return rooms[names[a]] > rooms[names[b]]
+		}
+
+		return names[a] < names[b]
+	})
+
+	for n, room := range names {
+		names[n] = fmt.Sprintf("%s (%d)", room, rooms[room])
+	}
+
+	return strings.Join(names, ", ")
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,92 @@
+package jabber
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TestRules проверяет value по правилам чёрного списка тем же способом, что и детекторы, но ничего не делает с
+// участниками и не трогает счётчики правил. kind - что проверяем: phrase (текст сообщения), nick или jid. room - комната,
+// для которой проверяем, если пустая - то правила всех комнат. Возвращает список сработавших правил с действиями.
+func (j *Jabber) TestRules(room, kind, value string) string {
+	var (
+		lines []string
+		env   = &ExprEnv{} //nolint:exhaustruct
+	)
+
+	switch kind {
+	case "phrase":
+		env.Text = value
+	case "nick":
+		env.Nick = value
+	case "jid":
+		env.JID = strings.SplitN(value, "/", 2)[0]
+
+		if at := strings.LastIndex(env.JID, "@"); at >= 0 {
+			env.Domain = env.JID[at+1:]
+		} else {
+			env.Domain = env.JID
+		}
+	}
+
+	report := func(m RuleMatch) bool {
+		rule := RuleID(m.Entry.RoomName, m.Kind, m.Pattern)
+		scope := m.Entry.RoomName
+
+		if scope == "" {
+			scope = "global"
+		}
+
+		lines = append(lines, fmt.Sprintf(
+			"%s %s %s %q: %s",
+			rule,
+			scope,
+			m.Kind,
+			m.Pattern,
+			j.describeRuleAction(room, m.Entry, rule),
+		))
+
+		return false
+	}
+
+	j.MatchRules(room, []RuleSubject{{Kind: kind, Value: value}}, report)
+	j.MatchExprs(room, func() *ExprEnv { return env }, func(m RuleMatch, _ *ExprEnv) bool { return report(m) })
+
+	if len(lines) == 0 {
+		return "No rule matches."
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// describeRuleAction описывает, что сделал бы бот при срабатывании правила в комнате room, с учётом подсчёта очков и
+// режима shadow. Если комната не задана, то описывает настройки самого правила.
+func (j *Jabber) describeRuleAction(room string, bEntry BlackListEntry, rule string) string {
+	var (
+		action = bEntry.Action
+		mode   = j.RuleMode(bEntry, rule)
+	)
+
+	if action == "tempban" {
+		action += " " + bEntry.duration.String()
+	}
+
+	switch {
+	case bEntry.Score > 0 && room != "" && j.ScoringEnabled(room):
+		action = fmt.Sprintf("+%g points", bEntry.Score)
+	case bEntry.Score > 0 && room == "":
+		action += fmt.Sprintf(", or +%g points where scoring is enabled", bEntry.Score)
+	}
+
+	if mode == "" && room != "" {
+		mode = j.RoomMode(room)
+	}
+
+	if mode == ModeShadow {
+		action += " (shadow)"
+	}
+
+	return action
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
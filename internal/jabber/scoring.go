@@ -0,0 +1,271 @@
+package jabber
+
+import (
+	"crypto/sha1" //nolint:gosec
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/eleksir/go-xmpp"
+	log "github.com/sirupsen/logrus"
+)
+
+// scoreLevels - действия по порядку возрастания строгости.
+var scoreLevels = []string{"warn", "devoice", "kick", "ban"}
+
+// scoreHit - одно срабатывание правила или сигнала.
+type scoreHit struct {
+	at     time.Time
+	points float64
+	why    string
+}
+
+// occupantScore - набранные участником очки в конкретной комнате.
+type occupantScore struct {
+	hits []scoreHit
+
+	// applied - самое строгое из уже применённых действий, индекс в scoreLevels, -1 - ничего не применялось.
+	applied int
+}
+
+// ScoringEnabled сообщает, включён ли в комнате подсчёт очков.
+func (j *Jabber) ScoringEnabled(room string) bool {
+	channel := j.GetRoomConfig(room)
+
+	return channel != nil && channel.Scoring.Enabled
+}
+
+// RuleHit вызывается, когда участник попался на правило чёрного списка. kind - вид правила (jid, nick, phrase,
+// user_agent, expr), pattern - само правило, match - то, что с ним совпало, msgID - stanza-id сообщения, если правило
+// сработало на сообщение. Если в комнате включён подсчёт очков и у записи задан вес, то участник получает очки, иначе
+// к нему применяется действие записи. Возвращает true, если дальше проверять участника не нужно.
+func (j *Jabber) RuleHit(room, from, jid string, bEntry BlackListEntry, kind, pattern, match, vType, msgID string) bool {
+	var (
+		rule = RuleID(bEntry.RoomName, kind, pattern)
+		why  = fmt.Sprintf("%s matches %s (rule %s)", kind, pattern, rule)
+	)
+
+	j.CountRuleHit(room, bEntry, kind, pattern)
+
+	mode := j.RuleMode(bEntry, rule)
+
+	if bEntry.Score > 0 && j.ScoringEnabled(room) {
+		// Правило в режиме shadow очков не начисляет, иначе из-за него участника могли бы наказать по-настоящему.
+		if mode == ModeShadow {
+			log.Infof("Shadow mode: would add %g points to %s (%s) for %s", bEntry.Score, from, jid, why)
+
+			return false
+		}
+
+		j.AddScore(room, from, jid, bEntry.Score, why)
+
+		return false
+	}
+
+	var nick string
+
+	if n := strings.SplitN(from, "/", 2); len(n) > 1 {
+		nick = n[1]
+	}
+
+	duration := ""
+
+	if bEntry.duration > 0 {
+		duration = bEntry.duration.String()
+	}
+
+	reason := j.RenderReason(
+		room,
+		bEntry.reason,
+		ReasonData{ //nolint:exhaustruct
+			Rule:     rule,
+			Kind:     kind,
+			Pattern:  pattern,
+			Match:    match,
+			Why:      why,
+			Nick:     nick,
+			JID:      strings.SplitN(jid, "/", 2)[0],
+			Action:   bEntry.Action,
+			Duration: duration,
+		},
+		bEntry.ReasonEnable,
+	)
+
+	j.Sanction(
+		from,
+		ModAction{ //nolint:exhaustruct
+			JID:      jid,
+			Action:   bEntry.Action,
+			Reason:   reason,
+			Duration: bEntry.duration,
+			VType:    vType,
+			Rule:     rule,
+			Why:      why,
+			Mode:     mode,
+			Message:  msgID,
+		},
+	)
+
+	return bEntry.Action != "log" && bEntry.Action != "warn"
+}
+
+// RuleID - короткий стабильный идентификатор правила чёрного списка, который не меняется, пока не меняется само
+// правило: по нему правило можно найти в логах и журнале модерации.
+func RuleID(room, kind, pattern string) string {
+	sum := sha1.Sum([]byte(room + "\x00" + kind + "\x00" + pattern)) //nolint:gosec
+
+	return "r" + hex.EncodeToString(sum[:4])
+}
+
+// AddScore добавляет участнику очки. Очки копятся в пределах окна window из настроек комнаты, более старые
+// забываются. Если сумма достигла порога, применяется соответствующее ему действие, но не мягче уже применённого.
+func (j *Jabber) AddScore(room, from, jid string, points float64, why string) {
+	channel := j.GetRoomConfig(room)
+
+	if channel == nil || !channel.Scoring.Enabled {
+		return
+	}
+
+	var (
+		bareJid = strings.SplitN(jid, "/", 2)[0]
+		key     = scoreKey(room, from, jid)
+		now     = time.Now()
+		window  = time.Duration(channel.Scoring.Window) * time.Second
+		prev    = &occupantScore{hits: nil, applied: -1}
+	)
+
+	if value, exist := j.Scores.Get(key); exist {
+		prev = value.(*occupantScore)
+	}
+
+	// Запись не меняется на месте, а заменяется новой, её параллельно может читать PruneScores.
+	score := &occupantScore{hits: make([]scoreHit, 0, len(prev.hits)+1), applied: prev.applied}
+
+	// Забываем то, что вышло за окно.
+	for _, hit := range prev.hits {
+		if now.Sub(hit.at) < window {
+			score.hits = append(score.hits, hit)
+		}
+	}
+
+	if len(score.hits) == 0 {
+		score.applied = -1
+	}
+
+	score.hits = append(score.hits, scoreHit{at: now, points: points, why: why})
+
+	var (
+		total   float64
+		reasons []string
+		level   = -1
+	)
+
+	for _, hit := range score.hits {
+		total += hit.points
+		reasons = append(reasons, fmt.Sprintf("%s (%+g)", hit.why, hit.points))
+	}
+
+	log.Infof("Score of %s (%s) in %s is %g: +%g for %s", from, bareJid, room, total, points, why)
+
+	for n, action := range scoreLevels {
+		if threshold := channel.Scoring.Threshold(action); threshold > 0 && total >= threshold {
+			level = n
+		}
+	}
+
+	if level <= score.applied {
+		j.Scores.Set(key, score)
+
+		return
+	}
+
+	score.applied = level
+	j.Scores.Set(key, score)
+
+	j.Punish(
+		from,
+		bareJid,
+		scoreLevels[level],
+		fmt.Sprintf("score %g reached %s threshold: %s", total, scoreLevels[level], strings.Join(reasons, ", ")),
+	)
+}
+
+// ScoreNewcomer начисляет очки за сигнал newcomer участнику, который впервые появился в комнате и ещё ничем не
+// заслужил репутации.
+func (j *Jabber) ScoreNewcomer(v xmpp.Presence) {
+	room := strings.SplitN(v.From, "/", 2)[0]
+	channel := j.GetRoomConfig(room)
+
+	if channel == nil || !channel.Scoring.Enabled || channel.Scoring.Signals.Newcomer <= 0 {
+		return
+	}
+
+	if j.Reputation(strings.SplitN(v.JID, "/", 2)[0]) > 0 {
+		return
+	}
+
+	j.AddScore(room, v.From, v.JID, channel.Scoring.Signals.Newcomer, "newcomer")
+}
+
+// ScoredSince сообщает, получал ли участник очки начиная с момента t.
+func (j *Jabber) ScoredSince(room, from, jid string, t time.Time) bool {
+	key := scoreKey(room, from, jid)
+
+	value, exist := j.Scores.Get(key)
+
+	if !exist {
+		return false
+	}
+
+	hits := value.(*occupantScore).hits
+
+	return len(hits) > 0 && !hits[len(hits)-1].at.Before(t)
+}
+
+// scoreKey - ключ, под которым хранятся очки участника. Анонимов считаем по нику, другого у нас нет.
+func scoreKey(room, from, jid string) string {
+	if bareJid := strings.SplitN(jid, "/", 2)[0]; bareJid != "" {
+		return room + "|" + bareJid
+	}
+
+	return from
+}
+
+// PruneScores выкидывает из памяти очки, которые целиком вышли за окно, чтобы они не копились вечно. Настройки комнат
+// и сами очки меняются в цикле разбора событий, поэтому и чистка выполняется там же.
+func (j *Jabber) PruneScores() error {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-j.GTomb.Dying():
+			return nil
+		case <-ticker.C:
+		}
+
+		j.InEventLoop(j.pruneScores)
+	}
+}
+
+// pruneScores выкидывает очки тех, у кого последний сигнал вышел за окно подсчёта очков комнаты или чьей комнаты
+// больше нет в конфиге.
+func (j *Jabber) pruneScores() {
+	j.Scores.Range(func(key, value interface{}) bool {
+		var (
+			room    = strings.SplitN(strings.SplitN(key.(string), "|", 2)[0], "/", 2)[0]
+			channel = j.GetRoomConfig(room)
+			score   = value.(*occupantScore)
+		)
+
+		if channel == nil || len(score.hits) == 0 ||
+			time.Since(score.hits[len(score.hits)-1].at) >= time.Duration(channel.Scoring.Window)*time.Second {
+			j.Scores.Delete(key)
+		}
+
+		return true
+	})
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
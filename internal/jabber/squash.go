@@ -2,79 +2,157 @@ package jabber
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/eleksir/go-xmpp"
+	log "github.com/sirupsen/logrus"
 )
 
-// Squash банит указанный jid в указанной комнате.
-// reasonEnable указывает, надо ли писать дату автобана в банлисте в поле reason (это единственная причина, в которую
-// умеет бот).
-func (j *Jabber) Squash(room, jid string, reasonEnable bool, vType string) (string, error) {
+// autobanReason - причина бана, которую бот пишет, если включён reason_enable, а своя причина у правила не задана.
+func autobanReason() string {
+	var t = time.Now()
+
+	return fmt.Sprintf(
+		"autoban at %04d.%02d.%02d %02d:%02d:%02d",
+		t.Year(),
+		t.Month(),
+		t.Day(),
+		t.Hour(),
+		t.Minute(),
+		t.Second(),
+	)
+}
+
+// Punish применяет к участнику комнаты действие action: log, warn, devoice, kick или ban. from - полный ник участника
+// вида room@conference.server/nick, jid - его real jid. why - человекочитаемая причина, она попадает в лог.
+func (j *Jabber) Punish(from, jid, action, why string) {
 	var (
-		id  string
-		err error
+		room = strings.SplitN(from, "/", 2)[0]
+		nick string
 	)
 
-	if j.C.Jabber.BanPhrasesEnable {
-		phrase := RandomPhrase(j.C.Jabber.BanPhrases)
+	if n := strings.SplitN(from, "/", 2); len(n) > 1 {
+		nick = n[1]
+	}
 
-		if _, err = j.Talk.Send(
-			xmpp.Chat{ //nolint:exhaustruct
-				Remote: room,
-				Text:   phrase,
-				Type:   vType,
-			},
-		); err != nil {
-			err = fmt.Errorf("unable to send phrase to room %s: %w", room, err)
+	reason := j.RenderReason(
+		room,
+		nil,
+		ReasonData{Why: why, Nick: nick, JID: strings.SplitN(jid, "/", 2)[0], Action: action}, //nolint:exhaustruct
+		false,
+	)
 
-			// Здесь возвращаем nil, т.к. за нас ошибку залоггирует код выше.
-			return id, err
-		}
+	j.Sanction(from, ModAction{Action: action, JID: jid, Reason: reason, Why: why}) //nolint:exhaustruct
+}
+
+// Sanction применяет к участнику комнаты действие a: log, warn, devoice, voice, kick, ban, tempban (бан на a.Duration)
+// или unban.
+// from - полный ник участника вида room@conference.server/nick, из него берутся комната и ник. Все действия, кроме log и
+// warn, выполняются через очередь. Если правило или комната в режиме shadow, то действие не выполняется. Вместе с
+// действием удаляются сообщения участника, см. Retract.
+func (j *Jabber) Sanction(from string, a ModAction) {
+	a.Room = strings.SplitN(from, "/", 2)[0]
+	a.JID = strings.SplitN(a.JID, "/", 2)[0]
+
+	if n := strings.SplitN(from, "/", 2); len(n) > 1 {
+		a.Nick = n[1]
 	}
 
-	// https://xmpp.org/extensions/xep-0045.html#ban баним вот таким сообщением
-	ban := "<item affiliation='outcast' jid='" + jid + "'>"
-
-	if reasonEnable {
-		var t = time.Now()
-		ban += fmt.Sprintf(
-			"<reason>autoban at %04d.%02d.%02d %02d:%02d:%02d</reason>",
-			t.Year(),
-			t.Month(),
-			t.Day(),
-			t.Hour(),
-			t.Minute(),
-			t.Second(),
-		)
-	} else {
-		ban += "<reason />"
+	mode := a.Mode
+
+	if mode == "" {
+		mode = j.RoomMode(a.Room)
 	}
 
-	ban += "</item>"
+	if mode == ModeShadow && a.Action != "log" {
+		j.Shadow(from, a)
 
-	// Выжидаем некоторое время перед баном. А то можно настолько рано забанить, что сервер не внесёт злодея в банлист
-	// комнаты и пришлёт affiliation: none вместо affiliation: outcast.
-	if j.C.Jabber.BanDelay > 0 {
-		time.Sleep(time.Duration(j.C.Jabber.BanDelay) * time.Millisecond)
+		return
 	}
 
-	if id, err = j.Talk.RawInformationQuery(
-		j.Talk.JID(),
-		room,
-		"ban1",
-		xmpp.IQTypeSet,
-		"http://jabber.org/protocol/muc#admin",
-		ban,
-	); err != nil {
-		err = fmt.Errorf(
-			"unable to ban user: id=%s, err=%w",
-			id,
-			err,
-		)
+	switch a.Action {
+	case "log":
+		log.Warnf("Suspicious %s (%s): %s", from, a.JID, a.Why)
+		j.AuditAction(a)
+
+		return
+
+	case "warn":
+		log.Warnf("Warning %s (%s): %s", from, a.JID, a.Why)
+		j.AuditAction(a)
+
+		text := "Please behave, or you will be removed from the room."
+
+		if channel := j.GetRoomConfig(a.Room); channel != nil {
+			text = channel.Scoring.WarnText
+		}
+
+		if _, err := j.Talk.Send(xmpp.Chat{Remote: from, Type: "chat", Text: text}); err != nil { //nolint:exhaustruct
+			log.Errorf("Unable to warn %s: %s", from, err)
+		}
+
+		j.Retract(from, a)
+
+		return
+
+	case "devoice", "voice", "kick":
+		// Если участник уже ушёл, то ни выгнать, ни лишить голоса его не получится.
+		if j.GetRealJIDfromNick(from) == "" {
+			log.Infof("Not going to %s %s (%s): %s, occupant already left", a.Action, from, a.JID, a.Why)
+
+			return
+		}
+
+	case "ban", "tempban":
+		if a.JID == "" {
+			log.Warnf("Not going to ban %s: %s, real jid is unknown", from, a.Why)
+
+			return
+		}
+
+		if a.Action == "tempban" {
+			if a.Duration <= 0 {
+				log.Errorf("Not going to tempban %s (%s): %s, duration is not set", from, a.JID, a.Why)
+
+				return
+			}
+
+			a.Action = "ban"
+		} else {
+			a.Duration = 0
+		}
+
+	case "unban":
+		if a.JID == "" {
+			log.Warnf("Not going to unban %s: %s, jid is unknown", from, a.Why)
+
+			return
+		}
+
+	default:
+		log.Errorf("Unknown action %s for %s (%s): %s", a.Action, from, a.JID, a.Why)
+
+		return
+	}
+
+	log.Infof("Queueing %s of %s (%s): %s", a.Action, from, a.JID, a.Why)
+
+	if err := j.Enqueue(a); err != nil {
+		log.Errorf("Unable to %s %s in %s: %s", a.Action, from, a.Room, err)
+
+		return
 	}
 
-	return id, err
+	j.Retract(from, a)
+
+	// Бан снимется сам, когда истечёт срок. Постоянный бан и снятие бана отменяют запланированное снятие временного.
+	switch {
+	case a.Action == "ban" && a.Duration > 0:
+		j.ScheduleUnban(a.Room, a.JID, time.Now().Add(a.Duration))
+	case a.Action == "ban" || a.Action == "unban":
+		j.CancelUnban(a.Room, a.JID)
+	}
 }
 
 /* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
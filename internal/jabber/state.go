@@ -0,0 +1,116 @@
+package jabber
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// StatePath возвращает путь к файлу состояния с данным именем в каталоге state_dir.
+func (j *Jabber) StatePath(name string) string {
+	return filepath.Join(j.C.Jabber.StateDir, name)
+}
+
+// SaveState сохраняет состояние v в файл name в каталоге state_dir, в json-е. Файл перезаписывается атомарно, так
+// что при падении бота посреди записи остаётся либо старое, либо новое состояние, но не обрывок.
+func (j *Jabber) SaveState(name string, v interface{}) error {
+	buf, err := json.MarshalIndent(v, "", "\t")
+
+	if err != nil {
+		return fmt.Errorf("unable to serialize state %s: %w", name, err)
+	}
+
+	if err := os.MkdirAll(j.C.Jabber.StateDir, 0o750); err != nil {
+		return fmt.Errorf("unable to create state dir %s: %w", j.C.Jabber.StateDir, err)
+	}
+
+	return WriteFileAtomic(j.StatePath(name), buf)
+}
+
+// LoadState загружает состояние из файла name в каталоге state_dir в v. Если файла нет, то v не меняется и ошибки
+// нет: состояния просто ещё не было.
+func (j *Jabber) LoadState(name string, v interface{}) error {
+	buf, err := os.ReadFile(j.StatePath(name))
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to read state %s: %w", name, err)
+	}
+
+	if err := json.Unmarshal(buf, v); err != nil {
+		return fmt.Errorf("unable to parse state %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// copyFile копирует файл src в dst с теми же правами. Если src нет, то ничего не делается и ошибки нет.
+func copyFile(src, dst string) error {
+	fi, err := os.Stat(src)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %w", src, err)
+	}
+
+	buf, err := os.ReadFile(src)
+
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %w", src, err)
+	}
+
+	if err := os.WriteFile(dst, buf, fi.Mode().Perm()); err != nil {
+		return fmt.Errorf("unable to write %s: %w", dst, err)
+	}
+
+	return nil
+}
+
+// WriteFileAtomic записывает данные во временный файл рядом с path и переименовывает его в path.
+func WriteFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+
+	if err != nil {
+		return fmt.Errorf("unable to create temporary file for %s: %w", path, err)
+	}
+
+	// Если что-то пошло не так, за собой прибираем. После успешного rename-а файла с таким именем уже нет.
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+
+		return fmt.Errorf("unable to write %s: %w", tmp.Name(), err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+
+		return fmt.Errorf("unable to sync %s: %w", tmp.Name(), err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to close %s: %w", tmp.Name(), err)
+	}
+
+	// Сохраняем права существующего файла, если он есть.
+	if fi, err := os.Stat(path); err == nil {
+		_ = os.Chmod(tmp.Name(), fi.Mode().Perm())
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("unable to replace %s: %w", path, err)
+	}
+
+	return nil
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,183 @@
+package jabber
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// startTime - когда запущен процесс бота.
+var startTime = time.Now()
+
+// statusActions - действия из журнала модерации, которые считаются в отчёте о состоянии. Правки списков туда не
+// попадают.
+var statusActions = []string{"log", "warn", "devoice", "voice", "kick", "ban", "tempban", "unban", "retract"}
+
+// roomActionCounts - число действий в комнате за последние сутки и за неделю.
+type roomActionCounts struct {
+	day  int
+	week int
+}
+
+// actionCounts считает по журналу модерации действия в каждой комнате за последние сутки и неделю. Действия в
+// режиме shadow и невыполненные не считаются.
+func (j *Jabber) actionCounts(now time.Time) (map[string]*roomActionCounts, error) {
+	var (
+		counts = make(map[string]*roomActionCounts)
+		day    = now.Add(-24 * time.Hour)
+	)
+
+	err := j.ReadAudit(now.AddDate(0, 0, -7), func(r AuditRecord) {
+		if r.Shadow || r.Failed != "" || !slices.Contains(statusActions, r.Action) {
+			return
+		}
+
+		c, exist := counts[r.Room]
+
+		if !exist {
+			c = &roomActionCounts{} //nolint:exhaustruct
+			counts[r.Room] = c
+		}
+
+		c.week++
+
+		if r.Time.After(day) {
+			c.day++
+		}
+	})
+
+	return counts, err
+}
+
+// roomFeatures возвращает фичи, которые комната анонсировала в ответе на disco#info.
+func (j *Jabber) roomFeatures(room string) []string {
+	var features []string
+
+	if caps, exist := j.MucCapsList.Get(room); exist {
+		for feature, supported := range caps.(map[string]bool) {
+			if supported {
+				features = append(features, feature)
+			}
+		}
+	}
+
+	sort.Strings(features)
+
+	return features
+}
+
+// Status собирает отчёт о состоянии бота: время работы, соединение, пинг до сервера, комнаты, действия за сутки и
+// неделю, правила и время последнего перечитывания списков.
+func (j *Jabber) Status() string {
+	var (
+		now   = time.Now()
+		lines []string
+	)
+
+	lines = append(lines, fmt.Sprintf("Version %s, up %s", j.C.Version, now.Sub(startTime).Round(time.Second)))
+
+	switch {
+	case j.IsConnected:
+		lines = append(lines, fmt.Sprintf(
+			"Connected to %s for %s", j.C.Jabber.Server, now.Sub(j.Connected).Round(time.Second),
+		))
+	case j.Connecting:
+		lines = append(lines, fmt.Sprintf("Connecting to %s", j.C.Jabber.Server))
+	default:
+		lines = append(lines, fmt.Sprintf("Not connected to %s", j.C.Jabber.Server))
+	}
+
+	if j.ServerPingRTT > 0 {
+		lines = append(lines, fmt.Sprintf(
+			"Server ping RTT %s, last pong %s ago",
+			j.ServerPingRTT.Round(time.Millisecond),
+			now.Sub(time.Unix(j.ServerPingTimestampRx, 0)).Round(time.Second),
+		))
+	} else {
+		lines = append(lines, "Server ping RTT unknown")
+	}
+
+	counts, err := j.actionCounts(now)
+
+	if err != nil {
+		log.Errorf("Unable to count actions for status: %s", err)
+	}
+
+	for _, channel := range j.C.Jabber.Channels {
+		state := "not joined"
+
+		if slices.Contains(j.RoomsConnected, channel.Name) {
+			state = "joined"
+		}
+
+		occupants := 0
+
+		if presences, present := j.RoomPresences.Get(channel.Name); present {
+			occupants = len(InterfaceToStringSlice(presences))
+		}
+
+		c, exist := counts[channel.Name]
+
+		if !exist {
+			c = &roomActionCounts{} //nolint:exhaustruct
+		}
+
+		lines = append(lines, fmt.Sprintf(
+			"%s: %s as %s, %s mode, %d occupants, actions %d/24h %d/7d",
+			channel.Name,
+			state,
+			channel.Nick,
+			j.RoomMode(channel.Name),
+			occupants,
+			c.day,
+			c.week,
+		))
+
+		if features := j.roomFeatures(channel.Name); len(features) > 0 {
+			lines = append(lines, "  features: "+strings.Join(features, ", "))
+		}
+	}
+
+	rules := 0
+
+	for _, bEntry := range j.BlackList.Blacklist {
+		rules += len(bEntry.rules())
+	}
+
+	jids := 0
+
+	for _, wEntry := range j.WhiteList.Whitelist {
+		jids += len(wEntry.jids)
+	}
+
+	lines = append(lines, fmt.Sprintf(
+		"Blacklist: %d rules in %d entries, whitelist: %d jids in %d entries",
+		rules,
+		len(j.BlackList.Blacklist),
+		jids,
+		len(j.WhiteList.Whitelist),
+	))
+
+	if j.ListsLoaded.IsZero() {
+		lines = append(lines, "Lists were not loaded")
+	} else {
+		lines = append(lines, "Lists loaded at "+j.ListsLoaded.Format("2006-01-02 15:04:05"))
+	}
+
+	if j.Actions != nil {
+		s := j.Actions.Stats()
+
+		lines = append(lines, fmt.Sprintf(
+			"Action queue: depth %d/%d, enqueued %d, dropped %d, acked %d, failed %d, lost %d, in flight %d",
+			s.Depth, s.Capacity, s.Enqueued, s.Dropped, s.Acked, s.Failed, s.Lost, s.InFlight,
+		))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
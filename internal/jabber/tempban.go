@@ -0,0 +1,148 @@
+package jabber
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tempBansState - имя файла состояния со списком временных банов.
+const tempBansState = "tempbans.json"
+
+// TempBan - временный бан, по истечении которого бот сам снимет бан.
+type TempBan struct {
+	Room  string    `json:"room"`
+	JID   string    `json:"jid"`
+	Until time.Time `json:"until"`
+}
+
+// TempBanList - список временных банов. Он сохраняется в state_dir, чтобы баны снимались и после перезапуска бота.
+type TempBanList struct {
+	mu    sync.Mutex
+	items []TempBan
+}
+
+// LoadTempBans загружает список временных банов из state_dir.
+func (j *Jabber) LoadTempBans() *TempBanList {
+	l := &TempBanList{} //nolint:exhaustruct
+
+	if err := j.LoadState(tempBansState, &l.items); err != nil {
+		log.Errorf("Unable to load temporary bans, they will not be lifted automatically: %s", err)
+	}
+
+	return l
+}
+
+// ScheduleUnban запоминает, что бан jid-а в комнате надо снять в момент until. Повторный бан того же jid-а в той же
+// комнате заменяет предыдущий срок.
+func (j *Jabber) ScheduleUnban(room, jid string, until time.Time) {
+	j.TempBans.mu.Lock()
+	defer j.TempBans.mu.Unlock()
+
+	items := j.TempBans.items[:0]
+
+	for _, tb := range j.TempBans.items {
+		if tb.Room != room || tb.JID != jid {
+			items = append(items, tb)
+		}
+	}
+
+	j.TempBans.items = append(items, TempBan{Room: room, JID: jid, Until: until})
+
+	if err := j.SaveState(tempBansState, j.TempBans.items); err != nil {
+		log.Errorf("Unable to save temporary bans: %s", err)
+	}
+}
+
+// CancelUnban забывает о временном бане, например, если его сняли вручную или заменили постоянным.
+func (j *Jabber) CancelUnban(room, jid string) {
+	j.TempBans.mu.Lock()
+	defer j.TempBans.mu.Unlock()
+
+	items := j.TempBans.items[:0]
+
+	for _, tb := range j.TempBans.items {
+		if tb.Room != room || tb.JID != jid {
+			items = append(items, tb)
+		}
+	}
+
+	if len(items) == len(j.TempBans.items) {
+		return
+	}
+
+	j.TempBans.items = items
+
+	if err := j.SaveState(tempBansState, j.TempBans.items); err != nil {
+		log.Errorf("Unable to save temporary bans: %s", err)
+	}
+}
+
+// TempBanWorker периодически снимает истёкшие временные баны.
+func (j *Jabber) TempBanWorker() error {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-j.GTomb.Dying():
+			return nil
+		case <-ticker.C:
+		}
+
+		j.liftExpiredBans()
+	}
+}
+
+// liftExpiredBans ставит в очередь снятие истёкших временных банов.
+func (j *Jabber) liftExpiredBans() {
+	var due []TempBan
+
+	j.TempBans.mu.Lock()
+
+	items := j.TempBans.items[:0]
+
+	for _, tb := range j.TempBans.items {
+		if time.Now().Before(tb.Until) {
+			items = append(items, tb)
+
+			continue
+		}
+
+		due = append(due, tb)
+	}
+
+	j.TempBans.items = items
+
+	j.TempBans.mu.Unlock()
+
+	if len(due) == 0 {
+		return
+	}
+
+	for _, tb := range due {
+		log.Infof("Temporary ban of %s in %s expired, lifting it", tb.JID, tb.Room)
+
+		if err := j.Enqueue(
+			ModAction{ //nolint:exhaustruct
+				Room:   tb.Room,
+				JID:    tb.JID,
+				Action: "unban",
+				Why:    "temporary ban expired",
+			},
+		); err != nil {
+			// Попробуем ещё раз в следующий раз.
+			j.ScheduleUnban(tb.Room, tb.JID, tb.Until)
+		}
+	}
+
+	j.TempBans.mu.Lock()
+	defer j.TempBans.mu.Unlock()
+
+	if err := j.SaveState(tempBansState, j.TempBans.items); err != nil {
+		log.Errorf("Unable to save temporary bans: %s", err)
+	}
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
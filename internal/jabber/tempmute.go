@@ -0,0 +1,181 @@
+package jabber
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tempMutesState - имя файла состояния со списком участников, лишённых голоса на время.
+const tempMutesState = "tempmutes.json"
+
+// TempMute - участник, лишённый голоса на время, которому по истечении срока бот сам вернёт голос.
+type TempMute struct {
+	Room  string    `json:"room"`
+	JID   string    `json:"jid"`
+	Until time.Time `json:"until"`
+}
+
+// TempMuteList - список участников, лишённых голоса на время. Сервер помнит роль участника, пока тот в комнате, в том
+// числе и пока бот переподключается, поэтому список сохраняется в state_dir и после реконнекта таймеры заводятся
+// заново, когда бот заходит в комнату.
+type TempMuteList struct {
+	mu    sync.Mutex
+	items []TempMute
+}
+
+// LoadTempMutes загружает список участников, лишённых голоса на время, из state_dir.
+func (j *Jabber) LoadTempMutes() *TempMuteList {
+	l := &TempMuteList{} //nolint:exhaustruct
+
+	if err := j.LoadState(tempMutesState, &l.items); err != nil {
+		log.Errorf("Unable to load temporary mutes, voice will not be returned automatically: %s", err)
+	}
+
+	return l
+}
+
+// setTempMute запоминает срок, до которого jid лишён голоса в комнате, или забывает о нём, если until нулевой.
+func (j *Jabber) setTempMute(room, jid string, until time.Time) {
+	j.TempMutes.mu.Lock()
+	defer j.TempMutes.mu.Unlock()
+
+	items := j.TempMutes.items[:0]
+
+	for _, tm := range j.TempMutes.items {
+		if tm.Room != room || tm.JID != jid {
+			items = append(items, tm)
+		}
+	}
+
+	changed := len(items) != len(j.TempMutes.items) || !until.IsZero()
+
+	if !until.IsZero() {
+		items = append(items, TempMute{Room: room, JID: jid, Until: until})
+	}
+
+	j.TempMutes.items = items
+
+	if !changed {
+		return
+	}
+
+	if err := j.SaveState(tempMutesState, j.TempMutes.items); err != nil {
+		log.Errorf("Unable to save temporary mutes: %s", err)
+	}
+}
+
+// muteKey - ключ таймера возврата голоса: комната и real jid участника, а если jid неизвестен - его полный ник.
+func muteKey(from, jid string) string {
+	if jid == "" {
+		return from
+	}
+
+	return strings.SplitN(from, "/", 2)[0] + "|" + jid
+}
+
+// cancelMute отменяет возврат голоса участнику from, если он был назначен.
+func (j *Jabber) cancelMute(from, jid string) {
+	if value, exist := j.Mutes.GetAndDelete(muteKey(from, jid)); exist {
+		value.(*time.Timer).Stop()
+	}
+
+	if jid != "" {
+		j.setTempMute(strings.SplitN(from, "/", 2)[0], jid, time.Time{})
+	}
+}
+
+// scheduleUnmute назначает участнику from, лишённому голоса действием a, возврат голоса по истечении срока. Срок
+// сохраняется в state_dir, если real jid участника известен, иначе он помнится только до реконнекта: без jid-а после
+// реконнекта не отличить того же участника от занявшего его ник.
+func (j *Jabber) scheduleUnmute(from string, a ModAction) {
+	until := time.Now().Add(a.Duration)
+
+	if a.JID != "" {
+		j.setTempMute(strings.SplitN(from, "/", 2)[0], a.JID, until)
+	}
+
+	o, _ := j.GetOccupant(from)
+
+	j.startUnmuteTimer(from, a.JID, until, o.Joined)
+}
+
+// RescheduleMutes заводит таймеры возврата голоса в комнате room по сохранённому списку. Вызывается, когда бот зашёл в
+// комнату, в том числе после реконнекта. Сроки, истёкшие, пока бота не было, срабатывают сразу.
+func (j *Jabber) RescheduleMutes(room string) {
+	j.TempMutes.mu.Lock()
+
+	var due []TempMute
+
+	for _, tm := range j.TempMutes.items {
+		if tm.Room == room {
+			due = append(due, tm)
+		}
+	}
+
+	j.TempMutes.mu.Unlock()
+
+	for _, tm := range due {
+		log.Debugf("Voice of %s in %s will be returned at %s", tm.JID, room, tm.Until.Format(time.RFC3339))
+
+		// Ник не важен: по jid-у участника ищут, когда таймер сработает.
+		j.startUnmuteTimer(room+"/", tm.JID, tm.Until, time.Time{})
+	}
+}
+
+// startUnmuteTimer заводит таймер, по которому участнику from голос вернут в момент until. Голос возвращается тому же
+// участнику: по real jid-у, а если он неизвестен - тому, кто с тех пор не перезаходил под этим ником (joined - когда
+// он зашёл). Само действие выполняется в цикле разбора событий. Таймер прежнего соединения ничего не делает: после
+// реконнекта срок подхватит новое соединение из state_dir.
+func (j *Jabber) startUnmuteTimer(from, jid string, until, joined time.Time) {
+	var (
+		key   = muteKey(from, jid)
+		room  = strings.SplitN(from, "/", 2)[0]
+		timer *time.Timer
+	)
+
+	timer = time.AfterFunc(time.Until(until), func() {
+		if !j.GTomb.Alive() {
+			return
+		}
+
+		j.InEventLoop(func() {
+			if !j.GTomb.Alive() {
+				return
+			}
+
+			// Таймер могли отменить или заменить новым как раз тогда, когда он сработал.
+			if value, exist := j.Mutes.Get(key); !exist || value.(*time.Timer) != timer {
+				return
+			}
+
+			j.Mutes.Delete(key)
+
+			target := from
+
+			if jid != "" {
+				// Роль живёт, пока участник в комнате: если он ушёл, то голос у него будет и так.
+				j.setTempMute(room, jid, time.Time{})
+
+				// Участник мог с тех пор сменить ник, ищем его по jid-у.
+				if target, _ = j.resolveTarget(room, jid); target == room {
+					return
+				}
+			} else if current, known := j.GetOccupant(from); !known || !current.Joined.Equal(joined) {
+				return
+			}
+
+			j.Sanction(target, ModAction{JID: jid, Action: "voice", Mode: ModeEnforce, Why: "mute expired"}) //nolint:exhaustruct
+		})
+	})
+
+	if value, exist := j.Mutes.GetAndDelete(key); exist {
+		value.(*time.Timer).Stop()
+	}
+
+	j.Mutes.Set(key, timer)
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
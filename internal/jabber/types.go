@@ -2,7 +2,11 @@ package jabber
 
 import (
 	"encoding/xml"
+	"io"
 	"os"
+	"sync"
+	"text/template"
+	"time"
 
 	"github.com/eleksir/go-xmpp"
 	"gopkg.in/tomb.v2"
@@ -11,41 +15,26 @@ import (
 // MyConfig прототип структурки с конфигом.
 type MyConfig struct {
 	Jabber struct {
-		Server                       string   `json:"server,omitempty"`
-		Port                         int      `json:"port,omitempty"`
-		Ssl                          bool     `json:"ssl,omitempty"`
-		StartTLS                     bool     `json:"starttls,omitempty"`
-		SslVerify                    bool     `json:"ssl_verify,omitempty"`
-		InsecureAllowUnencryptedAuth bool     `json:"insecureallowunencryptedauth,omitempty"`
-		ConnectionTimeout            int64    `json:"connection_timeout,omitempty"`
-		ReconnectDelay               int64    `json:"reconnect_delay,omitempty"`
-		ServerPingDelay              int64    `json:"server_ping_delay,omitempty"`
-		MucPingDelay                 int64    `json:"muc_ping_delay,omitempty"`
-		MucRejoinDelay               int64    `json:"muc_rejoin_delay,omitempty"`
-		PingSplayDelay               int64    `json:"ping_splay_delay,omitempty"`
-		Nick                         string   `json:"nick,omitempty"`
-		Resource                     string   `json:"resource,omitempty"`
-		User                         string   `json:"user,omitempty"`
-		Password                     string   `json:"password,omitempty"`
-		BotMasters                   []string `json:"bot_masters,omitempty"`
-		Channels                     []struct {
-			Name     string `json:"name,omitempty"`
-			Nick     string `json:"nick,omitempty"`
-			Password string `json:"password,omitempty"`
-			Bayes    struct {
-				Enabled       bool   `json:"enabled,omitempty"`
-				MinWords      int64  `json:"min_words,omitempty"`
-				MinLength     int    `json:"min_length,omitempty"`
-				DefaultAction string `json:"default_action,omitempty"`
-			} `json:"bayes,omitempty"`
-			AllCaps struct {
-				Enabled       bool   `json:"enabled,omitempty"`
-				MinLength     int    `json:"min_length,omitempty"`
-				DefaultAction string `json:"default_action,omitempty"`
-			} `json:"all_caps,omitempty"`
-		} `json:"channels"`
-		StartupStatus []string `json:"startup_status,omitempty"`
-		RuntimeStatus struct {
+		Server                       string      `json:"server,omitempty"`
+		Port                         int         `json:"port,omitempty"`
+		Ssl                          bool        `json:"ssl,omitempty"`
+		StartTLS                     bool        `json:"starttls,omitempty"`
+		SslVerify                    bool        `json:"ssl_verify,omitempty"`
+		InsecureAllowUnencryptedAuth bool        `json:"insecureallowunencryptedauth,omitempty"`
+		ConnectionTimeout            int64       `json:"connection_timeout,omitempty"`
+		ReconnectDelay               int64       `json:"reconnect_delay,omitempty"`
+		ServerPingDelay              int64       `json:"server_ping_delay,omitempty"`
+		MucPingDelay                 int64       `json:"muc_ping_delay,omitempty"`
+		MucRejoinDelay               int64       `json:"muc_rejoin_delay,omitempty"`
+		PingSplayDelay               int64       `json:"ping_splay_delay,omitempty"`
+		Nick                         string      `json:"nick,omitempty"`
+		Resource                     string      `json:"resource,omitempty"`
+		User                         string      `json:"user,omitempty"`
+		Password                     string      `json:"password,omitempty"`
+		BotMasters                   []string    `json:"bot_masters,omitempty"`
+		Channels                     []MyChannel `json:"channels"`
+		StartupStatus                []string    `json:"startup_status,omitempty"`
+		RuntimeStatus                struct {
 			Text              []string `json:"text,omitempty"`
 			RotationTime      int64    `json:"rotation_time,omitempty"`
 			RotationSplayTime int64    `json:"rotation_splay_time,omitempty"`
@@ -53,6 +42,29 @@ type MyConfig struct {
 		BanDelay         int64    `json:"ban_delay,omitempty"`
 		BanPhrasesEnable bool     `json:"ban_phrases_enable,omitempty"`
 		BanPhrases       []string `json:"ban_phrases,omitempty"`
+		ActionQueue      struct {
+			Size          int   `json:"size,omitempty"`
+			Workers       int   `json:"workers,omitempty"`
+			RoomInterval  int64 `json:"room_interval,omitempty"`
+			BatchSize     int   `json:"batch_size,omitempty"`
+			BatchWait     int64 `json:"batch_wait,omitempty"`
+			StatsInterval int64 `json:"stats_interval,omitempty"`
+		} `json:"action_queue,omitempty"`
+		Protect  MyProtect `json:"protect,omitempty"`
+		StateDir string    `json:"state_dir,omitempty"`
+		AuditLog string    `json:"audit_log,omitempty"`
+
+		// EventCapture - файл, куда записываются все входящие события, для последующего прогона через replay.
+		EventCapture string `json:"event_capture,omitempty"`
+
+		// ReasonTemplate - шаблон причины бана по-умолчанию, text/template, поля см. в ReasonData.
+		ReasonTemplate string `json:"reason_template,omitempty"`
+
+		// Timezone - часовой пояс для времени в причине бана, например, Europe/Moscow. По-умолчанию локальный.
+		Timezone string `json:"timezone,omitempty"`
+
+		reasonTemplate *template.Template
+		location       *time.Location
 	} `json:"jabber,omitempty"`
 
 	CSign    string `json:"csign,omitempty"`
@@ -62,29 +74,191 @@ type MyConfig struct {
 	ExeName  string `json:"exe_name,omitempty"`
 }
 
+// MyChannel прототип структурки с настройками отдельного канала (комнаты конференции).
+type MyChannel struct {
+	Name     string `json:"name,omitempty"`
+	Nick     string `json:"nick,omitempty"`
+	Password string `json:"password,omitempty"`
+	Bayes    struct {
+		Enabled       bool   `json:"enabled,omitempty"`
+		MinWords      int64  `json:"min_words,omitempty"`
+		MinLength     int    `json:"min_length,omitempty"`
+		DefaultAction string `json:"default_action,omitempty"`
+	} `json:"bayes,omitempty"`
+	AllCaps struct {
+		Enabled       bool   `json:"enabled,omitempty"`
+		MinLength     int    `json:"min_length,omitempty"`
+		DefaultAction string `json:"default_action,omitempty"`
+	} `json:"all_caps,omitempty"`
+
+	// Corrections - что делать с участниками, которые слишком часто исправляют свои сообщения (xep-0308): больше
+	// MaxEdits исправлений за Window секунд.
+	Corrections struct {
+		MaxEdits      int    `json:"max_edits,omitempty"`
+		Window        int64  `json:"window,omitempty"`
+		DefaultAction string `json:"default_action,omitempty"`
+	} `json:"corrections,omitempty"`
+	OutdatedClients []OutdatedClient `json:"outdated_clients,omitempty"`
+	VersionQuery    struct {
+		Timeout   int64  `json:"timeout,omitempty"`
+		NoAnswer  string `json:"no_answer,omitempty"`
+		Error     string `json:"error,omitempty"`
+		EmptyName string `json:"empty_name,omitempty"`
+	} `json:"version_query,omitempty"`
+	Protect MyProtect `json:"protect,omitempty"`
+	Scoring MyScoring `json:"scoring,omitempty"`
+	Catchup MyCatchup `json:"catchup,omitempty"`
+	Retract MyRetract `json:"retract,omitempty"`
+
+	// Mode - режим комнаты: enforce (по-умолчанию) или shadow, в котором бот только сообщает, что бы он сделал.
+	Mode string `json:"mode,omitempty"`
+
+	// ReasonTemplate и Timezone переопределяют глобальные настройки для комнаты.
+	ReasonTemplate string `json:"reason_template,omitempty"`
+	Timezone       string `json:"timezone,omitempty"`
+
+	// Moderators - bare jid-ы, которым, как и владельцам и администраторам комнаты, можно модерировать комнату и
+	// править её списки командами бота.
+	Moderators []string `json:"moderators,omitempty"`
+
+	reasonTemplate *template.Template
+	location       *time.Location
+}
+
+// MyCatchup прототип структурки с настройками проверки сообщений, которые были написаны в комнату, пока бота в ней не
+// было.
+type MyCatchup struct {
+	Enabled bool `json:"enabled,omitempty"`
+
+	// MaxAge - насколько далеко в прошлое бот заглядывает, в секундах, по-умолчанию час. Более старые пропущенные
+	// сообщения бот не проверяет, даже если не видел их.
+	MaxAge int64 `json:"max_age,omitempty"`
+
+	// MaxMessages - сколько последних сообщений бот запрашивает из архива комнаты, по-умолчанию 100.
+	MaxMessages int `json:"max_messages,omitempty"`
+}
+
+// MyRetract прототип структурки с настройками удаления сообщений (xep-0425). Удалять сообщения бот может, только если
+// комната анонсирует urn:xmpp:message-moderate.
+type MyRetract struct {
+	// Enabled - удалять сообщение, на которое сработало правило.
+	Enabled bool `json:"enabled,omitempty"`
+
+	// OnBan - сколько последних сообщений участника удалять, когда его банят, 0 - не удалять.
+	OnBan int `json:"on_ban,omitempty"`
+
+	// Reason - что написать в причине удаления, может быть пустым.
+	Reason string `json:"reason,omitempty"`
+}
+
+// MyScoring прототип структурки с настройками подсчёта очков в комнате. Правила чёрного списка с заданным весом и
+// сигналы не банят сразу, а добавляют участнику очки, при достижении порогов применяется соответствующее действие.
+type MyScoring struct {
+	Enabled bool `json:"enabled,omitempty"`
+
+	// Window - сколько секунд помнить набранные очки.
+	Window int64 `json:"window,omitempty"`
+
+	// Пороги действий, 0 - действие не применяется.
+	Warn    float64 `json:"warn,omitempty"`
+	Devoice float64 `json:"devoice,omitempty"`
+	Kick    float64 `json:"kick,omitempty"`
+	Ban     float64 `json:"ban,omitempty"`
+
+	// WarnText - что написать участнику в приват при достижении порога warn.
+	WarnText string `json:"warn_text,omitempty"`
+
+	// Signals - веса сигналов, которые сами по себе не тянут на бан.
+	Signals struct {
+		AllCaps  float64 `json:"all_caps,omitempty"`
+		Bayes    float64 `json:"bayes,omitempty"`
+		Newcomer float64 `json:"newcomer,omitempty"`
+		Edits    float64 `json:"edits,omitempty"`
+	} `json:"signals,omitempty"`
+}
+
+// Threshold возвращает порог для действия.
+func (s *MyScoring) Threshold(action string) float64 {
+	switch action {
+	case "warn":
+		return s.Warn
+	case "devoice":
+		return s.Devoice
+	case "kick":
+		return s.Kick
+	case "ban":
+		return s.Ban
+	}
+
+	return 0
+}
+
+// OutdatedClient прототип структурки с правилом для устаревших клиентов: какое клиентское ПО считаем устаревшим и что
+// делаем с его пользователями (log, devoice, kick, ban).
+type OutdatedClient struct {
+	UserAgent
+
+	Action string `json:"action,omitempty"`
+
+	// matcher - скомпилированное при чтении конфига правило.
+	matcher *UserAgentMatcher
+}
+
 // MyWhiteList прототип структурки с белым списком jid-ов.
 type MyWhiteList struct {
-	Whitelist []struct {
-		RoomName string   `json:"room_name,omitempty"`
-		Jid      []string `json:"jid,omitempty"`
-		WipeBans bool     `json:"wipe_bans,omitempty"`
-	} `json:"whitelist,omitempty"`
+	Whitelist []WhiteListEntry `json:"whitelist,omitempty"`
+}
+
+// WhiteListEntry прототип структурки с одной записью белого списка: глобальной или для конкретной комнаты.
+type WhiteListEntry struct {
+	RoomName string         `json:"room_name,omitempty"`
+	Jid      []WhiteListJid `json:"jid,omitempty"`
+	WipeBans bool           `json:"wipe_bans,omitempty"`
+
+	// jids - скомпилированные при загрузке белого списка шаблоны из Jid.
+	jids []*JidPattern
 }
 
 // MyBlackList прототип структурки с чёрным списком jid-ов.
 type MyBlackList struct {
-	Blacklist []struct {
-		RoomName     string   `json:"room_name,omitempty"`
-		ReasonEnable bool     `json:"reason_enable,omitempty"`
-		JidRe        []string `json:"jid_re,omitempty"`
-		NickRe       []string `json:"nick_re,omitempty"`
-		PhraseRe     []string `json:"phrase_re,omitempty"`
-		UserAgent    []struct {
-			Name    string `json:"name,omitempty"`
-			Version string `json:"version,omitempty"`
-			Os      string `json:"os,omitempty"`
-		} `json:"user_agent,omitempty"`
-	} `json:"blacklist,omitempty"`
+	Blacklist []BlackListEntry `json:"blacklist,omitempty"`
+}
+
+// BlackListEntry прототип структурки с одной записью чёрного списка: глобальной или для конкретной комнаты.
+type BlackListEntry struct {
+	RoomName     string      `json:"room_name,omitempty"`
+	ReasonEnable bool        `json:"reason_enable,omitempty"`
+	JidRe        []string    `json:"jid_re,omitempty"`
+	NickRe       []string    `json:"nick_re,omitempty"`
+	PhraseRe     []string    `json:"phrase_re,omitempty"`
+	UserAgent    []UserAgent `json:"user_agent,omitempty"`
+	Expr         []string    `json:"expr,omitempty"`
+	Score        float64     `json:"score,omitempty"`
+	Action       string      `json:"action,omitempty"`
+	Duration     string      `json:"duration,omitempty"`
+	Reason       string      `json:"reason,omitempty"`
+	Expires      string      `json:"expires,omitempty"`
+	Mode         string      `json:"mode,omitempty"`
+
+	// userAgents - скомпилированные при загрузке чёрного списка правила из UserAgent.
+	userAgents []*UserAgentMatcher
+
+	// exprs - скомпилированные при загрузке чёрного списка выражения из Expr.
+	exprs []*Expr
+
+	// reason - скомпилированный при загрузке шаблон из Reason.
+	reason *template.Template
+
+	// duration - разобранный при загрузке Duration, для tempban.
+	duration time.Duration
+
+	// expires - разобранный при загрузке Expires, нулевое значение - правило бессрочное.
+	expires time.Time
+}
+
+// Expired сообщает, истёк ли срок действия записи чёрного списка.
+func (b *BlackListEntry) Expired() bool {
+	return !b.expires.IsZero() && time.Now().After(b.expires)
 }
 
 // Jabber основная структура-объект, содержащая стейты и проч.
@@ -98,14 +272,28 @@ type Jabber struct {
 	// BlackList - структурка с запрещёнными по регуляркам фразами, никами, jid-ами.
 	BlackList MyBlackList
 
+	// WhitelistFile и BlacklistFile - файлы, из которых загружены списки. Изменённые командами списки пишутся туда же.
+	WhitelistFile string
+	BlacklistFile string
+
+	// whitelistRaw и blacklistRaw - списки в json-е, как они были прочитаны из файлов, до того как prepareWhitelist и
+	// prepareBlacklist их поправили. Изменённые командами списки пишутся из них, чтобы в файл не попадали подставленные
+	// ботом значения.
+	whitelistRaw []byte
+	blacklistRaw []byte
+
 	// Опции подключения к xmpp-серверу.
 	Options *xmpp.Options
 
 	// gTomb пул активных горутин.
 	GTomb tomb.Tomb
 
+	// EventMu - события с сервера разбираются по одному, а отложенные действия таймеров (InEventLoop) выполняются
+	// между ними, так что им не надо самим защищать настройки комнат, списки и прочее состояние бота.
+	EventMu sync.Mutex
+
 	// Talk основная структурка xmpp-клиента.
-	Talk *xmpp.Client
+	Talk XMPPClient
 
 	// sync.Map-ка с капабилити сервера.
 	ServerCapsList *Collection
@@ -123,6 +311,16 @@ type Jabber struct {
 	// Время, когда был принят s2c pong.
 	ServerPingTimestampRx int64
 
+	// ServerPingSent - когда точно был отправлен последний c2s ping, ServerPingRTT - за сколько на него ответил сервер.
+	ServerPingSent time.Time
+	ServerPingRTT  time.Duration
+
+	// Connected - когда установлено текущее соединение с сервером.
+	Connected time.Time
+
+	// ListsLoaded - когда последний раз были прочитаны из файлов белый и чёрный списки.
+	ListsLoaded time.Time
+
 	// Время последней активности, нужно для jabber:iq:last.
 	LastActivity int64
 
@@ -150,6 +348,53 @@ type Jabber struct {
 
 	// Индикатор того, что соединение в процессе достукивания до сервера.
 	Connecting bool
+
+	// Replaying - события не настоящие, а прогоняются из записи (Replay). Команды при этом не выполняются, а только
+	// описываются в replayOut.
+	Replaying bool
+	replayOut io.Writer
+
+	// Очередь модерирующих действий (баны, кики, devoice), её разгребают ActionWorker-ы.
+	Actions *ActionQueue
+
+	// sync.Map-ка с отправленными, но ещё не отвеченными запросами jabber:iq:version, ключ - id запроса.
+	VersionQueries *Collection
+
+	// sync.Map-ка со сведениями об участниках комнат (*Occupant), ключ - полный ник вида room@conference.server/nick.
+	Occupants *Collection
+
+	// sync.Map-ка с репутацией участников, ключ - bare jid.
+	Reputations *Collection
+
+	// sync.Map-ка с последними никами участников, ключ - bare jid.
+	Nicks *Collection
+
+	// sync.Map-ка с таймерами, которые вернут голос лишённым его на время, ключ - см. muteKey.
+	Mutes *Collection
+
+	// Временные баны, которые надо будет снять.
+	TempBans *TempBanList
+
+	// Лишённые голоса на время, которым надо будет вернуть голос.
+	TempMutes *TempMuteList
+
+	// sync.Map-ка с набранными участниками очками (*occupantScore), ключ - комната|bare jid.
+	Scores *Collection
+
+	// Счётчики срабатываний правил чёрного списка.
+	RuleStats *RuleStatList
+
+	// Режимы комнат и правил, переключённые командой.
+	Modes *ModeList
+
+	// Последние виденные сообщения комнат и запросы к архивам комнат.
+	Catchup *CatchupList
+
+	// Комнаты, в которые бота позвали или из которых его увели командами.
+	Rooms *RoomList
+
+	// Реестр команд бота.
+	Commands *CommandRegistry
 }
 
 // SimpleIqGetQuery прототип структурки для разбора запросов xmpp discovery query, например,
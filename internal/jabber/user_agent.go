@@ -0,0 +1,253 @@
+package jabber
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// UserAgent прототип записи о клиентском ПО в чёрном списке. Каждое поле - регулярное выражение, которое должно
+// совпасть со всем значением целиком. Поле version вместо регулярки может содержать диапазон версий, например, "<1.2.0"
+// или ">=0.666 <0.700", несколько диапазонов можно объединить через "||". Пустое поле совпадает с чем угодно, но хотя
+// бы одно поле должно быть задано.
+type UserAgent struct {
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+	Os      string `json:"os,omitempty"`
+}
+
+// UserAgentMatcher скомпилированное правило для проверки клиентского ПО.
+type UserAgentMatcher struct {
+	// Source - правило, как оно записано в конфиге.
+	Source UserAgent
+
+	name    *regexp.Regexp
+	version *regexp.Regexp
+	os      *regexp.Regexp
+
+	// versionRange - набор альтернатив, каждая из которых - набор условий, которые должны выполняться одновременно.
+	versionRange [][]versionConstraint
+}
+
+// versionConstraint одно условие на версию, например, ">=1.2".
+type versionConstraint struct {
+	op      string
+	version string
+}
+
+// CompileUserAgent компилирует правило для проверки клиентского ПО.
+func CompileUserAgent(ua UserAgent) (*UserAgentMatcher, error) {
+	var (
+		m   = &UserAgentMatcher{Source: ua} //nolint:exhaustruct
+		err error
+	)
+
+	if ua.Name == "" && ua.Version == "" && ua.Os == "" {
+		return nil, errors.New("user_agent rule has no name, version or os, it would match everyone") //nolint:goerr113
+	}
+
+	if m.name, err = compileFullMatch(ua.Name); err != nil {
+		return nil, fmt.Errorf("incorrect name regexp %s: %w", ua.Name, err)
+	}
+
+	if m.os, err = compileFullMatch(ua.Os); err != nil {
+		return nil, fmt.Errorf("incorrect os regexp %s: %w", ua.Os, err)
+	}
+
+	if isVersionRange(ua.Version) {
+		if m.versionRange, err = parseVersionRange(ua.Version); err != nil {
+			return nil, fmt.Errorf("incorrect version range %s: %w", ua.Version, err)
+		}
+	} else if m.version, err = compileFullMatch(ua.Version); err != nil {
+		return nil, fmt.Errorf("incorrect version regexp %s: %w", ua.Version, err)
+	}
+
+	return m, nil
+}
+
+// Match проверяет, подходит ли ответ на запрос версии клиента под правило.
+func (m *UserAgentMatcher) Match(ver IqResultSoftwareVersion) bool {
+	if m.name != nil && !m.name.MatchString(ver.Name) {
+		return false
+	}
+
+	if m.os != nil && !m.os.MatchString(ver.Os) {
+		return false
+	}
+
+	if m.version != nil && !m.version.MatchString(ver.Version) {
+		return false
+	}
+
+	if m.versionRange != nil && !matchVersionRange(m.versionRange, ver.Version) {
+		return false
+	}
+
+	return true
+}
+
+// String возвращает правило в человекочитаемом виде, для логов.
+func (m *UserAgentMatcher) String() string {
+	var parts []string
+
+	if m.Source.Name != "" {
+		parts = append(parts, "name="+m.Source.Name)
+	}
+
+	if m.Source.Version != "" {
+		parts = append(parts, "version="+m.Source.Version)
+	}
+
+	if m.Source.Os != "" {
+		parts = append(parts, "os="+m.Source.Os)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// compileFullMatch компилирует регулярку так, чтобы она совпадала только со всей строкой целиком. Так точные значения
+// из старых чёрных списков продолжают работать как раньше. Для пустой строки возвращает nil.
+func compileFullMatch(re string) (*regexp.Regexp, error) {
+	if re == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	return regexp.Compile("^(?:" + re + ")$")
+}
+
+// isVersionRange определяет, записан ли в поле version диапазон версий, а не регулярка.
+func isVersionRange(s string) bool {
+	s = strings.TrimSpace(s)
+
+	return s != "" && strings.ContainsAny(s[:1], "<>=!")
+}
+
+// parseVersionRange разбирает диапазон версий вида ">=0.666 <0.700 || =1.0".
+func parseVersionRange(s string) ([][]versionConstraint, error) {
+	var alternatives [][]versionConstraint
+
+	for _, alt := range strings.Split(s, "||") {
+		var constraints []versionConstraint
+
+		for _, token := range strings.Fields(alt) {
+			var c versionConstraint
+
+			for _, op := range []string{">=", "<=", "==", "!=", ">", "<", "="} {
+				if strings.HasPrefix(token, op) {
+					c.op = op
+					c.version = strings.TrimPrefix(token, op)
+
+					break
+				}
+			}
+
+			if c.op == "" {
+				return nil, fmt.Errorf("%s has no comparison operator", token) //nolint:goerr113
+			}
+
+			if c.version == "" {
+				return nil, fmt.Errorf("%s has no version to compare with", token) //nolint:goerr113
+			}
+
+			constraints = append(constraints, c)
+		}
+
+		if len(constraints) == 0 {
+			return nil, errors.New("empty alternative in version range") //nolint:goerr113
+		}
+
+		alternatives = append(alternatives, constraints)
+	}
+
+	return alternatives, nil
+}
+
+// matchVersionRange проверяет, попадает ли версия в диапазон.
+func matchVersionRange(alternatives [][]versionConstraint, version string) bool {
+	for _, constraints := range alternatives {
+		matched := true
+
+		for _, c := range constraints {
+			cmp := CompareVersions(version, c.version)
+
+			switch c.op {
+			case "<":
+				matched = cmp < 0
+			case "<=":
+				matched = cmp <= 0
+			case ">":
+				matched = cmp > 0
+			case ">=":
+				matched = cmp >= 0
+			case "=", "==":
+				matched = cmp == 0
+			case "!=":
+				matched = cmp != 0
+			}
+
+			if !matched {
+				break
+			}
+		}
+
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CompareVersions сравнивает две версии в стиле semver: -1, если a < b, 0, если равны и 1, если a > b. Версии
+// разбиваются на части по точкам, дефисам, плюсам и пробелам, числовые части сравниваются как числа, остальные - как
+// строки. Недостающие части считаются нулями, то есть "1.2" и "1.2.0" равны.
+func CompareVersions(a, b string) int {
+	var (
+		splitter = func(r rune) bool { return r == '.' || r == '-' || r == '+' || r == '_' || r == ' ' }
+		pa       = strings.FieldsFunc(a, splitter)
+		pb       = strings.FieldsFunc(b, splitter)
+	)
+
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		sa, sb := "0", "0"
+
+		if i < len(pa) {
+			sa = pa[i]
+		}
+
+		if i < len(pb) {
+			sb = pb[i]
+		}
+
+		na, errA := strconv.ParseUint(sa, 10, 64)
+		nb, errB := strconv.ParseUint(sb, 10, 64)
+
+		switch {
+		case errA == nil && errB == nil:
+			if na != nb {
+				if na < nb {
+					return -1
+				}
+
+				return 1
+			}
+
+		// Число считается старше, чем строка: 1.0 > 1.0-rc1 в нашем разбиении будет 1.0.0 > 1.0.rc1.
+		case errA == nil:
+			return 1
+		case errB == nil:
+			return -1
+
+		default:
+			if c := strings.Compare(sa, sb); c != 0 {
+				return c
+			}
+		}
+	}
+
+	return 0
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
@@ -0,0 +1,79 @@
+package jabber
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.2", "1.2.0", 0},
+		{"1.2.0.0", "1.2", 0},
+		{"", "0", 0},
+		{"1.9", "1.10", -1},
+		{"1.10", "1.9", 1},
+		{"0.666", "0.700", -1},
+		{"2", "1.99.99", 1},
+		{"1.0-rc1", "1.0", -1},
+		{"1.0", "1.0-rc1", 1},
+		{"1.0-beta", "1.0-alpha", 1},
+		{"1.0+build5", "1.0+build5", 0},
+		{"1_2", "1.2", 0},
+		{"1.2 (Linux)", "1.2", -1},
+		{"18446744073709551615", "18446744073709551614", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+" vs "+tt.b, func(t *testing.T) {
+			if got := CompareVersions(tt.a, tt.b); got != tt.want {
+				t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseVersionRangeErrors(t *testing.T) {
+	for _, s := range []string{"", "||", ">=1.0 ||", "1.0", ">=1.0 2.0", ">=", "<1 || !="} {
+		if _, err := parseVersionRange(s); err == nil {
+			t.Errorf("parseVersionRange(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestMatchVersionRange(t *testing.T) {
+	tests := []struct {
+		rng     string
+		version string
+		want    bool
+	}{
+		{">=0.666 <0.700", "0.666", true},
+		{">=0.666 <0.700", "0.699.9", true},
+		{">=0.666 <0.700", "0.700", false},
+		{">=0.666 <0.700", "0.665", false},
+		{">=0.666 <0.700 || =1.0", "1.0.0", true},
+		{">=0.666 <0.700 || =1.0", "1.0.1", false},
+		{"==2.1", "2.1", true},
+		{"!=2.1", "2.1", false},
+		{"!=2.1", "2.2", true},
+		{"<=1.4", "1.4", true},
+		{">1.4", "1.4", false},
+		{"<1.0", "1.0-rc1", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rng+" "+tt.version, func(t *testing.T) {
+			rng, err := parseVersionRange(tt.rng)
+
+			if err != nil {
+				t.Fatalf("parseVersionRange(%q): %s", tt.rng, err)
+			}
+
+			if got := matchVersionRange(rng, tt.version); got != tt.want {
+				t.Errorf("matchVersionRange(%q, %q) = %t, want %t", tt.rng, tt.version, got, tt.want)
+			}
+		})
+	}
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
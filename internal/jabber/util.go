@@ -3,9 +3,11 @@ package jabber
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"math/rand"
 	"reflect"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -42,9 +44,9 @@ func InterfaceToStringSlice(iface interface{}) []string {
 	return mySlice
 }
 
-// GetRealJIDfromNick достаёт из запомненных presence-ов по даденному nick-у real jid с resource-ом. Nick должен
-// содержать имя конфы, откуда участник.
-func (j *Jabber) GetRealJIDfromNick(fullNick string) string {
+// GetPresence достаёт из запомненных presence-ов presence участника по даденному nick-у. Nick должен содержать имя
+// конфы, откуда участник.
+func (j *Jabber) GetPresence(fullNick string) (xmpp.Presence, bool) {
 	var p xmpp.Presence
 
 	room := (strings.SplitN(fullNick, "/", 2))[0]
@@ -54,7 +56,7 @@ func (j *Jabber) GetRealJIDfromNick(fullNick string) string {
 
 	// Никого нет дома
 	if !present {
-		return ""
+		return p, false
 	}
 
 	presenceJSONStrings := InterfaceToStringSlice(presenceJSONInterface)
@@ -63,10 +65,20 @@ func (j *Jabber) GetRealJIDfromNick(fullNick string) string {
 		_ = json.Unmarshal([]byte(presepresenceJSONString), &p)
 
 		if p.From == fullNick {
-			return p.JID
+			return p, true
 		}
 	}
 
+	return xmpp.Presence{}, false //nolint:exhaustruct
+}
+
+// GetRealJIDfromNick достаёт из запомненных presence-ов по даденному nick-у real jid с resource-ом. Nick должен
+// содержать имя конфы, откуда участник.
+func (j *Jabber) GetRealJIDfromNick(fullNick string) string {
+	if p, found := j.GetPresence(fullNick); found {
+		return p.JID
+	}
+
 	return ""
 }
 
@@ -82,6 +94,53 @@ func (j *Jabber) GetBotNickFromRoomConfig(room string) string {
 	return j.C.Jabber.Nick
 }
 
+// GetRoomConfig достаёт из конфига настройки комнаты. Если комната в конфиге не описана, возвращает nil.
+func (j *Jabber) GetRoomConfig(room string) *MyChannel {
+	for n := range j.C.Jabber.Channels {
+		if j.C.Jabber.Channels[n].Name == room {
+			return &j.C.Jabber.Channels[n]
+		}
+	}
+
+	return nil
+}
+
+// InEventLoop выполняет f так же, как разбирается событие с сервера: не одновременно с другими событиями. Так должны
+// выполняться отложенные действия (таймеры), которые читают или меняют состояние бота.
+func (j *Jabber) InEventLoop(f func()) {
+	j.EventMu.Lock()
+	defer j.EventMu.Unlock()
+
+	f()
+}
+
+// ParseDuration разбирает длительность в формате time.ParseDuration, дополнительно понимая сутки и недели: "90m",
+// "12h", "3d", "2w".
+func ParseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, found := strings.CutSuffix(s, suffix); found {
+			count, err := strconv.ParseFloat(n, 64)
+
+			// NaN, бесконечность и то, что не влезает в time.Duration, тоже не длительность.
+			if err != nil || !(count > 0) || count*float64(unit) >= math.MaxInt64 {
+				return 0, fmt.Errorf("incorrect duration %s", s) //nolint:goerr113
+			}
+
+			return time.Duration(count * float64(unit)), nil
+		}
+	}
+
+	d, err := time.ParseDuration(s)
+
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("incorrect duration %s", s) //nolint:goerr113
+	}
+
+	return d, nil
+}
+
 // RotateStatus периодически изменяет статус бота в MUC-е согласно настройкам из кофига.
 func (j *Jabber) RotateStatus(room string) error {
 	for {
@@ -90,6 +149,11 @@ func (j *Jabber) RotateStatus(room string) error {
 		totalSleepTime += time.Duration(j.C.Jabber.RuntimeStatus.RotationSplayTime) * time.Second
 
 		for {
+			// Из комнаты бот ушёл, а presence в неё снова зашёл бы.
+			if room != "" && !slices.Contains(j.RoomsConnected, room) {
+				return nil
+			}
+
 			status := RandomPhrase(j.C.Jabber.RuntimeStatus.Text)
 			log.Debugf("Set status for MUC: %s to: %s", room, status)
 
@@ -155,7 +219,7 @@ func (j *Jabber) JoinMuc(room string) error {
 	}
 
 	// Заходим в конфу, наконец-то
-	if _, err := j.Talk.JoinMUCNoHistory(room, j.GetBotNickFromRoomConfig(room)); err != nil {
+	if err := j.joinRoom(room); err != nil {
 		return fmt.Errorf("unable to join to MUC: %s, %w", room, err)
 	}
 
@@ -189,6 +253,11 @@ func (j *Jabber) JoinMuc(room string) error {
 
 	j.GTomb.Go(func() error { return j.RotateStatus(room) })
 
+	// Проверим, что написали в комнату, пока нас не было.
+	if err := j.RequestArchive(room); err != nil {
+		return err
+	}
+
 	// Время проверить участников на предмет злобности
 	namesInterface, present := j.RoomPresences.Get(room)
 
@@ -200,7 +269,7 @@ func (j *Jabber) JoinMuc(room string) error {
 			_ = json.Unmarshal([]byte(name), &v)
 			log.Infof("Fake presence forged for %s just for on-enter check", name)
 			// Оно там внутри всё само обработает, если вдруг возникнет wire error, то зарекконетится.
-			_ = j.BunyPresense(v)
+			_, _ = j.BunyPresense(v)
 		}
 	}
 
@@ -221,12 +290,14 @@ func (j *Jabber) EstablishConnection() error {
 	j.RoomsConnected = make([]string, 0)
 
 	log.Debugf("Establishing connection to %s", j.Options.Host)
-	j.Talk, err = j.Options.NewClient()
+	talk, err := j.Options.NewClient()
 
 	if err != nil {
 		return fmt.Errorf("unable to connect to %s: %w", j.Options.Host, err)
 	}
 
+	j.Talk = talk
+
 	// По идее keepalive должен же проходить только, если мы уже на сервере, так?
 	if _, err := j.Talk.SendKeepAlive(); err != nil {
 		return fmt.Errorf("try to send initial KeepAlive, got error: %w", err)
@@ -244,6 +315,7 @@ func (j *Jabber) EstablishConnection() error {
 	j.GTomb.Go(func() error { return j.RotateStatus("") })
 
 	j.LastActivity = time.Now().Unix()
+	j.Connected = time.Now()
 	j.Connecting = false
 	j.IsConnected = true
 
@@ -320,6 +392,7 @@ func (j *Jabber) ProbeServerLiveness() error { //nolint:gocognit
 							}
 
 							j.ServerPingTimestampTx = time.Now().Unix()
+							j.ServerPingSent = time.Now()
 						}
 					} else { // Первая пуля пока не вылетела, отправляем
 						log.Debugf("Sending first c2s ping from %s to %s", j.Talk.JID(), j.C.Jabber.Server)
@@ -329,6 +402,7 @@ func (j *Jabber) ProbeServerLiveness() error { //nolint:gocognit
 						}
 
 						j.ServerPingTimestampTx = time.Now().Unix()
+						j.ServerPingSent = time.Now()
 					}
 
 				// Сервер не анонсировал, что умеет в c2s пинги
@@ -0,0 +1,49 @@
+package jabber
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"90m", 90 * time.Minute},
+		{"12h", 12 * time.Hour},
+		{"1h30m", 90 * time.Minute},
+		{"45s", 45 * time.Second},
+		{" 2h ", 2 * time.Hour},
+		{"3d", 3 * 24 * time.Hour},
+		{"1.5d", 36 * time.Hour},
+		{"2w", 14 * 24 * time.Hour},
+		{"0.5w", 84 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseDuration(tt.in)
+
+			if err != nil {
+				t.Fatalf("ParseDuration(%q): %s", tt.in, err)
+			}
+
+			if got != tt.want {
+				t.Errorf("ParseDuration(%q) = %s, want %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDurationErrors(t *testing.T) {
+	for _, s := range []string{
+		"", "3", "d", "w", "0d", "-1d", "0s", "-5m", "xd", "3 d", "1y", "NaNd", "Infw", "100000w", "10dd",
+	} {
+		if d, err := ParseDuration(s); err == nil {
+			t.Errorf("ParseDuration(%q) = %s, want error", s, d)
+		}
+	}
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */
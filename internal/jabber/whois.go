@@ -0,0 +1,184 @@
+package jabber
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// whoisActions - сколько последних действий против участника показывает !whois.
+const whoisActions = 5
+
+// whoisHistoryDays - за сколько последних дней !whois ищет санкции в журнале модерации, чтобы не читать его целиком.
+const whoisHistoryDays = 30
+
+// registerWhoisCommand добавляет в реестр команду !whois.
+func registerWhoisCommand(r *CommandRegistry) {
+	r.Register(&Command{ //nolint:exhaustruct
+		Name:    "whois",
+		Aliases: []string{"кто"},
+		Usage:   "[room] <nick>",
+		Help:    "tell what is known about occupant",
+		MinArgs: 1,
+		MaxArgs: 2,
+		Places:  CmdAnywhere,
+		Private: true,
+		Run:     (*Jabber).cmdWhois,
+	})
+}
+
+// cmdWhois рассказывает, что бот знает об участнике комнаты. Real jid, историю ников и jid-ы тех, кто применял к
+// участнику санкции, видят только bot_masters и владельцы, администраторы и модераторы комнаты. Остальные могут
+// спрашивать только про комнату, откуда пришла команда, иначе по чужим комнатам можно было бы выяснять, кто где сидит.
+func (j *Jabber) cmdWhois(r *CmdRequest) string {
+	room, args := j.cmdRoom(r)
+
+	if room == "" || len(args) != 1 {
+		return r.Usage(j.C.CSign)
+	}
+
+	privileged := j.IsMaster(r.JID) || j.IsRoomAdmin(room, r.JID)
+
+	if !privileged && room != r.Room {
+		return deniedAnswer
+	}
+
+	// Искать по jid-у могут только те, кому real jid-ы видны, иначе это способ их подбирать.
+	if strings.Contains(args[0], "@") && !privileged {
+		if _, known := j.GetOccupant(room + "/" + args[0]); !known {
+			return fmt.Sprintf("There is no %s in %s", args[0], room)
+		}
+	}
+
+	from, jid := j.resolveTarget(room, args[0])
+
+	if from == room {
+		return fmt.Sprintf("There is no %s in %s", args[0], room)
+	}
+
+	var (
+		nick  = strings.SplitN(from, "/", 2)[1]
+		o, _  = j.GetOccupant(from)
+		p, _  = j.GetPresence(from)
+		lines = []string{fmt.Sprintf("%s in %s", nick, room)}
+	)
+
+	if privileged {
+		if jid == "" {
+			jid = "unknown"
+		}
+
+		lines = append(lines, "JID: "+jid)
+	}
+
+	// Сведения об участнике заводятся по presence-у, но на всякий случай подстрахуемся самим presence-ом.
+	affiliation, role := o.Affiliation, o.Role
+
+	if affiliation == "" {
+		affiliation, role = p.Affiliation, p.Role
+	}
+
+	lines = append(lines, fmt.Sprintf("Affiliation: %s, role: %s", orNone(affiliation), orNone(role)))
+
+	if !o.Joined.IsZero() {
+		lines = append(lines, fmt.Sprintf(
+			"Joined: %s (%s ago)", o.Joined.Format("2006-01-02 15:04:05"), o.Age().Round(time.Second),
+		))
+	}
+
+	if o.Client.Name != "" {
+		client := strings.TrimSpace(o.Client.Name + " " + o.Client.Version)
+
+		if o.Client.Os != "" {
+			client += " (" + o.Client.Os + ")"
+		}
+
+		lines = append(lines, "Client: "+client)
+	} else {
+		lines = append(lines, "Client: unknown")
+	}
+
+	if len(o.Caps) > 0 {
+		lines = append(lines, fmt.Sprintf("Caps (%d): %s", len(o.Caps), strings.Join(o.Caps, ", ")))
+	}
+
+	if o.JID != "" {
+		if nicks := j.NickHistory(o.JID); privileged && len(nicks) > 0 {
+			lines = append(lines, "Nicks: "+strings.Join(nicks, ", "))
+		}
+
+		lines = append(lines, fmt.Sprintf("Reputation: %d", j.Reputation(o.JID)))
+	}
+
+	lines = append(lines, j.priorActions(room, nick, o.JID, privileged)...)
+
+	return strings.Join(lines, "\n")
+}
+
+// priorActions возвращает последние действия против участника из журнала модерации: по его jid-у во всех комнатах,
+// а если jid неизвестен - по нику в комнате room. Непривилегированным показываются только действия в комнате room,
+// чтобы не связывать участника с другими комнатами. Действия в режиме shadow и невыполненные тоже показываются, с
+// пометкой. Журнал читается только за последние whoisHistoryDays дней.
+func (j *Jabber) priorActions(room, nick, jid string, privileged bool) []string {
+	var actions []string
+
+	err := j.ReadAudit(time.Now().AddDate(0, 0, -whoisHistoryDays), func(r AuditRecord) {
+		switch {
+		case jid != "" && r.JID == jid && (privileged || r.Room == room):
+		case jid == "" && r.Room == room && r.Nick == nick:
+		default:
+			return
+		}
+
+		line := fmt.Sprintf("%s %s in %s", r.Time.Format("2006-01-02 15:04"), r.Action, r.Room)
+
+		if r.Duration != "" {
+			line += " for " + r.Duration
+		}
+
+		if r.Why != "" {
+			line += ": " + r.Why
+		}
+
+		if r.By != "" && privileged {
+			line += " by " + r.By
+		}
+
+		if r.Shadow {
+			line += " (shadow)"
+		}
+
+		if r.Failed != "" {
+			line += " (not done: " + r.Failed + ")"
+		}
+
+		actions = append(actions, line)
+	})
+
+	if err != nil {
+		log.Errorf("Unable to read prior actions for whois: %s", err)
+	}
+
+	if len(actions) == 0 {
+		return []string{"Prior actions: none"}
+	}
+
+	if len(actions) > whoisActions {
+		actions = actions[len(actions)-whoisActions:]
+	}
+
+	return append([]string{"Prior actions:"}, actions...)
+}
+
+// orNone подставляет none вместо пустой строки.
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+
+	return s
+}
+
+/* vim: set ft=go noet ai ts=4 sw=4 sts=4: */